@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/unitechio/agent/internal/config"
+	"github.com/unitechio/agent/internal/identity"
+)
+
+// enroll bootstraps the agent from an enrollment bundle file, enrollment URL
+// or enrollment token and saves the configuration without starting the agent:
+//
+//	agent enroll [-config path] [-force] <bundle file | enrollment URL | token>
+func enroll(args []string) error {
+	flags := flag.NewFlagSet("enroll", flag.ExitOnError)
+	configPath := flags.String("config", getDefaultConfigPath(), "Path to configuration file")
+	force := flags.Bool("force", false, "Enroll again even if the agent is already enrolled")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: agent enroll [-config path] [-force] <bundle file | enrollment URL | token>")
+	}
+
+	if existing, err := config.Load(*configPath); err == nil && existing.Bootstrapped && !*force {
+		return fmt.Errorf("agent is already enrolled as %s (use -force to enroll again)", existing.AgentID)
+	}
+
+	enrollment, err := config.ReadEnrollment(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := bootstrapEnrollment(ctx, enrollment)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Save(*configPath); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+
+	fmt.Printf("Enrolled as agent %s in org %s\n", cfg.AgentID, cfg.OrgID)
+	return nil
+}
+
+// bootstrapEnrollment registers the agent with an enrollment, explaining
+// rejected install tokens
+func bootstrapEnrollment(ctx context.Context, enrollment *config.Enrollment) (*config.Config, error) {
+	cfg := config.NewBootstrapConfig()
+	enrollment.Apply(cfg)
+
+	cfg, err := identity.RunBootstrap(ctx, cfg)
+	switch {
+	case errors.Is(err, identity.ErrTokenExpired):
+		return nil, fmt.Errorf("%w; request a new enrollment from your administrator", err)
+	case errors.Is(err, identity.ErrTokenUsed):
+		return nil, fmt.Errorf("%w; enrollment tokens are single-use, request a new one", err)
+	case err != nil:
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// enrollmentFilePath returns where installers drop an enrollment bundle for
+// the agent to pick up on first start: ENROLLMENT_FILE, or enrollment.json
+// next to the config file
+func enrollmentFilePath(configPath string) string {
+	if path := os.Getenv("ENROLLMENT_FILE"); path != "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configPath), "enrollment.json")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"syscall"
 	"time"
@@ -17,15 +19,31 @@ import (
 	"github.com/unitechio/agent/internal/config"
 	"github.com/unitechio/agent/internal/health"
 	"github.com/unitechio/agent/internal/identity"
+	"github.com/unitechio/agent/internal/logging"
 	"github.com/unitechio/agent/internal/policy"
 	"github.com/unitechio/agent/internal/scheduler"
+	"github.com/unitechio/agent/internal/sender"
 )
 
 const version = "1.0.0"
 
+// shutdownTimeout bounds how long main waits for run to stop the components
+// and flush telemetry after the tray exits
+const shutdownTimeout = 30 * time.Second
+
 func main() {
+	// agent enroll <bundle | URL | token> registers the agent and exits
+	if len(os.Args) > 1 && os.Args[1] == "enroll" {
+		if err := enroll(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	configPath := flag.String("config", getDefaultConfigPath(), "Path to configuration file")
 	showVersion := flag.Bool("version", false, "Show version and exit")
+	showPolicy := flag.Bool("show-policy", false, "Print the effective policy and the origin of each value, then exit")
 	flag.Parse()
 
 	if *showVersion {
@@ -33,6 +51,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *showPolicy {
+		if err := printPolicy(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	logger := log.New(os.Stdout, "[AGENT] ", log.LstdFlags|log.Lshortfile)
 	logger.Printf("Starting enterprise-agent v%s", version)
 
@@ -40,7 +66,10 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Start agent ở background
+	// done is closed once run has stopped every component
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		if err := run(ctx, *configPath, logger); err != nil {
 			logger.Printf("Agent stopped with error: %v", err)
 			systray.Quit()
@@ -61,6 +90,14 @@ func main() {
 		logger.Println("Systray exiting")
 		cancel()
 	})
+
+	// Let run flush telemetry before the process exits
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		logger.Printf("Agent did not stop within %v, exiting", shutdownTimeout)
+	}
 }
 
 func run(ctx context.Context, configPath string, logger *log.Logger) error {
@@ -71,14 +108,27 @@ func run(ctx context.Context, configPath string, logger *log.Logger) error {
 		// Step 2: No config exists - enter bootstrap mode
 		logger.Println("No configuration found, starting bootstrap process...")
 
-		// Step 3: Create minimal bootstrap config from environment
+		// Step 3: Create minimal bootstrap config from an enrollment bundle
+		// dropped by the installer, or else from environment
 		cfg = config.NewBootstrapConfig()
+		enrollmentFile := enrollmentFilePath(configPath)
+		if _, err := os.Stat(enrollmentFile); err == nil {
+			enrollment, err := config.LoadEnrollment(enrollmentFile)
+			if err == nil {
+				err = enrollment.Validate()
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read enrollment bundle: %w", err)
+			}
+			enrollment.Apply(cfg)
+			logger.Printf("Using enrollment bundle %s", enrollmentFile)
+		}
 
-		// DEBUG: Log values being used for bootstrap
-		logger.Printf("DEBUG: Loaded bootstrap config: OrgID='%s', InstallToken='%s'(len:%d)", cfg.OrgID, cfg.InstallToken, len(cfg.InstallToken))
+		// Never log the install token itself
+		logger.Printf("Loaded bootstrap config: OrgID='%s', install token present: %t", cfg.OrgID, cfg.InstallToken != "")
 
 		if err := cfg.ValidateBootstrap(); err != nil {
-			return fmt.Errorf("bootstrap validation failed: %w\nPlease set ORG_ID and INSTALL_TOKEN environment variables", err)
+			return fmt.Errorf("bootstrap validation failed: %w\nPlease set ORG_ID and INSTALL_TOKEN environment variables or run 'agent enroll'", err)
 		}
 
 		// Step 4: Run bootstrap with retry
@@ -94,6 +144,11 @@ func run(ctx context.Context, configPath string, logger *log.Logger) error {
 		}
 		logger.Println("Bootstrap successful, configuration saved")
 
+		// The bundle's install token is spent; don't leave it on disk
+		if err := os.Remove(enrollmentFile); err != nil && !os.IsNotExist(err) {
+			logger.Printf("Warning: failed to remove enrollment bundle: %v", err)
+		}
+
 	} else if err != nil {
 		// Step 6: Config load failed for other reasons
 		return fmt.Errorf("failed to load configuration: %w", err)
@@ -111,8 +166,9 @@ func run(ctx context.Context, configPath string, logger *log.Logger) error {
 	if err != nil {
 		return fmt.Errorf("failed to create identity manager: %w", err)
 	}
+	defer func() { identityMgr.Close() }()
 
-	// Step 9: Check if re-bootstrap is needed (cert expiration)
+	// Step 9: Check if re-bootstrap is needed (cert expired or invalid)
 	if identityMgr.NeedsRebootstrap() {
 		logger.Println("Certificate expired or invalid, re-bootstrapping...")
 
@@ -129,11 +185,14 @@ func run(ctx context.Context, configPath string, logger *log.Logger) error {
 		}
 
 		// Recreate identity manager with new certs
+		identityMgr.Close()
 		identityMgr, err = identity.NewManager(cfg, logger)
 		if err != nil {
 			return fmt.Errorf("failed to recreate identity manager: %w", err)
 		}
 
+		// The replaced key is kept until the sender re-wraps the buffer keyring
+
 		logger.Println("Re-bootstrap successful")
 	}
 
@@ -144,53 +203,190 @@ func run(ctx context.Context, configPath string, logger *log.Logger) error {
 
 	logger.Printf("Identity verified: Agent ID = %s", identityMgr.GetAgentID())
 
-	// Step 11: Initialize policy engine
+	// Step 11: Initialize audit logger
+	auditLogger, err := logging.NewAuditLogger(auditLogPath(cfg), cfg.AgentID)
+	if err != nil {
+		return fmt.Errorf("failed to create audit logger: %w", err)
+	}
+	defer auditLogger.Close()
+
+	// Renew or re-bootstrap when the backend rejects the agent certificate
+	identityMgr.SetAuditLogger(auditLogger)
+	identityMgr.Subscribe(func(change identity.Change) {
+		if change.Reason == identity.ChangeRebootstrapped {
+			// Save a copy: the running components keep reading cfg, so a
+			// new API URL takes effect on the next start
+			saved := *cfg
+			saved.MarkBootstrapped(change.AgentID, change.APIBaseURL)
+			if err := saved.Save(configPath); err != nil {
+				logger.Printf("Warning: failed to save config after re-bootstrap: %v", err)
+			}
+			if change.APIBaseURL != cfg.APIBaseURL {
+				logger.Printf("Re-bootstrap moved the agent to %s, restart to connect to it", change.APIBaseURL)
+			}
+		}
+	})
+
+	// Step 12: Initialize policy engine (loads the last known good policy)
+	if cfg.PolicyCacheFile == "" {
+		cfg.PolicyCacheFile = defaultPolicyCachePath(configPath)
+	}
 	policyEngine, err := policy.NewEngine(cfg, identityMgr, logger)
 	if err != nil {
 		return fmt.Errorf("failed to create policy engine: %w", err)
 	}
 
+	// Record every policy transition and rejection in the audit log
+	policyEngine.SetAuditLogger(auditLogger)
+	policyEngine.Subscribe(func(change policy.Change) {
+		auditLogger.LogPolicyChange(change.Old.Version, change.New.Version)
+	})
+
+	// Check this is the host the agent was bootstrapped on, before the
+	// sender opens the buffer under the (possibly new) identity
+	drift, err := identityMgr.CheckFingerprint()
+	if err != nil {
+		logger.Printf("Warning: failed to check host fingerprint: %v", err)
+	}
+	err = identityMgr.HandleDrift(ctx, drift, policyEngine.GetFingerprintDriftReaction())
+	switch {
+	case errors.Is(err, identity.ErrHostMismatch):
+		return fmt.Errorf("host fingerprint check failed: %w", err)
+	case err != nil:
+		// Retried after the next heartbeat
+		logger.Printf("Warning: failed to handle host fingerprint drift: %v", err)
+	}
+
 	// Fetch initial policy
 	if err := policyEngine.Refresh(ctx); err != nil {
-		logger.Printf("Warning: failed to fetch initial policy, using defaults: %v", err)
+		logger.Printf("Warning: failed to fetch initial policy, keeping policy %s: %v", policyEngine.Get().Version, err)
 	}
 
-	// Step 12: Initialize health monitor
+	// Step 13: Initialize telemetry sender
+	telemetrySender, err := sender.NewSender(cfg, policyEngine, identityMgr, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create sender: %w", err)
+	}
+	telemetrySender.Start(ctx)
+
+	// Rotate the certificate before it expires; the sender re-keys its buffer on each change
+	identityMgr.StartRenewal(ctx)
+
+	// Step 14: Initialize health monitor (reports buffer and drop counters)
 	healthMonitor := health.NewMonitor(cfg, identityMgr, logger)
+	healthMonitor.SetSender(telemetrySender)
+
+	// Apply the policy's reaction when a heartbeat finds the host changed
+	hostMismatch := make(chan error, 1)
+	healthMonitor.OnFingerprintDrift(func(drift *identity.Drift) {
+		err := identityMgr.HandleDrift(ctx, drift, policyEngine.GetFingerprintDriftReaction())
+		switch {
+		case errors.Is(err, identity.ErrHostMismatch):
+			select {
+			case hostMismatch <- err:
+			default:
+			}
+		case err != nil:
+			logger.Printf("Failed to handle host fingerprint drift: %v", err)
+		}
+	})
 	healthMonitor.Start(ctx)
 
-	// Step 13: Initialize scheduler
-	sched := scheduler.New(cfg, policyEngine, identityMgr, logger)
+	// Step 15: Initialize scheduler
+	sched := scheduler.New(cfg, policyEngine, identityMgr, telemetrySender, logger)
 	if err := sched.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start scheduler: %w", err)
 	}
 
 	logger.Println("Agent running successfully")
 
-	// Step 14: Periodically refresh policy and check for updates
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
+	// Step 16: Refresh policy on the schedule suggested by the server
+	refreshTimer := time.NewTimer(policyEngine.NextRefresh())
+	defer refreshTimer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			logger.Println("Shutting down agent...")
 
-			// Stop components gracefully
+			// Stop components gracefully; the scheduler goes first so the
+			// sender's final flush includes the last collected records
 			sched.Stop()
+			telemetrySender.Stop()
 			healthMonitor.Stop()
 
 			return nil
 
-		case <-ticker.C:
+		case err := <-hostMismatch:
+			logger.Printf("Stopping agent: %v", err)
+
+			sched.Stop()
+			telemetrySender.Stop()
+			healthMonitor.Stop()
+
+			return err
+
+		case <-refreshTimer.C:
 			// Periodic policy refresh
 			if err := policyEngine.Refresh(ctx); err != nil {
 				logger.Printf("Failed to refresh policy: %v", err)
 			}
+			refreshTimer.Reset(policyEngine.NextRefresh())
 		}
 	}
 }
 
+// printPolicy prints the effective policy (cache, bootstrap policy and
+// override merged) with the origin of every value, without contacting the server
+func printPolicy(configPath string) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if cfg.PolicyCacheFile == "" {
+		cfg.PolicyCacheFile = defaultPolicyCachePath(configPath)
+	}
+
+	// Keep diagnostics off stdout so the output stays valid JSON
+	logger := log.New(os.Stderr, "[AGENT] ", log.LstdFlags)
+
+	identityMgr, err := identity.NewManager(cfg, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create identity manager: %w", err)
+	}
+	defer identityMgr.Close()
+
+	policyEngine, err := policy.NewEngine(cfg, identityMgr, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create policy engine: %w", err)
+	}
+
+	out := struct {
+		Policy  *policy.Policy           `json:"policy"`
+		Origins map[string]policy.Source `json:"origins"`
+	}{
+		Policy:  policyEngine.Get(),
+		Origins: policyEngine.Origins(),
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
+
+// defaultPolicyCachePath keeps the policy cache next to the config file
+func defaultPolicyCachePath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "policy.json")
+}
+
+// auditLogPath returns the configured audit log, defaulting to audit.log next to the agent log
+func auditLogPath(cfg *config.Config) string {
+	if cfg.AuditLogFile != "" {
+		return cfg.AuditLogFile
+	}
+	return filepath.Join(filepath.Dir(cfg.LogFile), "audit.log")
+}
+
 func getDefaultConfigPath() string {
 	if path := os.Getenv("AGENT_CONFIG"); path != "" {
 		return path
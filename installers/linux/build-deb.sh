@@ -82,6 +82,12 @@ if ! id -u ${PACKAGE_NAME} > /dev/null 2>&1; then
     useradd --system --no-create-home --shell /usr/sbin/nologin ${PACKAGE_NAME}
 fi
 
+# An agent bootstrapped before host fingerprinting records this host once
+CERT_DIR=/var/lib/${PACKAGE_NAME}/certs
+if [ "$1" = "configure" ] && [ -n "$2" ] && [ -f ${CERT_DIR}/agent.crt ] && [ ! -f ${CERT_DIR}/host_fingerprint.json ]; then
+    touch ${CERT_DIR}/host_fingerprint.migrate
+fi
+
 # Set permissions
 chown -R ${PACKAGE_NAME}:${PACKAGE_NAME} /var/lib/${PACKAGE_NAME}
 chown -R ${PACKAGE_NAME}:${PACKAGE_NAME} /var/log/${PACKAGE_NAME}
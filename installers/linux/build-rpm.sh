@@ -102,6 +102,11 @@ getent passwd %{name} >/dev/null || useradd -r -g %{name} -s /sbin/nologin -c "E
 exit 0
 
 %post
+# An agent bootstrapped before host fingerprinting records this host once
+if [ \$1 -ge 2 ] && [ -f /var/lib/%{name}/certs/agent.crt ] && [ ! -f /var/lib/%{name}/certs/host_fingerprint.json ]; then
+    touch /var/lib/%{name}/certs/host_fingerprint.migrate
+fi
+
 # Set permissions
 chown -R %{name}:%{name} /var/lib/%{name}
 chown -R %{name}:%{name} /var/log/%{name}
@@ -57,6 +57,12 @@ EOF
 cat > ${BUILD_DIR}/scripts/postinstall <<'EOF'
 #!/bin/bash
 
+# An agent bootstrapped before host fingerprinting records this host once
+CERT_DIR=/var/lib/your-agent/certs
+if [ -f ${CERT_DIR}/agent.crt ] && [ ! -f ${CERT_DIR}/host_fingerprint.json ]; then
+    touch ${CERT_DIR}/host_fingerprint.migrate
+fi
+
 # Set permissions
 chown -R root:wheel /usr/local/bin/your-agent
 chown -R root:wheel /var/lib/your-agent
@@ -3,147 +3,325 @@ package buffer
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
-// Buffer provides persistent storage for telemetry when offline
+// Logger is the logging interface used by the buffer
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// SyncPolicy controls when buffered records are fsynced to disk
+type SyncPolicy string
+
+const (
+	SyncAlways   SyncPolicy = "always"   // fsync after every record
+	SyncInterval SyncPolicy = "interval" // fsync at most once per sync interval
+	SyncNever    SyncPolicy = "never"    // leave flushing to the OS
+)
+
+// ParseSyncPolicy parses a sync policy name, defaulting to SyncAlways when empty
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch policy := SyncPolicy(name); policy {
+	case "":
+		return SyncAlways, nil
+	case SyncAlways, SyncInterval, SyncNever:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidSync, name)
+	}
+}
+
+// Buffer provides persistent storage for telemetry when offline.
+// Each priority class is a segmented write-ahead log (see wal.go) in its own
+// subdirectory; the size limit and retention apply across all of them.
 type Buffer struct {
-	dir         string
-	maxSize     int64
-	logger      *log.Logger
-	mu          sync.Mutex
-	currentSize int64
+	dir             string
+	maxSize         int64
+	segmentSize     int64
+	logger          Logger
+	mu              sync.Mutex
+	queues          map[Priority]*queue
+	keys            *keyring // nil until SetEncryptionKey
+	syncPolicy      SyncPolicy
+	syncInterval    time.Duration
+	retention       Retention
+	dropped         DropCounter
+	droppedByClass  map[string]DropCounter
+	droppedByReason map[string]DropCounter
 }
 
-// New creates a new buffer
-func New(dir string, maxSize int64, logger *log.Logger) (*Buffer, error) {
+// New creates a new buffer, recovering any records left by a previous run
+func New(dir string, maxSize int64, logger Logger) (*Buffer, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, fmt.Errorf("failed to create buffer directory: %w", err)
 	}
 
 	b := &Buffer{
-		dir:     dir,
-		maxSize: maxSize,
-		logger:  logger,
+		dir:             dir,
+		maxSize:         maxSize,
+		segmentSize:     defaultSegmentSize,
+		logger:          logger,
+		queues:          make(map[Priority]*queue),
+		syncPolicy:      SyncAlways,
+		syncInterval:    time.Second,
+		retention:       Retention{Eviction: EvictOldest},
+		droppedByClass:  make(map[string]DropCounter),
+		droppedByReason: make(map[string]DropCounter),
+	}
+
+	for _, priority := range priorities {
+		q, err := openQueue(b, priority)
+		if err != nil {
+			return nil, err
+		}
+		b.queues[priority] = q
 	}
 
-	// Calculate current size
-	if err := b.calculateSize(); err != nil {
-		logger.Printf("Warning: failed to calculate buffer size: %v", err)
+	if err := b.migrateLegacy(); err != nil {
+		logger.Printf("Warning: failed to migrate legacy buffer files: %v", err)
+	}
+
+	if records := b.Len(); records > 0 {
+		logger.Printf("Recovered %d buffered records (%d bytes)", records, b.Size())
 	}
 
 	return b, nil
 }
 
-// Write adds data to the buffer
-func (b *Buffer) Write(data interface{}) error {
+// SetSyncPolicy sets when records are fsynced. The interval only applies to SyncInterval.
+func (b *Buffer) SetSyncPolicy(policy SyncPolicy, interval time.Duration) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	// Serialize data
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("failed to marshal data: %w", err)
+	b.syncPolicy = policy
+	if interval > 0 {
+		b.syncInterval = interval
 	}
+}
 
-	// Check size limit
-	if b.currentSize+int64(len(jsonData)) > b.maxSize {
-		return fmt.Errorf("buffer full (current: %d, max: %d)", b.currentSize, b.maxSize)
+// SetRetention sets the maximum record ages and eviction order
+func (b *Buffer) SetRetention(retention Retention) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if retention.Eviction == "" {
+		retention.Eviction = EvictOldest
 	}
+	b.retention = retention
+}
 
-	// Write to file with timestamp
-	filename := fmt.Sprintf("batch_%d.json", time.Now().UnixNano())
-	path := filepath.Join(b.dir, filename)
+// migrateLegacy moves batch_<nanos>.json files written by older agents into the WAL
+func (b *Buffer) migrateLegacy() error {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read buffer directory: %w", err)
+	}
 
-	if err := os.WriteFile(path, jsonData, 0600); err != nil {
-		return fmt.Errorf("failed to write buffer file: %w", err)
+	type legacyFile struct {
+		name  string
+		nanos int64
 	}
 
-	b.currentSize += int64(len(jsonData))
-	b.logger.Printf("Buffered %d bytes (total: %d/%d)", len(jsonData), b.currentSize, b.maxSize)
+	var files []legacyFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, "batch_") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		nanos, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, "batch_"), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, legacyFile{name: name, nanos: nanos})
+	}
 
-	return nil
-}
+	if len(files) == 0 {
+		return nil
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].nanos < files[j].nanos })
 
-// ReadAll reads all buffered data
-func (b *Buffer) ReadAll() ([][]byte, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	files, err := os.ReadDir(b.dir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read buffer directory: %w", err)
-	}
-
-	var batches [][]byte
 	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-
-		path := filepath.Join(b.dir, file.Name())
+		path := filepath.Join(b.dir, file.name)
 		data, err := os.ReadFile(path)
 		if err != nil {
-			b.logger.Printf("Failed to read buffer file %s: %v", file.Name(), err)
-			continue
+			return fmt.Errorf("failed to read %s: %w", file.name, err)
 		}
 
-		batches = append(batches, data)
+		// Already on disk, so migrate regardless of the size limit
+		q := b.queues[PriorityNormal]
+		if err := q.append(data, time.Unix(0, file.nanos)); err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", file.name, err)
+		}
+		if err := q.sync(); err != nil {
+			return fmt.Errorf("failed to sync buffer: %w", err)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", file.name, err)
+		}
 	}
 
-	return batches, nil
+	b.logger.Printf("Migrated %d legacy buffer files", len(files))
+	return nil
 }
 
-// Clear removes all buffered data
-func (b *Buffer) Clear() error {
+// Write adds data to the buffer with normal priority
+func (b *Buffer) Write(data interface{}) error {
+	return b.WritePriority(PriorityNormal, data)
+}
+
+// WritePriority adds data to the buffer in the given priority class.
+// When the buffer is full, records are evicted according to the retention
+// settings; if nothing may be evicted the write fails with ErrBufferFull.
+func (b *Buffer) WritePriority(priority Priority, data interface{}) error {
+	// Serialize data
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal data: %w", err)
+	}
+
+	return b.WriteBytes(priority, jsonData)
+}
+
+// WriteBytes adds an already encoded payload, such as a compressed request
+// body, to the buffer in the given priority class. Readers return it as is.
+func (b *Buffer) WriteBytes(priority Priority, payload []byte) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	files, err := os.ReadDir(b.dir)
-	if err != nil {
-		return fmt.Errorf("failed to read buffer directory: %w", err)
+	q, ok := b.queues[priority]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrInvalidPriority, priority)
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	// Encrypt at rest
+	if b.keys != nil {
+		var err error
+		payload, err = b.keys.seal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt buffer record: %w", err)
 		}
+	}
 
-		path := filepath.Join(b.dir, file.Name())
-		if err := os.Remove(path); err != nil {
-			b.logger.Printf("Failed to remove buffer file %s: %v", file.Name(), err)
-		}
+	// Check size limit
+	recordSize := int64(recordHeaderSize + len(payload))
+	fits, err := b.makeRoom(priority, recordSize)
+	if err != nil {
+		return fmt.Errorf("failed to evict buffered records: %w", err)
+	}
+	if !fits {
+		b.recordDrop(priority, DropRejected, 1, recordSize)
+		return fmt.Errorf("%w (current: %d, max: %d)", ErrBufferFull, b.size(), b.maxSize)
 	}
 
-	b.currentSize = 0
-	b.logger.Println("Buffer cleared")
+	if err := q.append(payload, time.Now()); err != nil {
+		return err
+	}
+
+	if err := q.maybeSync(); err != nil {
+		return fmt.Errorf("failed to sync buffer: %w", err)
+	}
+
+	b.logger.Printf("Buffered %d bytes (total: %d/%d)", recordSize, b.size(), b.maxSize)
 
 	return nil
 }
 
-// calculateSize computes the total size of buffered data
-func (b *Buffer) calculateSize() error {
+// size returns the bytes on disk across all classes. Must be called with b.mu held.
+func (b *Buffer) size() int64 {
 	var total int64
+	for _, q := range b.queues {
+		total += q.size
+	}
+	return total
+}
 
-	err := filepath.Walk(b.dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// records returns the number of unacknowledged records. Must be called with b.mu held.
+func (b *Buffer) records() int {
+	total := 0
+	for _, q := range b.queues {
+		total += q.records()
+	}
+	return total
+}
+
+// NewReader returns a streaming reader over the unacknowledged records
+// buffered so far, highest priority first. Records written after the reader
+// is created are not returned, and records past the maximum age are skipped.
+func (b *Buffer) NewReader() *Reader {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r := &Reader{buffer: b, keys: b.keys}
+	now := time.Now()
+
+	for _, priority := range priorities {
+		q := b.queues[priority]
+
+		var segments []segment
+		for _, seg := range q.segments {
+			if seg.seq >= q.cursor.Segment {
+				segments = append(segments, seg)
+			}
+		}
+
+		r.classes = append(r.classes, &classReader{
+			queue:    q,
+			segments: segments,
+			start:    q.cursor,
+			pos:      q.cursor,
+			cutoff:   b.retention.cutoff(priority, now),
+		})
+	}
+
+	return r
+}
+
+// ReadAll reads all buffered data into memory.
+// Prefer NewReader for draining, as the buffer may hold many records.
+func (b *Buffer) ReadAll() ([][]byte, error) {
+	reader := b.NewReader()
+	defer reader.Close()
+
+	var batches [][]byte
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			return batches, nil
 		}
-		if !info.IsDir() {
-			total += info.Size()
+		if err != nil {
+			return batches, err
 		}
-		return nil
-	})
+		batches = append(batches, data)
+	}
+}
 
-	if err != nil {
-		return err
+// Clear removes all buffered data
+func (b *Buffer) Clear() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, q := range b.queues {
+		if err := q.reset(); err != nil {
+			return err
+		}
 	}
 
-	b.currentSize = total
+	b.logger.Println("Buffer cleared")
+
 	return nil
 }
 
@@ -151,74 +329,59 @@ func (b *Buffer) calculateSize() error {
 func (b *Buffer) Size() int64 {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	return b.currentSize
+	return b.size()
+}
+
+// Len returns the number of buffered records
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.records()
 }
 
-// Prune removes old entries if buffer is too large
+// Prune drops records past the maximum age and evicts records while the
+// buffer is over its size limit. It is called periodically by the sender.
 func (b *Buffer) Prune() error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if b.currentSize <= b.maxSize {
-		return nil
+	if err := b.expire(); err != nil {
+		return fmt.Errorf("failed to expire buffered records: %w", err)
 	}
 
-	b.logger.Printf("Buffer size (%d) exceeds limit (%d), pruning...", b.currentSize, b.maxSize)
-
-	// Get all files sorted by modification time
-	type fileInfo struct {
-		path    string
-		modTime time.Time
-		size    int64
+	if b.size() <= b.maxSize {
+		return nil
 	}
 
-	var files []fileInfo
-	entries, err := os.ReadDir(b.dir)
-	if err != nil {
-		return fmt.Errorf("failed to read buffer directory: %w", err)
-	}
+	b.logger.Printf("Buffer size (%d) exceeds limit (%d), pruning...", b.size(), b.maxSize)
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+	// Evict from the lowest priority class up
+	for b.size() > b.maxSize {
+		victim := b.evictionVictim(PriorityHigh)
+		if victim == nil {
+			break
 		}
 
-		info, err := entry.Info()
+		records, bytes, err := victim.evictOldest()
 		if err != nil {
-			continue
+			return err
 		}
-
-		path := filepath.Join(b.dir, entry.Name())
-		files = append(files, fileInfo{
-			path:    path,
-			modTime: info.ModTime(),
-			size:    info.Size(),
-		})
+		b.recordDrop(victim.priority, DropEvicted, records, bytes)
 	}
 
-	// Sort by modification time (oldest first)
-	for i := 0; i < len(files)-1; i++ {
-		for j := i + 1; j < len(files); j++ {
-			if files[i].modTime.After(files[j].modTime) {
-				files[i], files[j] = files[j], files[i]
-			}
-		}
-	}
+	return nil
+}
 
-	// Remove oldest files until under limit
-	for _, file := range files {
-		if b.currentSize <= b.maxSize {
-			break
-		}
+// Close flushes and closes the buffer
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-		if err := os.Remove(file.path); err != nil {
-			b.logger.Printf("Failed to remove file %s: %v", file.path, err)
-			continue
+	var firstErr error
+	for _, q := range b.queues {
+		if err := q.close(); err != nil && firstErr == nil {
+			firstErr = err
 		}
-
-		b.currentSize -= file.size
-		b.logger.Printf("Pruned %s (%d bytes)", filepath.Base(file.path), file.size)
 	}
-
-	return nil
+	return firstErr
 }
@@ -1,7 +1,14 @@
 package buffer
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestBufferWriteAndRead(t *testing.T) {
@@ -119,6 +126,427 @@ func TestBufferPrune(t *testing.T) {
 	}
 }
 
+func TestBufferRecoversTornTail(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	logger := &testLogger{}
+	buffer, err := New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := buffer.Write(map[string]interface{}{"batch": i}); err != nil {
+			t.Fatalf("Failed to write to buffer: %v", err)
+		}
+	}
+	intact := buffer.Size()
+	buffer.Close()
+
+	// Simulate a crash halfway through appending a fourth record
+	path := filepath.Join(tmpDir, PriorityNormal.String(), segmentName(1))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	record := encodeRecord([]byte(`{"batch":3}`), time.Now())
+	f.Write(record[:len(record)-4])
+	f.Close()
+
+	buffer, err = New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+
+	if buffer.Size() != intact {
+		t.Errorf("Expected size %d after recovery, got %d", intact, buffer.Size())
+	}
+
+	// New writes must land after the intact records
+	if err := buffer.Write(map[string]interface{}{"batch": 4}); err != nil {
+		t.Fatalf("Failed to write to buffer: %v", err)
+	}
+
+	batches, err := buffer.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read from buffer: %v", err)
+	}
+	if len(batches) != 4 {
+		t.Fatalf("Expected 4 batches, got %d", len(batches))
+	}
+	if string(batches[3]) != `{"batch":4}` {
+		t.Errorf("Unexpected last batch: %s", batches[3])
+	}
+}
+
+func TestBufferStreamsAcrossSegments(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	logger := &testLogger{}
+	buffer, err := New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	buffer.segmentSize = 64 // force a new segment every few records
+	buffer.SetSyncPolicy(SyncNever, 0)
+
+	for i := 0; i < 20; i++ {
+		if err := buffer.Write(map[string]interface{}{"batch": i}); err != nil {
+			t.Fatalf("Failed to write to buffer: %v", err)
+		}
+	}
+
+	if segments := len(buffer.queues[PriorityNormal].segments); segments < 2 {
+		t.Fatalf("Expected several segments, got %d", segments)
+	}
+
+	reader := buffer.NewReader()
+	defer reader.Close()
+
+	for i := 0; ; i++ {
+		data, err := reader.Next()
+		if err == io.EOF {
+			if i != 20 {
+				t.Errorf("Expected 20 records, got %d", i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read record %d: %v", i, err)
+		}
+		if want := fmt.Sprintf(`{"batch":%d}`, i); string(data) != want {
+			t.Fatalf("Record %d: expected %s, got %s", i, want, data)
+		}
+	}
+}
+
+func TestBufferMigratesLegacyFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	os.WriteFile(filepath.Join(tmpDir, "batch_200.json"), []byte(`{"batch":2}`), 0600)
+	os.WriteFile(filepath.Join(tmpDir, "batch_100.json"), []byte(`{"batch":1}`), 0600)
+
+	logger := &testLogger{}
+	buffer, err := New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+
+	batches, err := buffer.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read from buffer: %v", err)
+	}
+	if len(batches) != 2 || string(batches[0]) != `{"batch":1}` {
+		t.Errorf("Legacy batches not migrated in order: %q", batches)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpDir, "batch_100.json")); !os.IsNotExist(err) {
+		t.Error("Legacy file was not removed after migration")
+	}
+}
+
+func TestBufferAckSurvivesRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	logger := &testLogger{}
+	buffer, err := New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := buffer.Write(map[string]interface{}{"batch": i}); err != nil {
+			t.Fatalf("Failed to write to buffer: %v", err)
+		}
+	}
+
+	// Deliver the first two records, then "crash"
+	reader := buffer.NewReader()
+	for i := 0; i < 2; i++ {
+		if _, err := reader.Next(); err != nil {
+			t.Fatalf("Failed to read record %d: %v", i, err)
+		}
+		if err := reader.Ack(); err != nil {
+			t.Fatalf("Failed to ack record %d: %v", i, err)
+		}
+	}
+	reader.Close()
+	buffer.Close()
+
+	buffer, err = New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+
+	if buffer.Len() != 1 {
+		t.Errorf("Expected 1 pending record after restart, got %d", buffer.Len())
+	}
+
+	reader = buffer.NewReader()
+	defer reader.Close()
+
+	data, err := reader.Next()
+	if err != nil {
+		t.Fatalf("Failed to read remaining record: %v", err)
+	}
+	if string(data) != `{"batch":2}` {
+		t.Errorf("Expected the undelivered record, got %s", data)
+	}
+
+	// Acknowledging everything empties the buffer
+	if err := reader.Ack(); err != nil {
+		t.Fatalf("Failed to ack record: %v", err)
+	}
+	if buffer.Len() != 0 || buffer.Size() != 0 {
+		t.Errorf("Expected empty buffer, got %d records (%d bytes)", buffer.Len(), buffer.Size())
+	}
+}
+
+func TestBufferEvictsLowerPriorityFirst(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	logger := &testLogger{}
+	buffer, err := New(tmpDir, 150, logger)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+
+	// Fill the buffer with routine and security records
+	for i := 0; i < 3; i++ {
+		if err := buffer.WritePriority(PriorityLow, map[string]interface{}{"metric": i}); err != nil {
+			t.Fatalf("Failed to write low priority record: %v", err)
+		}
+	}
+	if err := buffer.WritePriority(PriorityHigh, map[string]interface{}{"audit": 0}); err != nil {
+		t.Fatalf("Failed to write high priority record: %v", err)
+	}
+
+	// More security data must push out the routine metrics, not the audit record
+	for i := 1; i < 4; i++ {
+		if err := buffer.WritePriority(PriorityHigh, map[string]interface{}{"audit": i}); err != nil {
+			t.Fatalf("Failed to write high priority record %d: %v", i, err)
+		}
+	}
+
+	stats := buffer.Stats()
+	if stats.DroppedByClass["low"].Records != 3 {
+		t.Errorf("Expected 3 low priority records evicted, got %+v", stats.DroppedByClass)
+	}
+	if stats.DroppedByClass["high"].Records != 0 {
+		t.Errorf("Expected no high priority records dropped, got %+v", stats.DroppedByClass)
+	}
+
+	batches, err := buffer.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read from buffer: %v", err)
+	}
+	if len(batches) != 4 || string(batches[0]) != `{"audit":0}` {
+		t.Errorf("Expected the 4 audit records, got %q", batches)
+	}
+
+	// Routine data cannot evict security data
+	buffer.SetRetention(Retention{Eviction: EvictNewest})
+	err = buffer.WritePriority(PriorityLow, map[string]interface{}{"metric": "padding to make this record large enough"})
+	if !errors.Is(err, ErrBufferFull) {
+		t.Errorf("Expected ErrBufferFull, got %v", err)
+	}
+	if buffer.Stats().DroppedByReason[DropRejected].Records != 1 {
+		t.Errorf("Expected the rejected record to be counted")
+	}
+}
+
+func TestBufferSkipsExpiredRecords(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	logger := &testLogger{}
+	buffer, err := New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+
+	// Backdate one record, as if it had been buffered long ago
+	q := buffer.queues[PriorityNormal]
+	if err := q.append([]byte(`{"batch":"old"}`), time.Now().Add(-48*time.Hour)); err != nil {
+		t.Fatalf("Failed to append record: %v", err)
+	}
+	if err := buffer.Write(map[string]interface{}{"batch": "new"}); err != nil {
+		t.Fatalf("Failed to write to buffer: %v", err)
+	}
+
+	buffer.SetRetention(Retention{MaxAge: 24 * time.Hour})
+
+	reader := buffer.NewReader()
+	defer reader.Close()
+
+	data, err := reader.Next()
+	if err != nil {
+		t.Fatalf("Failed to read record: %v", err)
+	}
+	if string(data) != `{"batch":"new"}` {
+		t.Errorf("Expected the expired record to be skipped, got %s", data)
+	}
+
+	if err := reader.Ack(); err != nil {
+		t.Fatalf("Failed to ack record: %v", err)
+	}
+	if expired := buffer.Stats().DroppedByReason[DropExpired].Records; expired != 1 {
+		t.Errorf("Expected 1 expired record, got %d", expired)
+	}
+}
+
+func TestBufferHighPriorityOutlivesLow(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	logger := &testLogger{}
+	buffer, err := New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+
+	// Both records are past the low-priority cutoff
+	written := time.Now().Add(-48 * time.Hour)
+	if err := buffer.queues[PriorityLow].append([]byte(`{"batch":"cpu"}`), written); err != nil {
+		t.Fatalf("Failed to append record: %v", err)
+	}
+	if err := buffer.queues[PriorityHigh].append([]byte(`{"batch":"audit"}`), written); err != nil {
+		t.Fatalf("Failed to append record: %v", err)
+	}
+
+	buffer.SetRetention(Retention{
+		MaxAge:           24 * time.Hour,
+		MaxAgeByPriority: map[Priority]time.Duration{PriorityHigh: 30 * 24 * time.Hour},
+	})
+
+	records, err := buffer.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read buffer: %v", err)
+	}
+	if len(records) != 1 || string(records[0]) != `{"batch":"audit"}` {
+		t.Errorf("Expected only the high-priority record to survive, got %q", records)
+	}
+
+	if err := buffer.Prune(); err != nil {
+		t.Fatalf("Failed to prune buffer: %v", err)
+	}
+	if n := buffer.queues[PriorityHigh].records(); n != 1 {
+		t.Errorf("Expected prune to keep the high-priority record, got %d records", n)
+	}
+}
+
+func TestBufferEncryptsAndSurvivesKeyRotation(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	logger := &testLogger{}
+	buffer, err := New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	if err := buffer.SetEncryptionKey(oldKey); err != nil {
+		t.Fatalf("Failed to enable encryption: %v", err)
+	}
+
+	if err := buffer.Write(map[string]interface{}{"cmdline": "secret-before"}); err != nil {
+		t.Fatalf("Failed to write to buffer: %v", err)
+	}
+	buffer.Close()
+
+	segment, err := os.ReadFile(filepath.Join(tmpDir, PriorityNormal.String(), segmentName(1)))
+	if err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+	if bytes.Contains(segment, []byte("secret-before")) {
+		t.Fatal("Buffered record is stored in plaintext")
+	}
+
+	// The identity is re-bootstrapped; the keyring is re-wrapped on open
+	buffer, err = New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	if err := buffer.SetEncryptionKey(newKey, oldKey); err != nil {
+		t.Fatalf("Failed to enable encryption: %v", err)
+	}
+	buffer.Close()
+
+	buffer, err = New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	if err := buffer.SetEncryptionKey(newKey); err != nil {
+		t.Fatalf("Keyring was not re-wrapped under the new key: %v", err)
+	}
+	if err := buffer.Write(map[string]interface{}{"cmdline": "secret-after"}); err != nil {
+		t.Fatalf("Failed to write to buffer: %v", err)
+	}
+
+	reader := buffer.NewReader()
+	defer reader.Close()
+
+	for _, want := range []string{`{"cmdline":"secret-before"}`, `{"cmdline":"secret-after"}`} {
+		data, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Failed to read record: %v", err)
+		}
+		if string(data) != want {
+			t.Errorf("Expected %s, got %s", want, data)
+		}
+	}
+
+	// Old data keys are retired once everything sealed under them is drained
+	if err := reader.Ack(); err != nil {
+		t.Fatalf("Failed to ack records: %v", err)
+	}
+	if keys := len(buffer.keys.keys); keys != 1 {
+		t.Errorf("Expected 1 data key after draining, got %d", keys)
+	}
+}
+
+func TestBufferKeyringNeedsMatchingKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	otherKey := bytes.Repeat([]byte{3}, 32)
+
+	logger := &testLogger{}
+	buffer, err := New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	if err := buffer.SetEncryptionKey(oldKey); err != nil {
+		t.Fatalf("Failed to enable encryption: %v", err)
+	}
+	if err := buffer.Write(map[string]interface{}{"batch": "sealed"}); err != nil {
+		t.Fatalf("Failed to write to buffer: %v", err)
+	}
+	buffer.Close()
+
+	// The identity changed while the buffer was closed and the keyring was
+	// not rotated: without the old key the buffer must not start over
+	buffer, err = New(tmpDir, 1024*1024, logger)
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	if err := buffer.SetEncryptionKey(newKey, otherKey); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("Expected ErrKeyMismatch, got %v", err)
+	}
+
+	// With the previous key the keyring is re-wrapped and the record drained
+	if err := buffer.SetEncryptionKey(newKey, otherKey, oldKey); err != nil {
+		t.Fatalf("Failed to re-wrap keyring with the previous key: %v", err)
+	}
+	records, err := buffer.ReadAll()
+	if err != nil || len(records) != 1 || string(records[0]) != `{"batch":"sealed"}` {
+		t.Fatalf("Expected the sealed record, got %q (%v)", records, err)
+	}
+	buffer.Close()
+
+	if _, err := loadKeyring(tmpDir, newKey); err != nil {
+		t.Errorf("Expected the keyring to be saved under the new key, got %v", err)
+	}
+}
+
 // testLogger is a simple logger for testing
 type testLogger struct{}
 
@@ -0,0 +1,364 @@
+package buffer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// At-rest encryption
+//
+// Records are sealed with AES-256-GCM under a random data key. Data keys are
+// kept in keys.json, wrapped by a key-encryption key (KEK) derived from the
+// agent's identity, so the spool cannot be read without the identity key.
+//
+// When the identity changes, the data keys are re-wrapped under the new KEK
+// and a fresh data key is added for new records. Older data keys are kept
+// until every record sealed under them has been drained. A keyring that no
+// available KEK can unwrap is never replaced, so buffered records are not
+// lost without notice.
+//
+// A sealed payload is laid out as:
+//
+//	[1 byte sealedMagic][4 bytes data key ID, little endian][12 bytes nonce][ciphertext and tag]
+//
+// Records written before encryption was enabled are plain JSON and are
+// returned unchanged.
+const (
+	keyringFile = "keys.json"
+	sealedMagic = 0x01
+	dataKeySize = 32
+)
+
+// keyring holds the data keys records are sealed with
+type keyring struct {
+	mu      sync.RWMutex
+	kek     []byte
+	keys    map[uint32]cipher.AEAD
+	raw     map[uint32][]byte
+	created map[uint32]time.Time
+	current uint32
+}
+
+// keyringDocument is the on-disk form of a keyring
+type keyringDocument struct {
+	KEKID   string       `json:"kek_id"`
+	Current uint32       `json:"current"`
+	Keys    []wrappedKey `json:"keys"`
+}
+
+type wrappedKey struct {
+	ID        uint32    `json:"id"`
+	Wrapped   []byte    `json:"wrapped"` // nonce followed by the sealed data key
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// kekID identifies a KEK without revealing it
+func kekID(kek []byte) string {
+	sum := sha256.Sum256(append([]byte("kek-id:"), kek...))
+	return hex.EncodeToString(sum[:8])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newKeyring creates a keyring with a single fresh data key
+func newKeyring(kek []byte) (*keyring, error) {
+	k := &keyring{
+		kek:     kek,
+		keys:    make(map[uint32]cipher.AEAD),
+		raw:     make(map[uint32][]byte),
+		created: make(map[uint32]time.Time),
+	}
+	if err := k.addKey(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// loadKeyring reads the keyring in dir. It returns os.ErrNotExist if there is
+// none and ErrKeyMismatch if it was wrapped under a different KEK.
+func loadKeyring(dir string, kek []byte) (*keyring, error) {
+	data, err := os.ReadFile(filepath.Join(dir, keyringFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var doc keyringDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring: %w", err)
+	}
+	if doc.KEKID != kekID(kek) {
+		return nil, ErrKeyMismatch
+	}
+
+	wrapper, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &keyring{
+		kek:     kek,
+		keys:    make(map[uint32]cipher.AEAD),
+		raw:     make(map[uint32][]byte),
+		created: make(map[uint32]time.Time),
+		current: doc.Current,
+	}
+	for _, wk := range doc.Keys {
+		if len(wk.Wrapped) < wrapper.NonceSize() {
+			return nil, fmt.Errorf("data key %d is truncated", wk.ID)
+		}
+		nonce, sealed := wk.Wrapped[:wrapper.NonceSize()], wk.Wrapped[wrapper.NonceSize():]
+		key, err := wrapper.Open(nil, nonce, sealed, keyAAD(wk.ID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap data key %d: %w", wk.ID, err)
+		}
+		if err := k.setKey(wk.ID, key, wk.CreatedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := k.keys[k.current]; !ok {
+		return nil, fmt.Errorf("keyring has no current data key")
+	}
+	return k, nil
+}
+
+// keyAAD binds a wrapped data key to its ID
+func keyAAD(id uint32) []byte {
+	return []byte(fmt.Sprintf("unitechio-agent buffer data key %d", id))
+}
+
+func (k *keyring) setKey(id uint32, key []byte, created time.Time) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return fmt.Errorf("invalid data key %d: %w", id, err)
+	}
+	k.keys[id] = aead
+	k.raw[id] = key
+	k.created[id] = created
+	return nil
+}
+
+// addKey generates a new data key and makes it current. Must be called with k.mu held.
+func (k *keyring) addKey() error {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	id := k.current + 1
+	if err := k.setKey(id, key, time.Now().UTC()); err != nil {
+		return err
+	}
+	k.current = id
+	return nil
+}
+
+// save atomically writes the keyring, wrapping every data key under the KEK
+func (k *keyring) save(dir string) error {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	wrapper, err := newAEAD(k.kek)
+	if err != nil {
+		return err
+	}
+
+	doc := keyringDocument{KEKID: kekID(k.kek), Current: k.current}
+	for id, key := range k.raw {
+		nonce := make([]byte, wrapper.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		doc.Keys = append(doc.Keys, wrappedKey{
+			ID:        id,
+			Wrapped:   wrapper.Seal(nonce, nonce, key, keyAAD(id)),
+			CreatedAt: k.created[id],
+		})
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal keyring: %w", err)
+	}
+
+	path := filepath.Join(dir, keyringFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write keyring: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace keyring: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// rotate re-wraps the keyring under a new KEK and starts a new data key
+func (k *keyring) rotate(kek []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.kek = kek
+	return k.addKey()
+}
+
+// retire forgets every data key except the current one.
+// Only safe once no record sealed under an older key remains.
+func (k *keyring) retire() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.keys) == 1 {
+		return false
+	}
+	for id := range k.keys {
+		if id != k.current {
+			delete(k.keys, id)
+			delete(k.raw, id)
+			delete(k.created, id)
+		}
+	}
+	return true
+}
+
+// seal encrypts a payload under the current data key
+func (k *keyring) seal(payload []byte) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	aead := k.keys[k.current]
+	header := make([]byte, 5, 5+aead.NonceSize()+len(payload)+aead.Overhead())
+	header[0] = sealedMagic
+	binary.LittleEndian.PutUint32(header[1:5], k.current)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	// The header is authenticated but must not share memory with the output
+	aad := append([]byte(nil), header...)
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, payload, aad), nil
+}
+
+// open decrypts a sealed payload. Unsealed (legacy) payloads are returned as is.
+func (k *keyring) open(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != sealedMagic {
+		return data, nil
+	}
+	if len(data) < 5 {
+		return nil, ErrUndecryptable
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	aead, ok := k.keys[binary.LittleEndian.Uint32(data[1:5])]
+	if !ok || len(data) < 5+aead.NonceSize() {
+		return nil, ErrUndecryptable
+	}
+
+	header, nonce, sealed := data[:5], data[5:5+aead.NonceSize()], data[5+aead.NonceSize():]
+	payload, err := aead.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return nil, ErrUndecryptable
+	}
+	return payload, nil
+}
+
+// SetEncryptionKey enables at-rest encryption with a key-encryption key
+// derived from the agent identity. New records are sealed; records already
+// buffered stay readable as long as their data key is in the keyring.
+//
+// A keyring wrapped under one of the previous KEKs, e.g. of an identity
+// replaced while the buffer was closed, is re-wrapped under kek. If no key
+// can unwrap the keyring, ErrKeyMismatch is returned and the buffer is left
+// untouched rather than abandoning the records sealed under it.
+func (b *Buffer) SetEncryptionKey(kek []byte, previous ...[]byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys, err := loadKeyring(b.dir, kek)
+	for _, prev := range previous {
+		if err != ErrKeyMismatch {
+			break
+		}
+		if prev == nil {
+			continue
+		}
+		if keys, err = loadKeyring(b.dir, prev); err == nil {
+			if err := keys.rotate(kek); err != nil {
+				return err
+			}
+			if err := keys.save(b.dir); err != nil {
+				return err
+			}
+			b.logger.Println("Re-wrapped buffer keyring under the current identity")
+		}
+	}
+
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		keys, err = newKeyring(kek)
+		if err != nil {
+			return err
+		}
+		if err := keys.save(b.dir); err != nil {
+			return err
+		}
+	case err == ErrKeyMismatch:
+		return fmt.Errorf("%w: %d buffered records in %s cannot be read; restore the previous agent key, or remove the directory to discard them",
+			ErrKeyMismatch, b.records(), b.dir)
+	default:
+		return fmt.Errorf("failed to load buffer keyring: %w", err)
+	}
+
+	b.keys = keys
+	b.retireKeys()
+	return nil
+}
+
+// RotateKey re-wraps the keyring under a new key-encryption key after the
+// agent identity changes. Records sealed under older data keys stay readable.
+func (b *Buffer) RotateKey(kek []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.keys == nil {
+		return nil
+	}
+	if err := b.keys.rotate(kek); err != nil {
+		return err
+	}
+	return b.keys.save(b.dir)
+}
+
+// retireKeys drops old data keys once the buffer is empty. Must be called with b.mu held.
+func (b *Buffer) retireKeys() {
+	if b.keys == nil || b.records() > 0 {
+		return
+	}
+	if b.keys.retire() {
+		if err := b.keys.save(b.dir); err != nil {
+			b.logger.Printf("Failed to save buffer keyring: %v", err)
+		}
+	}
+}
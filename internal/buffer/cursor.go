@@ -0,0 +1,77 @@
+package buffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const cursorFile = "cursor.json"
+
+// cursor marks the position just after the last acknowledged record.
+// Everything before it has been delivered and is not returned by readers.
+type cursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Records int    `json:"records"` // acknowledged records within the segment
+}
+
+// before reports whether c is strictly before other
+func (c cursor) before(other cursor) bool {
+	if c.Segment != other.Segment {
+		return c.Segment < other.Segment
+	}
+	return c.Offset < other.Offset
+}
+
+// loadCursor reads the persisted cursor; a missing file means nothing was acknowledged
+func loadCursor(dir string) (cursor, error) {
+	data, err := os.ReadFile(filepath.Join(dir, cursorFile))
+	if os.IsNotExist(err) {
+		return cursor{}, nil
+	}
+	if err != nil {
+		return cursor{}, fmt.Errorf("failed to read cursor: %w", err)
+	}
+
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return cursor{}, fmt.Errorf("failed to parse cursor: %w", err)
+	}
+	return c, nil
+}
+
+// saveCursor atomically replaces the persisted cursor
+func saveCursor(dir string, c cursor, sync bool) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cursor: %w", err)
+	}
+
+	path := filepath.Join(dir, cursorFile)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write cursor: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write cursor: %w", err)
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to sync cursor: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write cursor: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace cursor: %w", err)
+	}
+	return nil
+}
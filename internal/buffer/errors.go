@@ -0,0 +1,13 @@
+package buffer
+
+import "errors"
+
+var (
+	ErrBufferFull      = errors.New("buffer full")
+	ErrCorruptRecord   = errors.New("corrupt buffer record")
+	ErrInvalidSync     = errors.New("invalid buffer sync policy")
+	ErrInvalidPriority = errors.New("invalid buffer priority")
+	ErrInvalidEviction = errors.New("invalid buffer eviction order")
+	ErrKeyMismatch     = errors.New("buffer keyring was sealed under a different identity")
+	ErrUndecryptable   = errors.New("buffer record cannot be decrypted")
+)
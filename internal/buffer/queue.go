@@ -0,0 +1,361 @@
+package buffer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// queue is the write-ahead log of one priority class, stored in its own
+// subdirectory of the buffer. All methods must be called with the owning
+// buffer's mutex held.
+type queue struct {
+	buffer   *Buffer
+	priority Priority
+	dir      string
+	segments []segment // oldest first; the last one is active
+	active   *os.File
+	cursor   cursor // position after the last acknowledged record
+	size     int64
+	dirty    bool
+	lastSync time.Time
+}
+
+// openQueue opens the queue for a priority class, recovering any segments
+// left by a previous run
+func openQueue(b *Buffer, priority Priority) (*queue, error) {
+	q := &queue{
+		buffer:   b,
+		priority: priority,
+		dir:      filepath.Join(b.dir, priority.String()),
+	}
+
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create buffer directory: %w", err)
+	}
+
+	if err := q.recover(); err != nil {
+		return nil, fmt.Errorf("failed to recover %s-priority buffer: %w", priority, err)
+	}
+
+	return q, nil
+}
+
+// recover opens existing segments, truncates a torn tail record and opens
+// the newest segment for appending
+func (q *queue) recover() error {
+	segments, err := listSegments(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for i := range segments {
+		dropped, err := recoverSegment(&segments[i])
+		if err != nil {
+			return fmt.Errorf("failed to recover %s: %w", filepath.Base(segments[i].path), err)
+		}
+		if dropped > 0 {
+			q.buffer.logger.Printf("Warning: truncated %d bytes of torn records from %s",
+				dropped, filepath.Base(segments[i].path))
+		}
+		q.size += segments[i].size
+	}
+
+	c, err := loadCursor(q.dir)
+	if err != nil {
+		// Redelivering is safer than losing data; the server de-duplicates by batch ID
+		q.buffer.logger.Printf("Warning: %v, redelivering all buffered records", err)
+	}
+
+	q.segments = segments
+	if len(segments) == 0 {
+		// Keep sequence numbers increasing so an old cursor never skips new records
+		seq := c.Segment + 1
+		q.cursor = cursor{Segment: seq}
+		return q.createSegment(seq)
+	}
+
+	active, err := os.OpenFile(segments[len(segments)-1].path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open active segment: %w", err)
+	}
+	q.active = active
+
+	q.cursor = q.normalizeCursor(c)
+	return q.compact()
+}
+
+// normalizeCursor fits a persisted cursor to the recovered segments
+func (q *queue) normalizeCursor(c cursor) cursor {
+	for _, seg := range q.segments {
+		if seg.seq < c.Segment {
+			continue
+		}
+		if seg.seq > c.Segment {
+			// The cursor's segment is gone, so everything in it was delivered
+			return cursor{Segment: seg.seq}
+		}
+		if c.Offset > seg.size || c.Records > seg.records {
+			// Acknowledged records were lost from a torn tail
+			return cursor{Segment: seg.seq, Offset: seg.size, Records: seg.records}
+		}
+		return c
+	}
+
+	// A cursor past every segment cannot be trusted; redeliver everything
+	return cursor{Segment: q.segments[0].seq}
+}
+
+// append writes one record to the active segment, rolling to a new segment
+// when the active one is full
+func (q *queue) append(payload []byte, written time.Time) error {
+	record := encodeRecord(payload, written)
+	active := &q.segments[len(q.segments)-1]
+
+	if active.size > 0 && active.size+int64(len(record)) > q.buffer.segmentSize {
+		if err := q.roll(); err != nil {
+			return err
+		}
+		active = &q.segments[len(q.segments)-1]
+	}
+
+	if _, err := q.active.Write(record); err != nil {
+		// Drop a partial write so the segment stays well-formed
+		if truncErr := q.active.Truncate(active.size); truncErr != nil {
+			q.buffer.logger.Printf("Failed to truncate partial buffer write: %v", truncErr)
+		}
+		return fmt.Errorf("failed to write buffer record: %w", err)
+	}
+
+	active.size += int64(len(record))
+	active.records++
+	active.newest = written
+	q.size += int64(len(record))
+	q.dirty = true
+
+	return nil
+}
+
+// roll seals the active segment and starts a new one
+func (q *queue) roll() error {
+	if err := q.sync(); err != nil {
+		return fmt.Errorf("failed to sync segment: %w", err)
+	}
+	if err := q.active.Close(); err != nil {
+		return fmt.Errorf("failed to close segment: %w", err)
+	}
+
+	return q.createSegment(q.segments[len(q.segments)-1].seq + 1)
+}
+
+// createSegment creates an empty segment and makes it active
+func (q *queue) createSegment(seq uint64) error {
+	path := filepath.Join(q.dir, segmentName(seq))
+	active, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+
+	if err := syncDir(q.dir); err != nil {
+		q.buffer.logger.Printf("Warning: failed to sync buffer directory: %v", err)
+	}
+
+	q.active = active
+	q.segments = append(q.segments, segment{seq: seq, path: path})
+	return nil
+}
+
+// maybeSync applies the sync policy after a write
+func (q *queue) maybeSync() error {
+	switch q.buffer.syncPolicy {
+	case SyncAlways:
+		return q.sync()
+	case SyncInterval:
+		if time.Since(q.lastSync) >= q.buffer.syncInterval {
+			return q.sync()
+		}
+	}
+	return nil
+}
+
+// sync flushes the active segment if it has unsynced writes
+func (q *queue) sync() error {
+	if !q.dirty {
+		return nil
+	}
+	if err := q.active.Sync(); err != nil {
+		return err
+	}
+	q.dirty = false
+	q.lastSync = time.Now()
+	return nil
+}
+
+// records returns the number of unacknowledged records
+func (q *queue) records() int {
+	total := 0
+	for _, seg := range q.segments {
+		total += seg.records
+		if seg.seq == q.cursor.Segment {
+			total -= q.cursor.Records
+		}
+	}
+	return total
+}
+
+// pending returns the unacknowledged records and bytes of a segment
+func (q *queue) pending(seg segment) (int64, int64) {
+	switch {
+	case seg.seq < q.cursor.Segment:
+		return 0, 0
+	case seg.seq == q.cursor.Segment:
+		return int64(seg.records - q.cursor.Records), seg.size - q.cursor.Offset
+	default:
+		return int64(seg.records), seg.size
+	}
+}
+
+// ack moves the cursor forward to pos and removes fully delivered segments
+func (q *queue) ack(pos cursor) error {
+	if !q.cursor.before(pos) {
+		return nil
+	}
+
+	// Persist the cursor before removing anything it covers
+	q.cursor = pos
+	if err := q.saveCursor(); err != nil {
+		return err
+	}
+
+	return q.compact()
+}
+
+func (q *queue) saveCursor() error {
+	return saveCursor(q.dir, q.cursor, q.buffer.syncPolicy == SyncAlways)
+}
+
+// compact removes segments that lie entirely before the cursor. Once every
+// record has been acknowledged the queue starts over with an empty segment.
+func (q *queue) compact() error {
+	for len(q.segments) > 1 {
+		oldest := q.segments[0]
+		if oldest.seq > q.cursor.Segment || (oldest.seq == q.cursor.Segment && q.cursor.Offset < oldest.size) {
+			break
+		}
+
+		if err := q.removeOldest(); err != nil {
+			return err
+		}
+	}
+
+	active := q.segments[0]
+	if len(q.segments) == 1 && active.size > 0 && q.cursor.Segment == active.seq && q.cursor.Offset >= active.size {
+		return q.reset()
+	}
+
+	return nil
+}
+
+// removeOldest deletes the oldest segment, moving the cursor past it.
+// The active segment must not be the oldest.
+func (q *queue) removeOldest() error {
+	oldest := q.segments[0]
+	if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove segment %s: %w", filepath.Base(oldest.path), err)
+	}
+
+	q.segments = q.segments[1:]
+	q.size -= oldest.size
+	if q.cursor.Segment <= oldest.seq {
+		q.cursor = cursor{Segment: q.segments[0].seq}
+	}
+	return nil
+}
+
+// evictOldest drops the oldest segment, even if it is the active one, and
+// returns the unacknowledged records and bytes lost
+func (q *queue) evictOldest() (int64, int64, error) {
+	if len(q.segments) == 1 {
+		if err := q.roll(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	records, bytes := q.pending(q.segments[0])
+	if err := q.removeOldest(); err != nil {
+		return 0, 0, err
+	}
+	if err := q.saveCursor(); err != nil {
+		return 0, 0, err
+	}
+
+	q.buffer.logger.Printf("Evicted %s-priority buffer segment (%d records, %d bytes)", q.priority, records, bytes)
+	return records, bytes, nil
+}
+
+// expire drops segments whose newest record was written before cutoff and
+// returns the unacknowledged records and bytes lost. Individual expired
+// records in newer segments are skipped by readers instead.
+func (q *queue) expire(cutoff time.Time) (int64, int64, error) {
+	var records, bytes int64
+	for q.records() > 0 {
+		oldest := q.segments[0]
+		if oldest.records == 0 || !oldest.newest.Before(cutoff) {
+			break
+		}
+
+		if len(q.segments) == 1 {
+			if err := q.roll(); err != nil {
+				return records, bytes, err
+			}
+		}
+
+		r, b := q.pending(oldest)
+		if err := q.removeOldest(); err != nil {
+			return records, bytes, err
+		}
+		records += r
+		bytes += b
+	}
+
+	if records > 0 {
+		if err := q.saveCursor(); err != nil {
+			return records, bytes, err
+		}
+	}
+	return records, bytes, nil
+}
+
+// reset removes every segment and starts a new, empty one
+func (q *queue) reset() error {
+	if err := q.active.Close(); err != nil {
+		q.buffer.logger.Printf("Failed to close active segment: %v", err)
+	}
+
+	next := q.segments[len(q.segments)-1].seq + 1
+	for _, seg := range q.segments {
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			q.buffer.logger.Printf("Failed to remove buffer segment %s: %v", filepath.Base(seg.path), err)
+		}
+	}
+
+	q.segments = nil
+	q.size = 0
+	q.dirty = false
+
+	if err := q.createSegment(next); err != nil {
+		return err
+	}
+
+	q.cursor = cursor{Segment: next}
+	return q.saveCursor()
+}
+
+// close flushes and closes the active segment
+func (q *queue) close() error {
+	if err := q.sync(); err != nil {
+		q.buffer.logger.Printf("Failed to sync buffer: %v", err)
+	}
+	return q.active.Close()
+}
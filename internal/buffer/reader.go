@@ -0,0 +1,174 @@
+package buffer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Reader streams unacknowledged records, highest priority first and oldest
+// first within a class. Call Ack after records have been delivered so they
+// are not read again.
+type Reader struct {
+	buffer  *Buffer
+	classes []*classReader
+	keys    *keyring // nil when records are not encrypted
+}
+
+// classReader reads the records of one priority class
+type classReader struct {
+	queue    *queue
+	segments []segment
+	start    cursor    // cursor when the reader was created
+	pos      cursor    // position after the last record returned or skipped
+	cutoff   time.Time // records written before this have expired
+	file     *os.File
+	r        *countingReader
+
+	// Records skipped since the last Ack, by drop reason
+	skipped map[string]DropCounter
+}
+
+// Next returns the next record, or io.EOF when there are no more
+func (r *Reader) Next() ([]byte, error) {
+	for _, c := range r.classes {
+		data, err := c.next(r.keys)
+		if err == io.EOF {
+			continue
+		}
+		return data, err
+	}
+	return nil, io.EOF
+}
+
+// Ack acknowledges every record returned by Next so far. Acknowledged
+// records are never read again, even after a restart.
+func (r *Reader) Ack() error {
+	b := r.buffer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, c := range r.classes {
+		if err := c.queue.ack(c.pos); err != nil {
+			return err
+		}
+
+		// Skipped records only count as dropped once they are acknowledged,
+		// so records skipped by an abandoned reader are not counted twice
+		for reason, counter := range c.skipped {
+			b.recordDrop(c.queue.priority, reason, counter.Records, counter.Bytes)
+		}
+		c.skipped = nil
+	}
+
+	b.retireKeys()
+	return nil
+}
+
+// Close releases the reader's open segment
+func (r *Reader) Close() error {
+	for _, c := range r.classes {
+		c.closeSegment()
+		c.segments = nil
+	}
+	return nil
+}
+
+// next returns the class's next unexpired, decrypted record
+func (c *classReader) next(keys *keyring) ([]byte, error) {
+	for {
+		if c.r == nil {
+			if len(c.segments) == 0 {
+				return nil, io.EOF
+			}
+
+			seg := c.segments[0]
+			c.segments = c.segments[1:]
+
+			if err := c.openSegment(seg); os.IsNotExist(err) {
+				// Pruned or cleared since the reader was created
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		start := c.r.n
+		data, written, err := readRecord(c.r)
+		if err == io.EOF {
+			c.closeSegment()
+			continue
+		}
+		if err == errTornRecord {
+			c.closeSegment()
+			return nil, ErrCorruptRecord
+		}
+		if err != nil {
+			c.closeSegment()
+			return nil, fmt.Errorf("failed to read segment: %w", err)
+		}
+
+		c.pos.Offset = c.r.n
+		c.pos.Records++
+
+		if written.Before(c.cutoff) {
+			c.skip(DropExpired, c.r.n-start)
+			continue
+		}
+
+		if keys != nil {
+			data, err = keys.open(data)
+			if err != nil {
+				c.skip(DropUndecryptable, c.r.n-start)
+				continue
+			}
+		}
+
+		return data, nil
+	}
+}
+
+// openSegment positions the reader at the first unacknowledged record of seg
+func (c *classReader) openSegment(seg segment) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	c.pos = cursor{Segment: seg.seq}
+	if seg.seq == c.start.Segment {
+		offset = c.start.Offset
+		c.pos = c.start
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to seek segment: %w", err)
+		}
+	}
+
+	// Only read what was written when the reader was created
+	c.file = f
+	c.r = &countingReader{r: bufio.NewReader(io.LimitReader(f, seg.size-offset)), n: offset}
+	return nil
+}
+
+// skip records a record that is passed over instead of returned
+func (c *classReader) skip(reason string, bytes int64) {
+	if c.skipped == nil {
+		c.skipped = make(map[string]DropCounter)
+	}
+	counter := c.skipped[reason]
+	counter.Records++
+	counter.Bytes += bytes
+	c.skipped[reason] = counter
+}
+
+func (c *classReader) closeSegment() {
+	if c.file != nil {
+		c.file.Close()
+	}
+	c.file = nil
+	c.r = nil
+}
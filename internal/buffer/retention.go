@@ -0,0 +1,211 @@
+package buffer
+
+import (
+	"fmt"
+	"time"
+)
+
+// Priority is a record's retention class. Under size pressure lower
+// priorities are evicted first, and readers drain higher priorities first.
+type Priority int
+
+const (
+	PriorityLow    Priority = iota // routine metrics
+	PriorityNormal                 // default
+	PriorityHigh                   // security and audit data
+)
+
+// priorities lists every class from highest to lowest
+var priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// ParsePriority parses a priority name, defaulting to PriorityNormal when empty
+func ParsePriority(name string) (Priority, error) {
+	switch name {
+	case "low":
+		return PriorityLow, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return PriorityNormal, fmt.Errorf("%w: %q", ErrInvalidPriority, name)
+	}
+}
+
+// Eviction decides what is dropped when the buffer is full
+type Eviction string
+
+const (
+	// EvictOldest drops the oldest records of the lowest priority to make
+	// room, so the most recent data survives
+	EvictOldest Eviction = "oldest_first"
+	// EvictNewest keeps what is already buffered and drops the incoming
+	// record, unless a lower priority class can make room
+	EvictNewest Eviction = "newest_first"
+)
+
+// ParseEviction parses an eviction order, defaulting to EvictOldest when empty
+func ParseEviction(name string) (Eviction, error) {
+	switch eviction := Eviction(name); eviction {
+	case "":
+		return EvictOldest, nil
+	case EvictOldest, EvictNewest:
+		return eviction, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidEviction, name)
+	}
+}
+
+// Retention controls how long and which records the buffer keeps
+type Retention struct {
+	MaxAge           time.Duration              // records older than this are dropped; zero keeps them forever
+	MaxAgeByPriority map[Priority]time.Duration // per-class MaxAge, e.g. to keep security data longer
+	Eviction         Eviction
+}
+
+// cutoff returns the time before which records of a class have expired, or
+// the zero time when they never expire
+func (r Retention) cutoff(priority Priority, now time.Time) time.Time {
+	maxAge, ok := r.MaxAgeByPriority[priority]
+	if !ok {
+		maxAge = r.MaxAge
+	}
+	if maxAge <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-maxAge)
+}
+
+// Reasons a record can be dropped
+const (
+	DropEvicted       = "evicted"       // removed to make room for other records
+	DropExpired       = "expired"       // older than the maximum age
+	DropRejected      = "rejected"      // did not fit and nothing could be evicted
+	DropUndecryptable = "undecryptable" // sealed under a data key that is no longer available
+)
+
+// DropCounter counts dropped records
+type DropCounter struct {
+	Records int64 `json:"records"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Stats describes the buffer contents and everything dropped since startup
+type Stats struct {
+	Records         int                    `json:"records"`
+	Bytes           int64                  `json:"bytes"`
+	Dropped         DropCounter            `json:"dropped"`
+	DroppedByClass  map[string]DropCounter `json:"dropped_by_class,omitempty"`
+	DroppedByReason map[string]DropCounter `json:"dropped_by_reason,omitempty"`
+}
+
+// recordDrop updates the drop counters. Must be called with b.mu held.
+func (b *Buffer) recordDrop(priority Priority, reason string, records, bytes int64) {
+	if records == 0 {
+		return
+	}
+
+	add := func(counters map[string]DropCounter, key string) {
+		c := counters[key]
+		c.Records += records
+		c.Bytes += bytes
+		counters[key] = c
+	}
+
+	b.dropped.Records += records
+	b.dropped.Bytes += bytes
+	add(b.droppedByClass, priority.String())
+	add(b.droppedByReason, reason)
+
+	b.logger.Printf("Dropped %d %s-priority buffered records (%d bytes): %s",
+		records, priority, bytes, reason)
+}
+
+// Stats returns the buffer contents and drop counters
+func (b *Buffer) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := Stats{
+		Records:         b.records(),
+		Bytes:           b.size(),
+		Dropped:         b.dropped,
+		DroppedByClass:  make(map[string]DropCounter, len(b.droppedByClass)),
+		DroppedByReason: make(map[string]DropCounter, len(b.droppedByReason)),
+	}
+	for k, v := range b.droppedByClass {
+		stats.DroppedByClass[k] = v
+	}
+	for k, v := range b.droppedByReason {
+		stats.DroppedByReason[k] = v
+	}
+	return stats
+}
+
+// makeRoom evicts records until a record of the given size and priority
+// fits. It returns false when the record must be dropped instead.
+// Must be called with b.mu held.
+func (b *Buffer) makeRoom(priority Priority, recordSize int64) (bool, error) {
+	if recordSize > b.maxSize {
+		return false, nil
+	}
+
+	for b.size()+recordSize > b.maxSize {
+		victim := b.evictionVictim(priority)
+		if victim == nil {
+			return false, nil
+		}
+
+		records, bytes, err := victim.evictOldest()
+		if err != nil {
+			return false, err
+		}
+		b.recordDrop(victim.priority, DropEvicted, records, bytes)
+	}
+
+	return true, nil
+}
+
+// evictionVictim picks the lowest priority class holding records that may
+// be evicted for an incoming record. Must be called with b.mu held.
+func (b *Buffer) evictionVictim(incoming Priority) *queue {
+	for i := len(priorities) - 1; i >= 0; i-- {
+		q := b.queues[priorities[i]]
+		if q.priority > incoming || (q.priority == incoming && b.retention.Eviction == EvictNewest) {
+			return nil
+		}
+		if q.records() > 0 {
+			return q
+		}
+	}
+	return nil
+}
+
+// expire drops records older than the maximum age of their class. Must be
+// called with b.mu held.
+func (b *Buffer) expire() error {
+	now := time.Now()
+	for _, priority := range priorities {
+		cutoff := b.retention.cutoff(priority, now)
+		if cutoff.IsZero() {
+			continue
+		}
+		records, bytes, err := b.queues[priority].expire(cutoff)
+		if err != nil {
+			return err
+		}
+		b.recordDrop(priority, DropExpired, records, bytes)
+	}
+	return nil
+}
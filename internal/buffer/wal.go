@@ -0,0 +1,217 @@
+package buffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// On-disk layout
+//
+// The buffer is a directory of append-only segment files named
+// wal-<sequence>.seg. Records are only ever appended to the newest segment;
+// older segments are immutable and removed whole once drained or pruned.
+//
+// Each record is framed as (integers little endian):
+//
+//	[4 bytes payload length][4 bytes CRC-32C][8 bytes write time, unix nanos][payload]
+//
+// The checksum covers the write time and the payload.
+//
+// A crash can leave a partially written record at the end of the newest
+// segment. It fails the length or checksum test and is truncated on startup.
+const (
+	segmentPrefix      = "wal-"
+	segmentSuffix      = ".seg"
+	recordHeaderSize   = 16
+	defaultSegmentSize = 4 * 1024 * 1024  // 4 MB
+	maxRecordSize      = 64 * 1024 * 1024 // anything larger is treated as corruption
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord marks a record cut short by a crash
+var errTornRecord = errors.New("torn record")
+
+// segment describes one WAL segment file
+type segment struct {
+	seq     uint64
+	path    string
+	size    int64
+	records int
+	newest  time.Time // write time of the last record
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%s%016d%s", segmentPrefix, seq, segmentSuffix)
+}
+
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// listSegments returns the segments in dir, oldest first
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read buffer directory: %w", err)
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		seq, ok := parseSegmentName(entry.Name())
+		if !ok {
+			continue
+		}
+		segments = append(segments, segment{
+			seq:  seq,
+			path: filepath.Join(dir, entry.Name()),
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+	return segments, nil
+}
+
+// encodeRecord frames a payload for appending to a segment
+func encodeRecord(payload []byte, written time.Time) []byte {
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(record[8:16], uint64(written.UnixNano()))
+	copy(record[recordHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(record[8:], crcTable))
+	return record
+}
+
+// readRecord reads the next record from r and returns its payload and write
+// time. It returns io.EOF at a clean end of the segment and errTornRecord for
+// a truncated or corrupt record.
+func readRecord(r io.Reader) ([]byte, time.Time, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, time.Time{}, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, time.Time{}, errTornRecord
+		}
+		return nil, time.Time{}, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, time.Time{}, errTornRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, time.Time{}, errTornRecord
+		}
+		return nil, time.Time{}, err
+	}
+
+	checksum := crc32.Update(crc32.Checksum(header[8:16], crcTable), crcTable, payload)
+	if checksum != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, time.Time{}, errTornRecord
+	}
+
+	written := time.Unix(0, int64(binary.LittleEndian.Uint64(header[8:16])))
+	return payload, written, nil
+}
+
+// recoverSegment scans a segment and truncates it after the last intact
+// record. It fills in the segment's size, record count and newest write time
+// and returns the number of bytes dropped.
+func recoverSegment(seg *segment) (int64, error) {
+	f, err := os.OpenFile(seg.path, os.O_RDWR, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open segment: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat segment: %w", err)
+	}
+
+	counter := &countingReader{r: bufio.NewReader(f)}
+	var valid int64
+	records := 0
+	var newest time.Time
+	for {
+		_, written, err := readRecord(counter)
+		if err == io.EOF || err == errTornRecord {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read segment: %w", err)
+		}
+		valid = counter.n
+		records++
+		newest = written
+	}
+
+	dropped := info.Size() - valid
+	if dropped > 0 {
+		if err := f.Truncate(valid); err != nil {
+			return 0, fmt.Errorf("failed to truncate segment: %w", err)
+		}
+		if err := f.Sync(); err != nil {
+			return 0, fmt.Errorf("failed to sync segment: %w", err)
+		}
+	}
+
+	seg.size = valid
+	seg.records = records
+	seg.newest = newest
+	return dropped, nil
+}
+
+// countingReader tracks how many bytes have been read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// syncDir flushes directory entries so created or removed segments survive a crash
+func syncDir(dir string) error {
+	// Windows does not support fsync on directories
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
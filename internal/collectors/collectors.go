@@ -2,6 +2,7 @@ package collectors
 
 import (
 	"context"
+	"sync"
 
 	"github.com/unitechio/agent/internal/collectors/cpu"
 	"github.com/unitechio/agent/internal/collectors/disk"
@@ -16,6 +17,11 @@ type Collector interface {
 	Collect(ctx context.Context) (interface{}, error)
 }
 
+// Configurable is implemented by collectors that accept policy options
+type Configurable interface {
+	Configure(options map[string]interface{})
+}
+
 type SystemCollector struct{}
 
 func (c *SystemCollector) Name() string {
@@ -58,6 +64,7 @@ func (c *DiskCollector) Collect(ctx context.Context) (interface{}, error) {
 
 type NetworkCollector struct {
 	CollectMAC bool // Policy-controlled: whether to collect MAC addresses
+	mu         sync.RWMutex
 }
 
 func (c *NetworkCollector) Name() string {
@@ -65,7 +72,20 @@ func (c *NetworkCollector) Name() string {
 }
 
 func (c *NetworkCollector) Collect(ctx context.Context) (interface{}, error) {
-	return network.NetworkInfo(ctx, c.CollectMAC)
+	c.mu.RLock()
+	collectMAC := c.CollectMAC
+	c.mu.RUnlock()
+
+	return network.NetworkInfo(ctx, collectMAC)
+}
+
+// Configure applies the "collect_mac" policy option (defaults to false)
+func (c *NetworkCollector) Configure(options map[string]interface{}) {
+	collectMAC, _ := options["collect_mac"].(bool)
+
+	c.mu.Lock()
+	c.CollectMAC = collectMAC
+	c.mu.Unlock()
 }
 
 type ProcessesCollector struct{}
@@ -97,6 +117,15 @@ func NewDefaultCollectors() []Collector {
 		&DiskCollector{},
 		// &FileCollector{},
 		&ProcessesCollector{},
-		&NetworkCollector{CollectMAC: false}, // MAC collection disabled by default
+		&NetworkCollector{}, // MAC collection is configured from policy options
+	}
+}
+
+// Names returns the names of all built-in collectors
+func Names() []string {
+	var names []string
+	for _, collector := range NewDefaultCollectors() {
+		names = append(names, collector.Name())
 	}
+	return names
 }
@@ -1,10 +1,14 @@
 package config
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -19,13 +23,48 @@ type Config struct {
 	APIBaseURL string    `json:"api_base_url,omitempty"`
 	TLSConfig  TLSConfig `json:"tls,omitempty"`
 
+	// Bootstrap endpoint and the trust pinned for it: a PEM CA bundle its
+	// certificate must chain to and/or sha256/<base64> SPKI hashes, one of
+	// which must appear in its chain. Empty uses the production endpoint and
+	// the system roots.
+	BootstrapURL  string   `json:"bootstrap_url,omitempty"`
+	BootstrapCA   string   `json:"bootstrap_ca,omitempty"`
+	BootstrapPins []string `json:"bootstrap_pins,omitempty"`
+
+	// Bootstrap again with the install token when the backend refuses to renew a revoked certificate
+	RebootstrapOnAuthFailure bool `json:"rebootstrap_on_auth_failure,omitempty"`
+
+	// Algorithm for keys generated on this host: ecdsa-p256 (default) or ed25519
+	KeyAlgorithm string `json:"key_algorithm,omitempty"`
+
+	// Where the private key lives: file (default, PEM at tls.key_file) or pkcs11
+	KeyProvider string       `json:"key_provider,omitempty"`
+	PKCS11      PKCS11Config `json:"pkcs11,omitempty"`
+
+	// HTTP proxy for all agent traffic; empty uses HTTPS_PROXY/HTTP_PROXY/NO_PROXY
+	Proxy ProxyConfig `json:"proxy,omitempty"`
+
+	// Renew the certificate once this fraction of its lifetime has passed (default 2/3)
+	CertRenewFraction float64 `json:"cert_renew_fraction,omitempty"`
+
 	// Data collection
 	CollectionInterval time.Duration `json:"collection_interval,omitempty"`
-	BatchSize          int           `json:"batch_size,omitempty"`
+	BatchSize          int           `json:"batch_size,omitempty"` // Deprecated: batching follows the telemetry policy
+
+	// Send queue
+	SendQueueSize     int           `json:"send_queue_size,omitempty"`     // records held in memory awaiting delivery
+	SendQueueOverflow string        `json:"send_queue_overflow,omitempty"` // spill, drop_oldest or block
+	SendQueueTimeout  time.Duration `json:"send_queue_timeout,omitempty"`  // how long Send waits with send_queue_overflow=block
 
 	// Buffering
-	MaxBufferSize int64  `json:"max_buffer_size,omitempty"` // bytes
-	BufferDir     string `json:"buffer_dir,omitempty"`
+	MaxBufferSize      int64         `json:"max_buffer_size,omitempty"` // bytes
+	BufferDir          string        `json:"buffer_dir,omitempty"`
+	BufferSync         string        `json:"buffer_sync,omitempty"`          // always, interval or never
+	BufferSyncInterval time.Duration `json:"buffer_sync_interval,omitempty"` // with buffer_sync=interval
+	BufferMaxAge       time.Duration `json:"buffer_max_age,omitempty"`       // zero keeps records until evicted
+	// Per-priority buffer_max_age ("low", "normal", "high"), so security data outlives routine metrics
+	BufferMaxAgeByPriority map[string]time.Duration `json:"buffer_max_age_by_priority,omitempty"`
+	BufferEviction         string                   `json:"buffer_eviction,omitempty"` // oldest_first or newest_first
 
 	// Health & monitoring
 	HeartbeatInterval time.Duration `json:"heartbeat_interval,omitempty"`
@@ -34,6 +73,13 @@ type Config struct {
 	LogLevel string `json:"log_level,omitempty"`
 	LogFile  string `json:"log_file,omitempty"`
 
+	// Audit logging
+	AuditLogFile string `json:"audit_log_file,omitempty"`
+
+	// Policy
+	PolicyCacheFile    string `json:"policy_cache_file,omitempty"`    // last known good policy
+	PolicyOverrideFile string `json:"policy_override_file,omitempty"` // local override merged over the server policy
+
 	// Update configuration
 	UpdateEnabled       bool          `json:"update_enabled,omitempty"`
 	UpdateCheckInterval time.Duration `json:"update_check_interval,omitempty"`
@@ -47,6 +93,22 @@ type TLSConfig struct {
 	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // Only for testing
 }
 
+// PKCS11Config selects the token that holds a non-exportable agent key
+type PKCS11Config struct {
+	Module     string `json:"module"`        // path to the PKCS#11 library
+	TokenLabel string `json:"token_label"`   // label of the token to use
+	Pin        string `json:"pin,omitempty"` // user PIN; falls back to PKCS11_PIN
+}
+
+// ProxyConfig routes agent traffic through an HTTP proxy (see package proxy)
+type ProxyConfig struct {
+	URL      string   `json:"url,omitempty"`      // http://host:port or https://host:port
+	Username string   `json:"username,omitempty"` // basic auth, also used for proxies picked by the PAC file
+	Password string   `json:"password,omitempty"`
+	NoProxy  []string `json:"no_proxy,omitempty"` // hosts, domains, IPs and CIDRs to reach directly
+	PACURL   string   `json:"pac_url,omitempty"`  // PAC file path or http(s) URL, evaluated locally
+}
+
 // Load reads configuration from a JSON file
 // Returns ErrConfigNotFound if the file doesn't exist
 func Load(path string) (*Config, error) {
@@ -106,9 +168,44 @@ func (c *Config) ValidateBootstrap() error {
 	if c.InstallToken == "" {
 		return fmt.Errorf("%w: install_token is required", ErrInvalidBootstrap)
 	}
+	if c.BootstrapCA != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(c.BootstrapCA)) {
+		return fmt.Errorf("%w: bootstrap_ca contains no PEM certificates", ErrInvalidBootstrap)
+	}
+	for _, pin := range c.BootstrapPins {
+		if _, err := ParseSPKIPin(pin); err != nil {
+			return fmt.Errorf("%w: bootstrap_pins: %v", ErrInvalidBootstrap, err)
+		}
+	}
+	switch c.KeyAlgorithm {
+	case "", "ecdsa-p256", "ed25519":
+	default:
+		return fmt.Errorf("%w: key_algorithm must be ecdsa-p256 or ed25519", ErrInvalidBootstrap)
+	}
+	switch c.KeyProvider {
+	case "", "file":
+	case "pkcs11":
+		if c.PKCS11.Module == "" || c.PKCS11.TokenLabel == "" {
+			return fmt.Errorf("%w: pkcs11.module and pkcs11.token_label are required", ErrInvalidBootstrap)
+		}
+	default:
+		return fmt.Errorf("%w: key_provider must be file or pkcs11", ErrInvalidBootstrap)
+	}
 	return nil
 }
 
+// ParseSPKIPin decodes a pin of the form sha256/<base64 SHA-256 of the SubjectPublicKeyInfo>
+func ParseSPKIPin(pin string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(pin, "sha256/")
+	if !ok {
+		return nil, fmt.Errorf("pin %q must start with sha256/", pin)
+	}
+	hash, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("pin %q is not a base64 SHA-256 hash", pin)
+	}
+	return hash, nil
+}
+
 // ValidateRuntime validates the full configuration needed for normal operation
 func (c *Config) ValidateRuntime() error {
 	if !c.Bootstrapped {
@@ -143,16 +240,24 @@ func (c *Config) MarkBootstrapped(agentID, apiBaseURL string) {
 // NewBootstrapConfig creates a minimal configuration for bootstrap from environment variables
 func NewBootstrapConfig() *Config {
 	return &Config{
-		Bootstrapped:        false,
-		OrgID:               os.Getenv("ORG_ID"),
-		InstallToken:        os.Getenv("INSTALL_TOKEN"),
-		CollectionInterval:  60 * time.Second,
-		BatchSize:           100,
-		MaxBufferSize:       100 * 1024 * 1024, // 100 MB
-		BufferDir:           getDefaultBufferDir(),
+		Bootstrapped:       false,
+		OrgID:              os.Getenv("ORG_ID"),
+		InstallToken:       os.Getenv("INSTALL_TOKEN"),
+		KeyAlgorithm:       os.Getenv("KEY_ALGORITHM"),
+		BootstrapURL:       os.Getenv("BOOTSTRAP_URL"),
+		CollectionInterval: 60 * time.Second,
+		BatchSize:          100,
+		SendQueueSize:      1000,
+		MaxBufferSize:      100 * 1024 * 1024, // 100 MB
+		BufferDir:          getDefaultBufferDir(),
+		BufferMaxAge:       7 * 24 * time.Hour,
+		BufferMaxAgeByPriority: map[string]time.Duration{
+			"high": 30 * 24 * time.Hour,
+		},
 		HeartbeatInterval:   5 * time.Minute,
 		LogLevel:            "info",
 		LogFile:             getDefaultLogFile(),
+		AuditLogFile:        getDefaultAuditLogFile(),
 		UpdateEnabled:       true,
 		UpdateCheckInterval: 1 * time.Hour,
 		TLSConfig: TLSConfig{
@@ -188,6 +293,13 @@ func getDefaultLogFile() string {
 	return "/var/log/your-agent/agent.log"
 }
 
+func getDefaultAuditLogFile() string {
+	if isWindows() {
+		return `C:\ProgramData\unitechio\Agent\logs\audit.log`
+	}
+	return "/var/log/your-agent/audit.log"
+}
+
 func getDefaultCertPath() string {
 	if isWindows() {
 		return `C:\ProgramData\unitechio\Agent\certs\agent.crt`
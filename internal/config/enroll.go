@@ -0,0 +1,174 @@
+package config
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Enrollment
+//
+// Installers and MDM tools enroll an agent with a single artifact instead of
+// environment variables: an enrollment bundle file, an enrollment URL such as
+// https://api.example.com/enroll?org_id=acme&token=... or an enrollment token,
+// which is a bundle encoded as base64url JSON. All three carry the org ID and
+// install token and can pin the bootstrap server's SPKI hash; bundles can also
+// name the bootstrap endpoint and the CA its certificate must chain to.
+
+// bootstrapPath is the bootstrap endpoint on the server an enrollment URL names
+const bootstrapPath = "/api/v1/agents/bootstrap"
+
+// Enrollment holds what an agent needs to bootstrap into an org
+type Enrollment struct {
+	OrgID        string    `json:"org_id"`
+	InstallToken string    `json:"install_token"`
+	BootstrapURL string    `json:"bootstrap_url,omitempty"` // defaults to the production endpoint
+	CACert       string    `json:"ca_cert,omitempty"`       // PEM bundle the bootstrap server must chain to
+	SPKIPins     []string  `json:"spki_pins,omitempty"`     // sha256/<base64> keys, one of which the bootstrap server must present
+	ExpiresAt    time.Time `json:"expires_at,omitempty"`    // when the install token stops being accepted
+}
+
+// ReadEnrollment reads an enrollment from a bundle file path, an enrollment
+// URL or an enrollment token
+func ReadEnrollment(source string) (*Enrollment, error) {
+	source = strings.TrimSpace(source)
+
+	var e *Enrollment
+	var err error
+	switch {
+	case fileExists(source):
+		e, err = LoadEnrollment(source)
+	case strings.Contains(source, "://"):
+		e, err = parseEnrollmentURL(source)
+	default:
+		e, err = parseEnrollmentToken(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// LoadEnrollment reads an enrollment bundle file
+func LoadEnrollment(path string) (*Enrollment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enrollment bundle: %w", err)
+	}
+
+	var e Enrollment
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse bundle %s: %v", ErrInvalidEnrollment, path, err)
+	}
+	return &e, nil
+}
+
+// parseEnrollmentURL reads the org ID, token and optional expiry and pins
+// from the query of an enrollment URL; its scheme and host name the
+// bootstrap server
+func parseEnrollmentURL(raw string) (*Enrollment, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnrollment, err)
+	}
+
+	query := u.Query()
+	e := &Enrollment{
+		OrgID:        query.Get("org_id"),
+		InstallToken: query.Get("token"),
+		BootstrapURL: (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: bootstrapPath}).String(),
+		SPKIPins:     query["pin"],
+	}
+	if expires := query.Get("expires"); expires != "" {
+		if e.ExpiresAt, err = time.Parse(time.RFC3339, expires); err != nil {
+			return nil, fmt.Errorf("%w: expires must be an RFC 3339 time", ErrInvalidEnrollment)
+		}
+	}
+	return e, nil
+}
+
+// parseEnrollmentToken decodes a base64url-encoded bundle
+func parseEnrollmentToken(token string) (*Enrollment, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(token, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: not a bundle file, URL or enrollment token", ErrInvalidEnrollment)
+	}
+
+	var e Enrollment
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse enrollment token: %v", ErrInvalidEnrollment, err)
+	}
+	return &e, nil
+}
+
+// Validate checks that the enrollment is complete and has not expired
+func (e *Enrollment) Validate() error {
+	if e.OrgID == "" {
+		return fmt.Errorf("%w: org_id is required", ErrInvalidEnrollment)
+	}
+	if e.InstallToken == "" {
+		return fmt.Errorf("%w: install token is required", ErrInvalidEnrollment)
+	}
+	if !e.ExpiresAt.IsZero() && time.Now().After(e.ExpiresAt) {
+		return fmt.Errorf("%w at %s, request a new one", ErrEnrollmentExpired, e.ExpiresAt.Format(time.RFC3339))
+	}
+
+	if e.BootstrapURL != "" {
+		u, err := url.Parse(e.BootstrapURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%w: invalid bootstrap URL %q", ErrInvalidEnrollment, e.BootstrapURL)
+		}
+		// The install token must not cross the network in clear text
+		if u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname())) {
+			return fmt.Errorf("%w: bootstrap URL must use https", ErrInvalidEnrollment)
+		}
+	}
+	if e.CACert != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(e.CACert)) {
+		return fmt.Errorf("%w: ca_cert contains no PEM certificates", ErrInvalidEnrollment)
+	}
+	for _, pin := range e.SPKIPins {
+		if _, err := ParseSPKIPin(pin); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEnrollment, err)
+		}
+	}
+	return nil
+}
+
+// Apply copies the enrollment into a bootstrap configuration
+func (e *Enrollment) Apply(cfg *Config) {
+	cfg.OrgID = e.OrgID
+	cfg.InstallToken = e.InstallToken
+	if e.BootstrapURL != "" {
+		cfg.BootstrapURL = e.BootstrapURL
+	}
+	if e.CACert != "" {
+		cfg.BootstrapCA = e.CACert
+	}
+	if len(e.SPKIPins) > 0 {
+		cfg.BootstrapPins = e.SPKIPins
+	}
+}
+
+// isLoopback reports whether host is this machine, for local test servers
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
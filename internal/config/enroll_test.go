@@ -0,0 +1,63 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadEnrollment(t *testing.T) {
+	bundle := Enrollment{
+		OrgID:        "acme",
+		InstallToken: "tok_3f9a",
+		BootstrapURL: "https://enroll.acme.example/api/v1/agents/bootstrap",
+	}
+	data, _ := json.Marshal(bundle)
+
+	bundlePath := filepath.Join(t.TempDir(), "enrollment.json")
+	os.WriteFile(bundlePath, data, 0600)
+
+	sources := map[string]string{
+		"bundle file": bundlePath,
+		"token":       base64.RawURLEncoding.EncodeToString(data),
+		"URL":         "https://enroll.acme.example/enroll?org_id=acme&token=tok_3f9a",
+	}
+	for name, source := range sources {
+		t.Run(name, func(t *testing.T) {
+			e, err := ReadEnrollment(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.OrgID != bundle.OrgID || e.InstallToken != bundle.InstallToken || e.BootstrapURL != bundle.BootstrapURL {
+				t.Errorf("Unexpected enrollment: %+v", e)
+			}
+		})
+	}
+}
+
+func TestReadEnrollmentRejects(t *testing.T) {
+	expired := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	tests := map[string]struct {
+		source string
+		err    error
+	}{
+		"expired":      {"https://enroll.acme.example/enroll?org_id=acme&token=t&expires=" + expired, ErrEnrollmentExpired},
+		"no token":     {"https://enroll.acme.example/enroll?org_id=acme", ErrInvalidEnrollment},
+		"plain http":   {"http://enroll.acme.example/enroll?org_id=acme&token=t", ErrInvalidEnrollment},
+		"bad pin":      {"https://enroll.acme.example/enroll?org_id=acme&token=t&pin=md5/abc", ErrInvalidEnrollment},
+		"not a bundle": {"not*a*token", ErrInvalidEnrollment},
+		"missing file": {"does-not-exist.json", ErrInvalidEnrollment},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadEnrollment(tt.source); !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
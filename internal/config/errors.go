@@ -9,4 +9,6 @@ var (
 	ErrInvalidRuntime      = errors.New("invalid runtime configuration")
 	ErrCertExpired         = errors.New("certificate expired")
 	ErrBootstrapInProgress = errors.New("bootstrap already in progress")
+	ErrInvalidEnrollment   = errors.New("invalid enrollment")
+	ErrEnrollmentExpired   = errors.New("enrollment token expired")
 )
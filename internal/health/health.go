@@ -6,30 +6,39 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"runtime"
 	"time"
 
 	"github.com/unitechio/agent/internal/config"
 	"github.com/unitechio/agent/internal/identity"
+	"github.com/unitechio/agent/internal/sender"
 )
 
 type Monitor struct {
 	cfg       *config.Config
 	identity  *identity.Manager
 	logger    *log.Logger
+	sender    *sender.Sender
+	onDrift   func(*identity.Drift)
 	stopCh    chan struct{}
 	startTime time.Time
 }
 
 type HealthStatus struct {
-	AgentID       string    `json:"agent_id"`
-	Version       string    `json:"version"`
-	Status        string    `json:"status"` // healthy, degraded, unhealthy
-	Uptime        int64     `json:"uptime_seconds"`
-	LastHeartbeat time.Time `json:"last_heartbeat"`
-	MemoryUsageMB float64   `json:"memory_usage_mb"`
-	Goroutines    int       `json:"goroutines"`
-	Errors        []string  `json:"errors,omitempty"`
+	AgentID       string        `json:"agent_id"`
+	Version       string        `json:"version"`
+	Status        string        `json:"status"` // healthy, degraded, unhealthy
+	Uptime        int64         `json:"uptime_seconds"`
+	LastHeartbeat time.Time     `json:"last_heartbeat"`
+	MemoryUsageMB float64       `json:"memory_usage_mb"`
+	Goroutines    int           `json:"goroutines"`
+	Errors        []string      `json:"errors,omitempty"`
+	Telemetry     *sender.Stats `json:"telemetry,omitempty"`
+
+	// Host fingerprint hash and, if the host changed since bootstrap, what changed
+	HostFingerprint  string          `json:"host_fingerprint,omitempty"`
+	FingerprintDrift *identity.Drift `json:"fingerprint_drift,omitempty"`
 }
 
 func NewMonitor(cfg *config.Config, identityMgr *identity.Manager, logger *log.Logger) *Monitor {
@@ -42,6 +51,17 @@ func NewMonitor(cfg *config.Config, identityMgr *identity.Manager, logger *log.L
 	}
 }
 
+// SetSender includes the sender's buffer and drop counters in heartbeats
+func (m *Monitor) SetSender(s *sender.Sender) {
+	m.sender = s
+}
+
+// OnFingerprintDrift sets the function called when a heartbeat finds that the
+// host no longer matches the one the agent was bootstrapped on
+func (m *Monitor) OnFingerprintDrift(fn func(*identity.Drift)) {
+	m.onDrift = fn
+}
+
 func (m *Monitor) Start(ctx context.Context) {
 	m.logger.Println("Starting health monitor...")
 
@@ -72,11 +92,19 @@ func (m *Monitor) Stop() {
 }
 
 func (m *Monitor) sendHeartbeat(ctx context.Context) {
+	// Re-check the host so a cloned agent is reported in this heartbeat
+	drift, err := m.identity.CheckFingerprint()
+	if err != nil {
+		m.logger.Printf("Failed to check host fingerprint: %v", err)
+	}
+	defer m.handleDrift(drift)
+
 	status := m.getHealthStatus()
 
+	// Shared mTLS client; connections are pooled across heartbeats
 	client, err := m.identity.GetHTTPClient()
 	if err != nil {
-		m.logger.Printf("Failed to create HTTP client for heartbeat: %v", err)
+		m.logger.Printf("Failed to get HTTP client for heartbeat: %v", err)
 		return
 	}
 
@@ -88,7 +116,14 @@ func (m *Monitor) sendHeartbeat(ctx context.Context) {
 		return
 	}
 
-	req, err := client.Post(url, "application/json", bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		m.logger.Printf("Failed to create heartbeat request: %v", err)
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	req, err := client.Do(httpReq)
 	if err != nil {
 		m.logger.Printf("Failed to send heartbeat: %v", err)
 		return
@@ -103,11 +138,19 @@ func (m *Monitor) sendHeartbeat(ctx context.Context) {
 	m.logger.Printf("Heartbeat sent successfully (status: %s)", status.Status)
 }
 
+// handleDrift passes a drift on for the policy's reaction, after the
+// heartbeat reporting it has been sent
+func (m *Monitor) handleDrift(drift *identity.Drift) {
+	if drift != nil && m.onDrift != nil {
+		m.onDrift(drift)
+	}
+}
+
 func (m *Monitor) getHealthStatus() *HealthStatus {
 	var memStats runtime.MemStats
 	runtime.ReadMemStats(&memStats)
 
-	return &HealthStatus{
+	status := &HealthStatus{
 		AgentID:       m.identity.GetAgentID(),
 		Version:       "1.0.0",
 		Status:        "healthy",
@@ -116,6 +159,19 @@ func (m *Monitor) getHealthStatus() *HealthStatus {
 		MemoryUsageMB: float64(memStats.Alloc) / 1024 / 1024,
 		Goroutines:    runtime.NumGoroutine(),
 	}
+
+	status.HostFingerprint = m.identity.HostFingerprint()
+	if drift := m.identity.FingerprintDrift(); drift != nil {
+		status.FingerprintDrift = drift
+		status.Status = "degraded"
+	}
+
+	if m.sender != nil {
+		stats := m.sender.Stats()
+		status.Telemetry = &stats
+	}
+
+	return status
 }
 
 // CheckHealth performs a health check
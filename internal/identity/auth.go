@@ -0,0 +1,204 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/unitechio/agent/internal/retry"
+)
+
+// Auth failure recovery
+//
+// Every mTLS request goes through authTransport. A 401 or 403 from the
+// backend means the agent certificate was revoked or rotated server-side, so
+// the manager first asks the backend to renew it. If renewal is refused and
+// rebootstrap_on_auth_failure is set, the agent bootstraps again with its
+// install token. Either way the shared transport picks up the new
+// certificate (see tls.go), so every component holding the client from
+// GetHTTPClient uses it without a restart.
+
+// Limits on recovery attempts
+const (
+	minRecoveryInterval = 1 * time.Minute
+	recoveryTimeout     = 10 * time.Minute
+)
+
+// Reasons an identity changes
+const (
+	ChangeRenewed        = "renewed"
+	ChangeRebootstrapped = "rebootstrapped"
+)
+
+// Change describes a new agent identity delivered to subscribers
+type Change struct {
+	Reason     string // ChangeRenewed or ChangeRebootstrapped
+	AgentID    string
+	APIBaseURL string    // backend named by a re-bootstrap, empty on renewal
+	NotAfter   time.Time // expiry of the new certificate
+}
+
+// ErrRecoveryDisabled is returned when renewal failed and re-bootstrap is not allowed
+var ErrRecoveryDisabled = errors.New("certificate renewal refused and re-bootstrap is disabled")
+
+// authTransport forwards requests over the manager's shared mTLS transport
+// and reports authentication failures
+type authTransport struct {
+	manager *Manager
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.manager.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		t.manager.reportAuthFailure(req.URL.Path, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// reportAuthFailure audits a rejected request and starts recovery, unless it
+// is already running or ran too recently
+func (m *Manager) reportAuthFailure(endpoint string, status int) {
+	m.logger.Printf("Backend rejected agent credentials (%d %s) on %s", status, http.StatusText(status), endpoint)
+	if m.audit != nil {
+		m.audit.LogAuthFailure(endpoint, fmt.Sprintf("status %d", status))
+	}
+
+	m.mu.Lock()
+	if m.recovering || time.Since(m.lastRecovery) < minRecoveryInterval {
+		m.mu.Unlock()
+		return
+	}
+	m.recovering = true
+	m.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), recoveryTimeout)
+		defer cancel()
+
+		if err := m.Recover(ctx); err != nil {
+			m.logger.Printf("Failed to recover agent identity: %v", err)
+		}
+
+		m.mu.Lock()
+		m.recovering = false
+		m.lastRecovery = time.Now()
+		m.mu.Unlock()
+	}()
+}
+
+// Recover renews the agent certificate, falling back to a re-bootstrap when
+// renewal is refused and cfg.RebootstrapOnAuthFailure is set
+func (m *Manager) Recover(ctx context.Context) error {
+	m.logger.Println("Renewing agent certificate...")
+
+	err := m.renew(ctx)
+	if err == nil {
+		return m.activate(Change{Reason: ChangeRenewed})
+	}
+	m.logger.Printf("Certificate renewal failed: %v", err)
+	m.auditRotation(false, err)
+
+	// Only a refusal justifies starting over; network errors do not
+	if code := retry.StatusCode(err); code != http.StatusUnauthorized && code != http.StatusForbidden {
+		return err
+	}
+	if !m.cfg.RebootstrapOnAuthFailure {
+		return ErrRecoveryDisabled
+	}
+
+	m.logger.Println("Re-bootstrapping agent...")
+	resp, err := m.rebootstrap(ctx)
+	if err != nil {
+		m.auditRotation(false, err)
+		return fmt.Errorf("re-bootstrap failed: %w", err)
+	}
+	return m.activate(Change{Reason: ChangeRebootstrapped, APIBaseURL: resp.APIBaseURL})
+}
+
+// rebootstrap registers the agent again with its install token, taken from
+// the config or the INSTALL_TOKEN environment variable.
+// The shared config is only read here, since other components use it
+// concurrently; subscribers get the new agent ID and API URL in the Change.
+func (m *Manager) rebootstrap(ctx context.Context) (*BootstrapResponse, error) {
+	installToken := m.cfg.InstallToken
+	if installToken == "" {
+		installToken = os.Getenv("INSTALL_TOKEN")
+	}
+	if installToken == "" {
+		return nil, ErrNoInstallToken
+	}
+
+	return m.register(ctx, installToken)
+}
+
+// activate loads the new certificate into the shared transport and tells
+// subscribers. The agent ID and expiry of the change are filled in here.
+func (m *Manager) activate(change Change) error {
+	if err := m.VerifyIdentity(); err != nil {
+		m.auditRotation(false, err)
+		return err
+	}
+	if err := m.reloadCredentials(); err != nil {
+		m.auditRotation(false, err)
+		return fmt.Errorf("failed to reload client certificate: %w", err)
+	}
+
+	notAfter, _ := m.certificateExpiry()
+	if m.audit != nil {
+		m.audit.LogCertRotation(true, notAfter, nil)
+	}
+	change.AgentID = m.GetAgentID()
+	change.NotAfter = notAfter
+	m.logger.Printf("Agent certificate %s (agent ID %s, expires %s)", change.Reason, change.AgentID, notAfter.Format(time.RFC3339))
+
+	m.notify(change)
+	return nil
+}
+
+// auditRotation records a failed renewal or re-bootstrap
+func (m *Manager) auditRotation(success bool, err error) {
+	if m.audit == nil {
+		return
+	}
+	notAfter, _ := m.certificateExpiry()
+	m.audit.LogCertRotation(success, notAfter, err)
+}
+
+// Subscribe registers a callback invoked after the identity changes, e.g. to
+// re-key the telemetry buffer or save the config. Callbacks run on the
+// recovery goroutine. The returned function removes the subscription.
+func (m *Manager) Subscribe(fn func(Change)) func() {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	id := m.nextSubID
+	m.nextSubID++
+	m.subscribers[id] = fn
+
+	return func() {
+		m.subMu.Lock()
+		defer m.subMu.Unlock()
+		delete(m.subscribers, id)
+	}
+}
+
+// notify delivers a change to all subscribers
+func (m *Manager) notify(change Change) {
+	m.subMu.Lock()
+	subscribers := make([]func(Change), 0, len(m.subscribers))
+	for _, fn := range m.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	m.subMu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(change)
+	}
+}
@@ -0,0 +1,217 @@
+package identity
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForChange returns the next identity change, failing the test if none arrives
+func waitForChange(t *testing.T, changes <-chan Change) Change {
+	t.Helper()
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the agent identity to change")
+		return Change{}
+	}
+}
+
+// waitForRecovery waits for the background recovery goroutine to finish
+func waitForRecovery(t *testing.T, m *Manager) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		m.mu.RLock()
+		recovering := m.recovering
+		m.mu.RUnlock()
+		if !recovering {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Recovery did not finish")
+}
+
+func get(t *testing.T, client *http.Client, url string) int {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestUnauthorizedRenewsAndRetrySucceeds(t *testing.T) {
+	ca := newTestCA(t)
+
+	var mu sync.Mutex
+	var revoked *x509.Certificate
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/agents/renew", renewHandler(t, ca, nil))
+	mux.HandleFunc("/api/v1/telemetry", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.TLS.PeerCertificates[0].Equal(revoked) {
+			http.Error(w, "certificate revoked", http.StatusUnauthorized)
+		}
+	})
+	server := newBackend(t, ca, mux)
+
+	m := newTestManager(t, ca, server.URL)
+	changes := make(chan Change, 1)
+	m.Subscribe(func(change Change) { changes <- change })
+
+	original, err := m.loadCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	revoked = original
+	mu.Unlock()
+
+	client, err := m.GetHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := get(t, client, server.URL+"/api/v1/telemetry"); status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with the revoked certificate, got %d", status)
+	}
+
+	change := waitForChange(t, changes)
+	if change.Reason != ChangeRenewed || change.AgentID != testAgentID {
+		t.Errorf("Expected a renewal of %s, got %+v", testAgentID, change)
+	}
+
+	// The same client retries with the renewed certificate
+	if status := get(t, client, server.URL+"/api/v1/telemetry"); status != http.StatusOK {
+		t.Errorf("Expected the retry to succeed, got %d", status)
+	}
+}
+
+func TestRefusedRenewalRebootstraps(t *testing.T) {
+	t.Setenv("INSTALL_TOKEN", "")
+	ca := newTestCA(t)
+	const newAgentID = "9b1e7c2d-4f6a-4d3b-8e25-7a0c1f9d6e48"
+
+	backend := newBackend(t, ca, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "agent revoked", http.StatusForbidden)
+	}))
+	bootstrap := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req BootstrapRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		block, _ := pem.Decode([]byte(req.CSR))
+		if block == nil || req.InstallToken != "fresh-token" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			http.Error(w, "bad CSR", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(BootstrapResponse{
+			AgentID:     newAgentID,
+			APIBaseURL:  "https://api.example.test",
+			Certificate: string(ca.issueAgent(t, newAgentID, csr.PublicKey)),
+			CACert:      string(ca.pem),
+		})
+	}))
+	defer bootstrap.Close()
+
+	m := newTestManager(t, ca, backend.URL)
+	m.cfg.OrgID = "test-org"
+	m.cfg.InstallToken = "fresh-token"
+	m.cfg.BootstrapURL = bootstrap.URL
+
+	if err := m.Recover(context.Background()); !errors.Is(err, ErrRecoveryDisabled) {
+		t.Fatalf("Expected ErrRecoveryDisabled without rebootstrap_on_auth_failure, got %v", err)
+	}
+
+	m.cfg.RebootstrapOnAuthFailure = true
+	var change Change
+	m.Subscribe(func(c Change) { change = c })
+	if err := m.Recover(context.Background()); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+
+	if change.Reason != ChangeRebootstrapped || change.AgentID != newAgentID || change.APIBaseURL != "https://api.example.test" {
+		t.Errorf("Expected a re-bootstrap as %s, got %+v", newAgentID, change)
+	}
+	if m.GetAgentID() != newAgentID {
+		t.Errorf("Expected agent ID %s, got %s", newAgentID, m.GetAgentID())
+	}
+
+	// The shared config is left to the subscribers
+	if m.cfg.AgentID != testAgentID || m.cfg.APIBaseURL != backend.URL {
+		t.Errorf("Expected the shared config to be unchanged, got %s at %s", m.cfg.AgentID, m.cfg.APIBaseURL)
+	}
+}
+
+func TestAuthFailureRecoveryIsThrottled(t *testing.T) {
+	ca := newTestCA(t)
+
+	var mu sync.Mutex
+	renewals := 0
+	renew := renewHandler(t, ca, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/agents/renew", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		renewals++
+		mu.Unlock()
+		renew(w, r)
+	})
+	mux.HandleFunc("/api/v1/telemetry", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "certificate revoked", http.StatusUnauthorized)
+	})
+	server := newBackend(t, ca, mux)
+
+	m := newTestManager(t, ca, server.URL)
+	changes := make(chan Change, 1)
+	m.Subscribe(func(change Change) { changes <- change })
+
+	client, err := m.GetHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get(t, client, server.URL+"/api/v1/telemetry")
+	waitForChange(t, changes)
+	waitForRecovery(t, m)
+
+	// Rejections right after a recovery do not start another one
+	for i := 0; i < 3; i++ {
+		get(t, client, server.URL+"/api/v1/telemetry")
+	}
+	waitForRecovery(t, m)
+
+	mu.Lock()
+	if renewals != 1 {
+		t.Errorf("Expected 1 renewal within %v, got %d", minRecoveryInterval, renewals)
+	}
+	mu.Unlock()
+
+	// Once the interval has passed the next rejection recovers again
+	m.mu.Lock()
+	m.lastRecovery = time.Now().Add(-minRecoveryInterval)
+	m.mu.Unlock()
+
+	get(t, client, server.URL+"/api/v1/telemetry")
+	waitForChange(t, changes)
+	waitForRecovery(t, m)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if renewals != 2 {
+		t.Errorf("Expected a second renewal after %v, got %d renewals", minRecoveryInterval, renewals)
+	}
+}
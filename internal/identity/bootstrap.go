@@ -6,45 +6,83 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/unitechio/agent/internal/config"
+	"github.com/unitechio/agent/internal/logging"
+	"github.com/unitechio/agent/internal/proxy"
+	"github.com/unitechio/agent/internal/retry"
+)
+
+// defaultAPIBaseURL is the production backend, used when bootstrap names no other
+const defaultAPIBaseURL = "https://api.unitechio.space"
+
+// Install token rejections reported by the bootstrap API
+var (
+	ErrTokenExpired   = errors.New("install token expired")
+	ErrTokenUsed      = errors.New("install token already used")
+	ErrNoInstallToken = errors.New("no install token available")
 )
 
 // Manager handles agent identity and mTLS certificates
 type Manager struct {
 	cfg      *config.Config
 	logger   *log.Logger
-	agentID  string
+	audit    *logging.AuditLogger
 	certPath string
 	keyPath  string
 	caPath   string
+	keys     KeyProvider // holds the private key that keyPath refers to
+
+	creds     *credentials    // hot-reloaded certificate and CA pool; see tls.go
+	transport *http.Transport // pooled mTLS transport shared by every client
+	proxy     *proxy.Resolver // picks the proxy for bootstrap and mTLS requests
+
+	// rotateMu serializes key rotations (renewal and registration) from key
+	// generation until the new key and certificate are installed
+	rotateMu sync.Mutex
+
+	mu           sync.RWMutex
+	agentID      string
+	client       *http.Client // shared by every component; see auth.go
+	recovering   bool
+	lastRecovery time.Time
+	fingerprint  Fingerprint // of this host, as last read
+	drift        *Drift      // found by the last CheckFingerprint
+	noReenroll   bool        // drift re-bootstrap fell back to report; see HandleDrift
+
+	subMu       sync.Mutex
+	subscribers map[int]func(Change)
+	nextSubID   int
 }
 
 // BootstrapRequest is sent to the server during initial registration
 type BootstrapRequest struct {
-	OrgID        string `json:"org_id"`
-	InstallToken string `json:"install_token"`
-	Hostname     string `json:"hostname"`
-	OS           string `json:"os"`
-	Arch         string `json:"arch"`
-	AgentVersion string `json:"agent_version"`
+	OrgID           string `json:"org_id"`
+	InstallToken    string `json:"install_token"`
+	Hostname        string `json:"hostname"`
+	OS              string `json:"os"`
+	Arch            string `json:"arch"`
+	AgentVersion    string `json:"agent_version"`
+	HostFingerprint string `json:"host_fingerprint"` // Fingerprint.Hash of this host
+	CSR             string `json:"csr"`              // PEM-encoded PKCS#10 request for a key generated on this host
 }
 
 // BootstrapResponse contains the agent identity and certificates
 type BootstrapResponse struct {
 	AgentID     string `json:"agent_id"`
 	APIBaseURL  string `json:"api_base_url"` // Server-provided API endpoint
-	Certificate string `json:"certificate"`  // PEM-encoded X.509 certificate
-	PrivateKey  string `json:"private_key"`  // PEM-encoded private key
+	Certificate string `json:"certificate"`  // PEM-encoded X.509 certificate, issued for the CSR
 	CACert      string `json:"ca_cert"`      // PEM-encoded CA certificate
-	Policy      string `json:"policy"`       // Initial policy JSON
+	Policy      string `json:"policy"`       // Initial signed policy document (JSON)
 	ExpiresAt   string `json:"expires_at"`   // Certificate expiration timestamp (RFC3339)
 }
 
@@ -55,13 +93,50 @@ func NewManager(cfg *config.Config, logger *log.Logger) (*Manager, error) {
 		return nil, fmt.Errorf("failed to create cert directory: %w", err)
 	}
 
-	return &Manager{
-		cfg:      cfg,
+	proxies, err := proxy.New(cfg.Proxy, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure proxy: %w", err)
+	}
+
+	keys, err := newKeyProvider(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key provider: %w", err)
+	}
+
+	m := &Manager{
+		cfg:         cfg,
+		logger:      logger,
+		certPath:    cfg.TLSConfig.CertFile,
+		keyPath:     cfg.TLSConfig.KeyFile,
+		caPath:      cfg.TLSConfig.CAFile,
+		keys:        keys,
+		proxy:       proxies,
+		subscribers: make(map[int]func(Change)),
+	}
+	m.creds = &credentials{
+		certPath: m.certPath,
+		keyPath:  m.keyPath,
+		caPath:   m.caPath,
+		keyPair:  m.keyPair,
 		logger:   logger,
-		certPath: cfg.TLSConfig.CertFile,
-		keyPath:  cfg.TLSConfig.KeyFile,
-		caPath:   cfg.TLSConfig.CAFile,
-	}, nil
+	}
+	m.transport = m.newTransport()
+
+	// Finish or discard a certificate rotation cut short by a restart
+	m.recoverPendingRotation()
+
+	return m, nil
+}
+
+// Close releases the key provider
+func (m *Manager) Close() error {
+	m.transport.CloseIdleConnections()
+	return m.keys.Close()
+}
+
+// SetAuditLogger enables audit events for auth failures and certificate rotation
+func (m *Manager) SetAuditLogger(audit *logging.AuditLogger) {
+	m.audit = audit
 }
 
 // HasIdentity checks if the agent has been bootstrapped
@@ -93,25 +168,14 @@ func (m *Manager) NeedsRebootstrap() bool {
 		return true
 	}
 
-	// Check certificate expiration
-	certPEM, err := os.ReadFile(m.certPath)
-	if err != nil {
-		return true
-	}
-
-	cert, err := tls.X509KeyPair(certPEM, nil)
-	if err != nil {
-		return true
-	}
-
-	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	// Only an expired certificate needs a new identity; one that is merely
+	// close to expiry is renewed in place by StartRenewal
+	cert, err := m.loadCertificate()
 	if err != nil {
 		return true
 	}
-
-	// Check if cert expires within 24 hours
-	if time.Until(x509Cert.NotAfter) < 24*time.Hour {
-		m.logger.Printf("Certificate expires soon: %v", x509Cert.NotAfter)
+	if time.Now().After(cert.NotAfter) {
+		m.logger.Printf("Certificate expired: %v", cert.NotAfter)
 		return true
 	}
 
@@ -131,29 +195,26 @@ func RunBootstrap(ctx context.Context, cfg *config.Config) (*config.Config, erro
 	if err != nil {
 		return nil, fmt.Errorf("failed to create identity manager: %w", err)
 	}
+	defer manager.Close()
 
-	// Perform bootstrap with retry
-	var resp *BootstrapResponse
-	retryConfig := DefaultRetryConfig()
-	err = RetryWithBackoff(ctx, retryConfig, func() error {
-		var retryErr error
-		resp, retryErr = manager.callBootstrapAPI(ctx, BootstrapRequest{
-			OrgID:        cfg.OrgID,
-			InstallToken: cfg.InstallToken,
-			Hostname:     getHostname(),
-			OS:           getOS(),
-			Arch:         getArch(),
-			AgentVersion: "1.0.0",
-		})
-		return retryErr
-	})
-	if err != nil {
-		return nil, fmt.Errorf("bootstrap failed after retries: %w", err)
+	// Audit the bootstrap server trust and the outcome
+	if cfg.AuditLogFile != "" {
+		audit, err := logging.NewAuditLogger(cfg.AuditLogFile, "")
+		if err != nil {
+			logger.Printf("Warning: bootstrap will not be audited: %v", err)
+		} else {
+			defer audit.Close()
+			manager.SetAuditLogger(audit)
+		}
 	}
 
-	// Save certificates
-	if err := manager.saveCertificates(resp); err != nil {
-		return nil, fmt.Errorf("failed to save certificates: %w", err)
+	// Perform bootstrap with retry and save the certificates
+	resp, err := manager.register(ctx, cfg.InstallToken)
+	if manager.audit != nil {
+		manager.audit.LogBootstrap(err == nil, cfg.OrgID, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap failed: %w", err)
 	}
 
 	// Mark config as bootstrapped and populate runtime fields
@@ -170,40 +231,18 @@ func (m *Manager) Bootstrap(ctx context.Context) error {
 		return fmt.Errorf("install_token is required for bootstrap")
 	}
 
-	hostname := getHostname()
-
-	req := BootstrapRequest{
-		OrgID:        m.cfg.OrgID,
-		InstallToken: m.cfg.InstallToken,
-		Hostname:     hostname,
-		OS:           getOS(),
-		Arch:         getArch(),
-		AgentVersion: "1.0.0",
-	}
-
 	m.logger.Printf("Bootstrapping agent for org %s...", m.cfg.OrgID)
 
-	// Call bootstrap API with retry
-	var resp *BootstrapResponse
-	retryConfig := DefaultRetryConfig()
-	err := RetryWithBackoff(ctx, retryConfig, func() error {
-		var retryErr error
-		resp, retryErr = m.callBootstrapAPI(ctx, req)
-		return retryErr
-	})
+	// Call bootstrap API with retry and save the certificates
+	resp, err := m.register(ctx, m.cfg.InstallToken)
 	if err != nil {
-		return fmt.Errorf("bootstrap API call failed: %w", err)
+		return fmt.Errorf("bootstrap failed: %w", err)
 	}
 
 	// Save agent ID to config
-	m.agentID = resp.AgentID
+	m.setAgentID(resp.AgentID)
 	m.cfg.MarkBootstrapped(resp.AgentID, resp.APIBaseURL)
 
-	// Save certificates
-	if err := m.saveCertificates(resp); err != nil {
-		return fmt.Errorf("failed to save certificates: %w", err)
-	}
-
 	// Update config file
 	configPath := getConfigPath()
 	if err := m.cfg.Save(configPath); err != nil {
@@ -214,13 +253,103 @@ func (m *Manager) Bootstrap(ctx context.Context) error {
 	return nil
 }
 
-// callBootstrapAPI sends the bootstrap request to the server
-func (m *Manager) callBootstrapAPI(ctx context.Context, req BootstrapRequest) (*BootstrapResponse, error) {
-	// Use hardcoded bootstrap endpoint (not from config, as config might not have it yet)
-	bootstrapURL := "https://api.unitechio.space/api/v1/agents/bootstrap"
-	if envURL := os.Getenv("BOOTSTRAP_URL"); envURL != "" {
-		bootstrapURL = envURL
+// register generates a key pair with the key provider, has the backend issue
+// a certificate for it and saves the new identity. The private key never
+// leaves this host.
+func (m *Manager) register(ctx context.Context, installToken string) (*BootstrapResponse, error) {
+	m.rotateMu.Lock()
+	defer m.rotateMu.Unlock()
+
+	key, keyRef, err := m.keys.Generate(m.cfg.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	registered := false
+	defer func() {
+		if !registered {
+			m.keys.Delete(keyRef)
+		}
+	}()
+
+	csr, err := createCSR(key, "")
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := hostFingerprint()
+	req := newBootstrapRequest(m.cfg.OrgID, installToken, csr)
+	req.HostFingerprint = fingerprint.Hash()
+
+	// Decide once which servers may receive the install token
+	trust, err := m.bootstrapServerTrust()
+	if err != nil {
+		return nil, err
+	}
+	m.logger.Printf("Bootstrap server trust: %s (%s)", trust.mode(), trust.source)
+	if m.audit != nil {
+		m.audit.LogBootstrapTrust(m.bootstrapURL(), trust.mode(), trust.source)
+	}
+	client := trust.client(m.proxy.Proxy)
+
+	var resp *BootstrapResponse
+	err = retry.Do(ctx, m.bootstrapRetryConfig(), func(ctx context.Context) error {
+		var retryErr error
+		resp, retryErr = m.callBootstrapAPI(ctx, client, req)
+		return retryErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.checkIssued([]byte(resp.Certificate), []byte(resp.CACert), key.Public(), resp.AgentID); err != nil {
+		return nil, err
+	}
+
+	if err := m.saveCertificates(resp, keyRef); err != nil {
+		return nil, fmt.Errorf("failed to save certificates: %w", err)
+	}
+	registered = true
+
+	// Later checks compare against the host that registered
+	if err := m.recordFingerprint(fingerprint); err != nil {
+		m.logger.Printf("Warning: %v", err)
+	}
+	return resp, nil
+}
+
+// newBootstrapRequest describes this host for registration
+func newBootstrapRequest(orgID, installToken string, csr []byte) BootstrapRequest {
+	return BootstrapRequest{
+		OrgID:        orgID,
+		InstallToken: installToken,
+		Hostname:     getHostname(),
+		OS:           getOS(),
+		Arch:         getArch(),
+		AgentVersion: "1.0.0",
+		CSR:          string(csr),
+	}
+}
+
+// bootstrapRetryConfig retries bootstrap patiently, since the agent cannot
+// run without an identity, but gives up at once on a rejected request
+func (m *Manager) bootstrapRetryConfig() retry.Config {
+	return retry.Config{
+		InitialDelay: 5 * time.Second,
+		MaxDelay:     5 * time.Minute,
+		MaxAttempts:  10,
+		Multiplier:   2.0,
+		Jitter:       true,
+		OnAttempt: func(a retry.Attempt) {
+			if a.Err != nil && a.Retryable {
+				m.logger.Printf("Bootstrap attempt %d failed, retrying in %v: %v", a.Number, a.Delay.Round(time.Second), a.Err)
+			}
+		},
 	}
+}
+
+// callBootstrapAPI sends the bootstrap request to the server
+func (m *Manager) callBootstrapAPI(ctx context.Context, client *http.Client, req BootstrapRequest) (*BootstrapResponse, error) {
+	bootstrapURL := m.bootstrapURL()
 
 	body, err := json.Marshal(req)
 	if err != nil {
@@ -233,22 +362,25 @@ func (m *Manager) callBootstrapAPI(ctx context.Context, req BootstrapRequest) (*
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	// Use standard HTTPS (no mTLS yet, as we don't have certs)
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
 	m.logger.Printf("Calling bootstrap API: %s", bootstrapURL)
 
+	// Standard HTTPS (no mTLS yet, as we don't have certs)
 	httpResp, err := client.Do(httpReq)
+	if errors.Is(err, ErrPinMismatch) {
+		return nil, retry.Permanent(fmt.Errorf("HTTP request failed: %w", err))
+	}
 	if err != nil {
 		return nil, fmt.Errorf("HTTP request failed: %w", err)
 	}
 	defer httpResp.Body.Close()
 
 	if httpResp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(httpResp.Body)
-		return nil, fmt.Errorf("bootstrap failed with status %d: %s", httpResp.StatusCode, string(bodyBytes))
+		// 4xx (e.g. a revoked or invalid install token) fails fast; 429 and 5xx are retried
+		status := retry.NewStatusError(httpResp)
+		if err := tokenError(status); err != nil {
+			return nil, fmt.Errorf("bootstrap rejected: %w (%w)", err, status)
+		}
+		return nil, fmt.Errorf("bootstrap rejected: %w", status)
 	}
 
 	var resp BootstrapResponse
@@ -258,29 +390,64 @@ func (m *Manager) callBootstrapAPI(ctx context.Context, req BootstrapRequest) (*
 
 	// If server doesn't provide APIBaseURL, use the bootstrap URL's base
 	if resp.APIBaseURL == "" {
-		resp.APIBaseURL = "https://api.unitechio.space"
+		resp.APIBaseURL = defaultAPIBaseURL
+		if u, err := url.Parse(bootstrapURL); err == nil && u.Host != "" {
+			resp.APIBaseURL = (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+		}
 	}
 
 	return &resp, nil
 }
 
-// saveCertificates writes certificates to disk with proper permissions
-func (m *Manager) saveCertificates(resp *BootstrapResponse) error {
-	// Save certificate
-	if err := os.WriteFile(m.certPath, []byte(resp.Certificate), 0600); err != nil {
-		return fmt.Errorf("failed to write certificate: %w", err)
+// bootstrapURL returns the configured bootstrap endpoint, then BOOTSTRAP_URL,
+// then the production endpoint
+func (m *Manager) bootstrapURL() string {
+	if m.cfg.BootstrapURL != "" {
+		return m.cfg.BootstrapURL
+	}
+	if envURL := os.Getenv("BOOTSTRAP_URL"); envURL != "" {
+		return envURL
+	}
+	return defaultAPIBaseURL + "/api/v1/agents/bootstrap"
+}
+
+// tokenError recognizes a rejected install token in a bootstrap response,
+// from its "error" code or a 409 (used) or 410 (expired) status
+func tokenError(status *retry.StatusError) error {
+	var body struct {
+		Error string `json:"error"`
 	}
+	json.Unmarshal([]byte(status.Body), &body)
 
-	// Save private key (most sensitive, 0600 permissions)
-	if err := os.WriteFile(m.keyPath, []byte(resp.PrivateKey), 0600); err != nil {
-		return fmt.Errorf("failed to write private key: %w", err)
+	switch {
+	case body.Error == "token_used" || status.StatusCode == http.StatusConflict:
+		return ErrTokenUsed
+	case body.Error == "token_expired" || status.StatusCode == http.StatusGone:
+		return ErrTokenExpired
 	}
+	return nil
+}
 
+// saveCertificates writes the issued certificates and the key (or, with a
+// hardware key provider, its reference) to disk with proper permissions
+func (m *Manager) saveCertificates(resp *BootstrapResponse, keyRef []byte) error {
 	// Save CA certificate
-	if err := os.WriteFile(m.caPath, []byte(resp.CACert), 0644); err != nil {
+	if err := writeFileAtomic(m.caPath, []byte(resp.CACert), 0644); err != nil {
 		return fmt.Errorf("failed to write CA certificate: %w", err)
 	}
 
+	// Save certificate and private key (most sensitive, 0600 permissions)
+	if err := m.installCertificate([]byte(resp.Certificate), keyRef); err != nil {
+		return err
+	}
+
+	// Save the initial policy; the policy engine verifies it before use
+	if resp.Policy != "" {
+		if err := os.WriteFile(m.bootstrapPolicyPath(), []byte(resp.Policy), 0600); err != nil {
+			return fmt.Errorf("failed to write bootstrap policy: %w", err)
+		}
+	}
+
 	m.logger.Println("Certificates saved successfully")
 	return nil
 }
@@ -293,45 +460,51 @@ func (m *Manager) VerifyIdentity() error {
 		return fmt.Errorf("failed to read certificate: %w", err)
 	}
 
-	// Load private key
-	keyPEM, err := os.ReadFile(m.keyPath)
+	// Load private key (or its reference)
+	keyRef, err := os.ReadFile(m.keyPath)
 	if err != nil {
 		return fmt.Errorf("failed to read private key: %w", err)
 	}
 
-	// Parse certificate and key
-	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	// Parse certificate and check it matches the key
+	cert, err := m.keyPair(certPEM, keyRef)
 	if err != nil {
 		return fmt.Errorf("failed to parse certificate/key: %w", err)
 	}
-
-	// Parse X.509 certificate to extract agent ID
-	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
-	if err != nil {
-		return fmt.Errorf("failed to parse X.509 certificate: %w", err)
-	}
+	x509Cert := cert.Leaf
 
 	// Extract agent ID from certificate Common Name
-	m.agentID = x509Cert.Subject.CommonName
-	m.logger.Printf("Identity verified: Agent ID = %s", m.agentID)
+	m.setAgentID(x509Cert.Subject.CommonName)
+	m.logger.Printf("Identity verified: Agent ID = %s", x509Cert.Subject.CommonName)
 
 	return nil
 }
 
 // GetAgentID returns the agent's unique identifier
 func (m *Manager) GetAgentID() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return m.agentID
 }
 
-// GetTLSConfig returns a TLS configuration for mTLS
-func (m *Manager) GetTLSConfig() (*tls.Config, error) {
-	// Load client certificate and key
-	cert, err := tls.LoadX509KeyPair(m.certPath, m.keyPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load certificate/key: %w", err)
-	}
+func (m *Manager) setAgentID(agentID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.agentID = agentID
+}
+
+// BootstrapPolicy returns the signed policy document received at bootstrap
+func (m *Manager) BootstrapPolicy() ([]byte, error) {
+	return os.ReadFile(m.bootstrapPolicyPath())
+}
+
+// bootstrapPolicyPath stores the initial policy alongside the CA certificate
+func (m *Manager) bootstrapPolicyPath() string {
+	return filepath.Join(filepath.Dir(m.caPath), "bootstrap_policy.json")
+}
 
-	// Load CA certificate
+// CACertPool returns a pool containing the org CA certificate
+func (m *Manager) CACertPool() (*x509.CertPool, error) {
 	caCert, err := os.ReadFile(m.caPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
@@ -342,26 +515,52 @@ func (m *Manager) GetTLSConfig() (*tls.Config, error) {
 		return nil, fmt.Errorf("failed to parse CA certificate")
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
-		MinVersion:   tls.VersionTLS12,
-	}, nil
+	return caCertPool, nil
 }
 
-// GetHTTPClient returns an HTTP client configured for mTLS
-func (m *Manager) GetHTTPClient() (*http.Client, error) {
-	tlsConfig, err := m.GetTLSConfig()
+// bufferKeyLabel separates the buffer key from other keys derived from the agent key
+const bufferKeyLabel = "unitechio-agent buffer key v1"
+
+// BufferKey derives the key that protects the offline telemetry buffer from
+// the agent's private key. It changes whenever the identity is re-issued.
+func (m *Manager) BufferKey() ([]byte, error) {
+	keyRef, err := os.ReadFile(m.keyPath)
 	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	return m.keys.DeriveKey(keyRef, bufferKeyLabel)
+}
+
+// GetTLSConfig returns a TLS configuration for mTLS. It picks up renewed
+// certificates and CA changes on each handshake.
+func (m *Manager) GetTLSConfig() (*tls.Config, error) {
+	if _, err := m.creds.clientCertificate(); err != nil {
+		return nil, err
+	}
+	if _, err := m.creds.rootCAs(); err != nil {
 		return nil, err
 	}
+	return m.tlsConfig(), nil
+}
 
-	return &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
-		Timeout: 30 * 1000000000, // 30 seconds
-	}, nil
+// GetHTTPClient returns the shared HTTP client configured for mTLS. The
+// client keeps working across certificate renewals, and 401/403 responses
+// through it trigger renewal (see auth.go).
+func (m *Manager) GetHTTPClient() (*http.Client, error) {
+	// Fail early rather than on the first request if there is no identity
+	if _, err := m.creds.clientCertificate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client == nil {
+		m.client = &http.Client{
+			Transport: &authTransport{manager: m},
+			Timeout:   30 * time.Second,
+		}
+	}
+	return m.client, nil
 }
 
 // Helper functions
@@ -0,0 +1,148 @@
+package identity
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/unitechio/agent/internal/config"
+)
+
+func TestRegisterGeneratesKeyLocally(t *testing.T) {
+	for _, algorithm := range []string{KeyAlgorithmECDSAP256, KeyAlgorithmEd25519} {
+		t.Run(algorithm, func(t *testing.T) {
+			ca := newTestCA(t)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if strings.Contains(string(body), "PRIVATE KEY") {
+					t.Error("Bootstrap request carries a private key")
+				}
+
+				var req BootstrapRequest
+				json.Unmarshal(body, &req)
+				block, _ := pem.Decode([]byte(req.CSR))
+				if block == nil {
+					http.Error(w, "no CSR", http.StatusBadRequest)
+					return
+				}
+				csr, err := x509.ParseCertificateRequest(block.Bytes)
+				if err != nil || csr.CheckSignature() != nil {
+					http.Error(w, "bad CSR", http.StatusBadRequest)
+					return
+				}
+
+				json.NewEncoder(w).Encode(BootstrapResponse{
+					AgentID:     testAgentID,
+					APIBaseURL:  "https://api.example.test",
+					Certificate: string(ca.issueAgent(t, testAgentID, csr.PublicKey)),
+					CACert:      string(ca.pem),
+				})
+			}))
+			defer server.Close()
+			t.Setenv("BOOTSTRAP_URL", server.URL)
+
+			dir := t.TempDir()
+			cfg := &config.Config{
+				OrgID:        "test-org",
+				KeyAlgorithm: algorithm,
+				TLSConfig: config.TLSConfig{
+					CertFile: filepath.Join(dir, "agent.crt"),
+					KeyFile:  filepath.Join(dir, "agent.key"),
+					CAFile:   filepath.Join(dir, "ca.crt"),
+				},
+			}
+			m, err := NewManager(cfg, log.New(io.Discard, "", 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := m.register(context.Background(), "test-token"); err != nil {
+				t.Fatalf("register failed: %v", err)
+			}
+			if err := m.VerifyIdentity(); err != nil {
+				t.Fatalf("Bootstrapped identity does not verify: %v", err)
+			}
+
+			keyPEM, _ := os.ReadFile(m.keyPath)
+			block, _ := pem.Decode(keyPEM)
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ok bool
+			switch algorithm {
+			case KeyAlgorithmECDSAP256:
+				_, ok = key.(*ecdsa.PrivateKey)
+			case KeyAlgorithmEd25519:
+				_, ok = key.(ed25519.PrivateKey)
+			}
+			if !ok {
+				t.Errorf("Expected a %s key, got %T", algorithm, key)
+			}
+		})
+	}
+}
+
+func TestRegisterReportsRejectedToken(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		body   string
+		err    error
+	}{
+		"expired":   {http.StatusGone, `{"error":"token_expired"}`, ErrTokenExpired},
+		"used":      {http.StatusUnauthorized, `{"error":"token_used"}`, ErrTokenUsed},
+		"conflict":  {http.StatusConflict, "", ErrTokenUsed},
+		"forbidden": {http.StatusForbidden, "invalid token", nil},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				http.Error(w, tt.body, tt.status)
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			cfg := &config.Config{
+				OrgID:        "test-org",
+				BootstrapURL: server.URL,
+				TLSConfig: config.TLSConfig{
+					CertFile: filepath.Join(dir, "agent.crt"),
+					KeyFile:  filepath.Join(dir, "agent.key"),
+					CAFile:   filepath.Join(dir, "ca.crt"),
+				},
+			}
+			m, err := NewManager(cfg, log.New(io.Discard, "", 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = m.register(context.Background(), "test-token")
+			if err == nil {
+				t.Fatal("Expected register to fail")
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+			if tt.err == nil && (errors.Is(err, ErrTokenExpired) || errors.Is(err, ErrTokenUsed)) {
+				t.Errorf("Unexpected token error: %v", err)
+			}
+			if calls != 1 {
+				t.Errorf("Expected a rejected token not to be retried, got %d calls", calls)
+			}
+		})
+	}
+}
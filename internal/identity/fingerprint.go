@@ -0,0 +1,434 @@
+package identity
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jaypipes/ghw"
+)
+
+// Host fingerprint
+//
+// Copying the cert directory and config.json to another machine would let
+// it impersonate this agent. At bootstrap the manager records a fingerprint
+// of the host (machine ID, DMI product UUID, physical MACs and the boot disk
+// serial) next to the CA certificate, signed with the agent key, and sends
+// its hash to the backend. On
+// every start and heartbeat the host is fingerprinted again; a drift is
+// audited, reported in heartbeats and handled as the policy's
+// identity.on_fingerprint_drift says.
+
+// Reactions to a fingerprint drift
+const (
+	DriftReport      = "report"      // audit and report, keep running
+	DriftRefuse      = "refuse"      // stop the agent
+	DriftRebootstrap = "rebootstrap" // register as a new agent with the install token
+)
+
+// ErrHostMismatch is returned when the agent refuses to run on a different host
+var ErrHostMismatch = errors.New("host fingerprint does not match the bootstrapped host")
+
+// ErrUnverifiedFingerprint is returned when the recorded host fingerprint
+// was not signed with the agent key
+var ErrUnverifiedFingerprint = errors.New("host fingerprint is not signed by the agent key")
+
+// driftNoRecord is reported instead of component names when there is no
+// valid recorded fingerprint to compare with
+const driftNoRecord = "recorded_fingerprint"
+
+// Fingerprint identifies the hardware an agent was bootstrapped on. Empty
+// components could not be read (e.g. DMI without root) and are not compared.
+type Fingerprint struct {
+	MachineID   string   `json:"machine_id,omitempty"`
+	ProductUUID string   `json:"product_uuid,omitempty"`
+	MACs        []string `json:"macs,omitempty"` // sorted
+	DiskSerial  string   `json:"disk_serial,omitempty"`
+}
+
+// Hash summarizes the fingerprint for the backend without revealing its components
+func (f Fingerprint) Hash() string {
+	h := sha256.New()
+	for _, part := range []string{f.MachineID, f.ProductUUID, strings.Join(f.MACs, ","), f.DiskSerial} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Drift lists the fingerprint components that changed since bootstrap
+type Drift struct {
+	Changed  []string `json:"changed"`
+	Recorded string   `json:"recorded"` // hash recorded at bootstrap
+	Current  string   `json:"current"`
+}
+
+// compare returns the components of current that differ from f. MACs only
+// count as changed when none of the recorded ones is left, so replacing one
+// network card is not mistaken for a clone.
+func (f Fingerprint) compare(current Fingerprint) []string {
+	var changed []string
+	differs := func(recorded, now string) bool {
+		return recorded != "" && now != "" && recorded != now
+	}
+
+	if differs(f.MachineID, current.MachineID) {
+		changed = append(changed, "machine_id")
+	}
+	if differs(f.ProductUUID, current.ProductUUID) {
+		changed = append(changed, "product_uuid")
+	}
+	if len(f.MACs) > 0 && len(current.MACs) > 0 && !overlaps(f.MACs, current.MACs) {
+		changed = append(changed, "macs")
+	}
+	if differs(f.DiskSerial, current.DiskSerial) {
+		changed = append(changed, "disk_serial")
+	}
+	return changed
+}
+
+func overlaps(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostFingerprint reads the fingerprint of this host
+func hostFingerprint() Fingerprint {
+	f := Fingerprint{MachineID: machineID()}
+
+	if product, err := ghw.Product(ghw.WithDisableWarnings()); err == nil {
+		f.ProductUUID = known(product.UUID)
+	}
+
+	if network, err := ghw.Network(ghw.WithDisableWarnings()); err == nil {
+		for _, nic := range network.NICs {
+			if nic.IsVirtual || nic.MACAddress == "" {
+				continue
+			}
+			f.MACs = append(f.MACs, strings.ToLower(nic.MACAddress))
+		}
+		sort.Strings(f.MACs)
+	}
+
+	if block, err := ghw.Block(ghw.WithDisableWarnings()); err == nil {
+		f.DiskSerial = bootDiskSerial(block.Disks)
+	}
+
+	return f
+}
+
+// bootDiskSerial returns the serial of the disk holding the root (or C:)
+// file system, falling back to the first fixed disk
+func bootDiskSerial(disks []*ghw.Disk) string {
+	var fallback string
+	for _, disk := range disks {
+		serial := known(disk.SerialNumber)
+		if serial == "" || disk.IsRemovable {
+			continue
+		}
+		for _, part := range disk.Partitions {
+			switch strings.TrimRight(strings.ToUpper(part.MountPoint), `\`) {
+			case "/", "C:":
+				return serial
+			}
+		}
+		if fallback == "" {
+			fallback = serial
+		}
+	}
+	return fallback
+}
+
+// known drops the placeholder ghw uses for unreadable values
+func known(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(value, "unknown") {
+		return ""
+	}
+	return value
+}
+
+// fingerprintPath stores the recorded fingerprint alongside the CA certificate
+func (m *Manager) fingerprintPath() string {
+	return filepath.Join(filepath.Dir(m.caPath), "host_fingerprint.json")
+}
+
+// fingerprintMigrationPath is the marker package upgrades leave for agents
+// bootstrapped before fingerprinting
+func (m *Manager) fingerprintMigrationPath() string {
+	return filepath.Join(filepath.Dir(m.caPath), "host_fingerprint.migrate")
+}
+
+// fingerprintKeyLabel separates the fingerprint key from other keys derived from the agent key
+const fingerprintKeyLabel = "unitechio-agent host fingerprint v1"
+
+// fingerprintRecord is the saved fingerprint, bound to the agent key by an
+// HMAC so it cannot be edited or swapped in without that key
+type fingerprintRecord struct {
+	Fingerprint Fingerprint `json:"fingerprint"`
+	MAC         string      `json:"mac"`
+}
+
+// fingerprintMAC authenticates f under the key keyRef refers to
+func (m *Manager) fingerprintMAC(f Fingerprint, keyRef []byte) ([]byte, error) {
+	key, err := m.keys.DeriveKey(keyRef, fingerprintKeyLabel)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal host fingerprint: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// recordFingerprint saves this host's fingerprint as the reference for later checks
+func (m *Manager) recordFingerprint(f Fingerprint) error {
+	m.mu.Lock()
+	m.fingerprint = f
+	m.mu.Unlock()
+	return m.writeFingerprint(f)
+}
+
+// writeFingerprint saves a fingerprint signed with the current agent key
+func (m *Manager) writeFingerprint(f Fingerprint) error {
+	keyRef, err := os.ReadFile(m.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read private key: %w", err)
+	}
+	mac, err := m.fingerprintMAC(f, keyRef)
+	if err != nil {
+		return fmt.Errorf("failed to sign host fingerprint: %w", err)
+	}
+
+	data, err := json.MarshalIndent(fingerprintRecord{Fingerprint: f, MAC: hex.EncodeToString(mac)}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal host fingerprint: %w", err)
+	}
+	if err := writeFileAtomic(m.fingerprintPath(), data, 0600); err != nil {
+		return fmt.Errorf("failed to write host fingerprint: %w", err)
+	}
+	return nil
+}
+
+// readFingerprint returns the recorded fingerprint if it was signed with
+// one of keyRefs, and which of them signed it. A missing record returns an
+// error matching os.ErrNotExist, one no key signed ErrUnverifiedFingerprint.
+func (m *Manager) readFingerprint(keyRefs ...[]byte) (Fingerprint, int, error) {
+	data, err := os.ReadFile(m.fingerprintPath())
+	if err != nil {
+		return Fingerprint{}, 0, fmt.Errorf("failed to read host fingerprint: %w", err)
+	}
+
+	var record fingerprintRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return Fingerprint{}, 0, fmt.Errorf("%w: %v", ErrUnverifiedFingerprint, err)
+	}
+	mac, err := hex.DecodeString(record.MAC)
+	if err != nil || len(mac) == 0 {
+		return Fingerprint{}, 0, ErrUnverifiedFingerprint
+	}
+
+	for i, keyRef := range keyRefs {
+		expected, err := m.fingerprintMAC(record.Fingerprint, keyRef)
+		if err != nil {
+			continue
+		}
+		if hmac.Equal(mac, expected) {
+			return record.Fingerprint, i, nil
+		}
+	}
+	return Fingerprint{}, 0, ErrUnverifiedFingerprint
+}
+
+// fingerprintKeys returns the current key and, if one is kept, the key it
+// replaced, which signed the record until a rotation re-signs it
+func (m *Manager) fingerprintKeys() ([][]byte, error) {
+	current, err := os.ReadFile(m.keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	keyRefs := [][]byte{current}
+	if retired, err := os.ReadFile(m.keyPath + retiredSuffix); err == nil {
+		keyRefs = append(keyRefs, retired)
+	}
+	return keyRefs, nil
+}
+
+// HostFingerprint returns the hash of this host's fingerprint
+func (m *Manager) HostFingerprint() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.fingerprint.Hash()
+}
+
+// CheckFingerprint compares this host with the one the agent was
+// bootstrapped on and returns the drift, or nil if it is the same host.
+// A missing record, or one not signed with the agent key, is a drift too:
+// bootstrap always records one, so only a copy would lack it. Agents
+// bootstrapped before fingerprinting record the current host once, when a
+// package upgrade left the migration marker. A new drift is written to the
+// audit log once.
+func (m *Manager) CheckFingerprint() (*Drift, error) {
+	keyRefs, err := m.fingerprintKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	current := hostFingerprint()
+	recorded, signer, err := m.readFingerprint(keyRefs...)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if m.migrateFingerprint(current) {
+			return nil, nil
+		}
+		return m.reportUnrecorded(current), nil
+	case errors.Is(err, ErrUnverifiedFingerprint):
+		m.logger.Printf("Warning: %v", err)
+		return m.reportUnrecorded(current), nil
+	case err != nil:
+		return nil, err
+	}
+
+	// A rotation stopped before re-signing the record with the new key
+	if signer > 0 {
+		if err := m.writeFingerprint(recorded); err != nil {
+			m.logger.Printf("Warning: %v", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.fingerprint = current
+	m.mu.Unlock()
+
+	changed := recorded.compare(current)
+	if len(changed) == 0 {
+		m.setDrift(nil)
+		return nil, nil
+	}
+
+	return m.reportDrift(&Drift{Changed: changed, Recorded: recorded.Hash(), Current: current.Hash()}), nil
+}
+
+// migrateFingerprint records the current host if a package upgrade marked
+// this agent as bootstrapped before fingerprinting. The marker is used once.
+func (m *Manager) migrateFingerprint(current Fingerprint) bool {
+	marker := m.fingerprintMigrationPath()
+	if _, err := os.Stat(marker); err != nil {
+		return false
+	}
+
+	m.logger.Println("No host fingerprint recorded, recording this host as marked by the upgrade")
+	if err := m.recordFingerprint(current); err != nil {
+		m.logger.Printf("Warning: %v", err)
+		return false
+	}
+	if err := os.Remove(marker); err != nil {
+		m.logger.Printf("Warning: failed to remove host fingerprint migration marker: %v", err)
+	}
+	return true
+}
+
+// reportUnrecorded reports a host without a valid recorded fingerprint
+func (m *Manager) reportUnrecorded(current Fingerprint) *Drift {
+	m.mu.Lock()
+	m.fingerprint = current
+	m.mu.Unlock()
+	return m.reportDrift(&Drift{Changed: []string{driftNoRecord}, Current: current.Hash()})
+}
+
+// reportDrift stores a drift and logs and audits it if it is new
+func (m *Manager) reportDrift(drift *Drift) *Drift {
+	changed := drift.Changed
+	if m.setDrift(drift) {
+		m.logger.Printf("Warning: host fingerprint changed since bootstrap (%s)", strings.Join(changed, ", "))
+		if m.audit != nil {
+			m.audit.LogFingerprintDrift(changed, drift.Recorded, drift.Current)
+		}
+	}
+	return drift
+}
+
+// setDrift stores the latest drift and reports whether it is new
+func (m *Manager) setDrift(drift *Drift) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changed := func(d *Drift) string {
+		if d == nil {
+			return ""
+		}
+		return d.Current
+	}
+	isNew := changed(drift) != changed(m.drift)
+	m.drift = drift
+	return isNew && drift != nil
+}
+
+// FingerprintDrift returns the drift found by the last check, if any
+func (m *Manager) FingerprintDrift() *Drift {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.drift
+}
+
+// HandleDrift applies the policy's reaction to a drift: report does nothing
+// more, refuse returns ErrHostMismatch and rebootstrap registers this host
+// as a new agent. Install tokens are single-use and cleared after bootstrap,
+// so when no usable token is left, rebootstrap falls back to report: the
+// fallback is audited once and the drift stays reported in heartbeats.
+func (m *Manager) HandleDrift(ctx context.Context, drift *Drift, reaction string) error {
+	if drift == nil {
+		return nil
+	}
+
+	switch reaction {
+	case DriftRefuse:
+		return fmt.Errorf("%w (%s changed)", ErrHostMismatch, strings.Join(drift.Changed, ", "))
+	case DriftRebootstrap:
+		m.mu.RLock()
+		noReenroll := m.noReenroll
+		m.mu.RUnlock()
+		if noReenroll {
+			return nil
+		}
+
+		m.logger.Println("Host changed, re-bootstrapping agent...")
+		resp, err := m.rebootstrap(ctx)
+		if err == nil {
+			m.setDrift(nil)
+			return m.activate(Change{Reason: ChangeRebootstrapped, APIBaseURL: resp.APIBaseURL})
+		}
+		m.auditRotation(false, err)
+
+		if !errors.Is(err, ErrNoInstallToken) && !errors.Is(err, ErrTokenUsed) && !errors.Is(err, ErrTokenExpired) {
+			return fmt.Errorf("re-bootstrap failed: %w", err)
+		}
+		m.mu.Lock()
+		m.noReenroll = true
+		m.mu.Unlock()
+		m.logger.Printf("Warning: cannot re-bootstrap after host change (%v), reporting the drift instead; enroll the agent again to register this host", err)
+		if m.audit != nil {
+			m.audit.LogDriftReaction(DriftRebootstrap, DriftReport, err)
+		}
+		return nil
+	default:
+		return nil
+	}
+}
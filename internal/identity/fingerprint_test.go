@@ -0,0 +1,188 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/unitechio/agent/internal/logging"
+)
+
+func TestFingerprintCompare(t *testing.T) {
+	recorded := Fingerprint{
+		MachineID:   "4c4c4544-0042",
+		ProductUUID: "b1c2d3e4",
+		MACs:        []string{"00:1a:2b:3c:4d:5e", "00:1a:2b:3c:4d:5f"},
+		DiskSerial:  "S3Z9NX0K",
+	}
+
+	tests := []struct {
+		name    string
+		current Fingerprint
+		changed []string
+	}{
+		{"same host", recorded, nil},
+		{"one NIC replaced", Fingerprint{
+			MachineID:   recorded.MachineID,
+			ProductUUID: recorded.ProductUUID,
+			MACs:        []string{"00:1a:2b:3c:4d:5e", "00:aa:bb:cc:dd:ee"},
+			DiskSerial:  recorded.DiskSerial,
+		}, nil},
+		{"DMI unreadable", Fingerprint{
+			MachineID:  recorded.MachineID,
+			MACs:       recorded.MACs,
+			DiskSerial: recorded.DiskSerial,
+		}, nil},
+		{"cloned VM", Fingerprint{
+			MachineID:   recorded.MachineID,
+			ProductUUID: "f9e8d7c6",
+			MACs:        []string{"52:54:00:12:34:56"},
+			DiskSerial:  recorded.DiskSerial,
+		}, []string{"product_uuid", "macs"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if changed := recorded.compare(tt.current); !reflect.DeepEqual(changed, tt.changed) {
+				t.Errorf("Expected %v changed, got %v", tt.changed, changed)
+			}
+		})
+	}
+}
+
+func TestCheckFingerprintRecordsHost(t *testing.T) {
+	m := newTestManager(t, newTestCA(t), "")
+	if err := m.recordFingerprint(hostFingerprint()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		drift, err := m.CheckFingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drift != nil {
+			t.Fatalf("Unexpected drift on the same host: %+v", drift)
+		}
+	}
+
+	drift := &Drift{Changed: []string{"machine_id"}}
+	if err := m.HandleDrift(context.Background(), drift, DriftReport); err != nil {
+		t.Errorf("Expected report to keep running, got %v", err)
+	}
+	if err := m.HandleDrift(context.Background(), drift, DriftRefuse); !errors.Is(err, ErrHostMismatch) {
+		t.Errorf("Expected ErrHostMismatch, got %v", err)
+	}
+}
+
+func TestCheckFingerprintMissingRecord(t *testing.T) {
+	m := newTestManager(t, newTestCA(t), "")
+
+	// Bootstrap always records a fingerprint; only a copy lacks one
+	drift, err := m.CheckFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift == nil || !reflect.DeepEqual(drift.Changed, []string{driftNoRecord}) {
+		t.Fatalf("Expected a missing fingerprint to be reported as drift, got %+v", drift)
+	}
+	if _, err := os.Stat(m.fingerprintPath()); !os.IsNotExist(err) {
+		t.Errorf("Expected no fingerprint to be recorded, got %v", err)
+	}
+
+	// An upgrade from before fingerprinting leaves a marker to record this host once
+	if err := os.WriteFile(m.fingerprintMigrationPath(), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		drift, err := m.CheckFingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drift != nil {
+			t.Fatalf("Expected the migration marker to record this host, got %+v", drift)
+		}
+	}
+	if _, err := os.Stat(m.fingerprintMigrationPath()); !os.IsNotExist(err) {
+		t.Errorf("Expected the migration marker to be removed, got %v", err)
+	}
+}
+
+func TestCheckFingerprintRejectsEditedRecord(t *testing.T) {
+	m := newTestManager(t, newTestCA(t), "")
+	if err := m.recordFingerprint(Fingerprint{MachineID: "another-host"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap in this host's fingerprint without the agent key
+	data, err := json.Marshal(fingerprintRecord{Fingerprint: hostFingerprint(), MAC: strings.Repeat("00", 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(m.fingerprintPath(), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err := m.CheckFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift == nil || !reflect.DeepEqual(drift.Changed, []string{driftNoRecord}) {
+		t.Fatalf("Expected an edited fingerprint to be reported as drift, got %+v", drift)
+	}
+}
+
+func TestHandleDriftRebootstrapFallsBackToReport(t *testing.T) {
+	t.Setenv("INSTALL_TOKEN", "")
+	drift := &Drift{Changed: []string{"machine_id"}}
+
+	// The install token was cleared after bootstrap
+	m := newTestManager(t, newTestCA(t), "")
+	if err := m.HandleDrift(context.Background(), drift, DriftRebootstrap); err != nil {
+		t.Errorf("Expected a fallback to report without an install token, got %v", err)
+	}
+
+	// The token is still configured but was used up by the first bootstrap
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusConflict)
+	}))
+	defer server.Close()
+
+	m = newTestManager(t, newTestCA(t), "")
+	m.cfg.OrgID = "test-org"
+	m.cfg.InstallToken = "used-token"
+	m.cfg.BootstrapURL = server.URL
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := logging.NewAuditLogger(auditPath, testAgentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	m.SetAuditLogger(audit)
+
+	for i := 0; i < 2; i++ {
+		if err := m.HandleDrift(context.Background(), drift, DriftRebootstrap); err != nil {
+			t.Fatalf("Expected a fallback to report with a used token, got %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected a used token to be tried once, got %d bootstrap calls", calls)
+	}
+	if err := m.VerifyIdentity(); err != nil {
+		t.Errorf("Expected the current identity to be kept, got %v", err)
+	}
+
+	events, _ := os.ReadFile(auditPath)
+	if !strings.Contains(string(events), `"result":"fallback"`) {
+		t.Errorf("Expected the fallback to be audited, got %s", events)
+	}
+}
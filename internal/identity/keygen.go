@@ -0,0 +1,62 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+)
+
+// Key algorithms for agent keys, selected with key_algorithm
+const (
+	KeyAlgorithmECDSAP256 = "ecdsa-p256"
+	KeyAlgorithmEd25519   = "ed25519"
+)
+
+// generateKey creates a new agent private key on this host. The key never
+// leaves it; the backend only sees CSRs.
+func generateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "", KeyAlgorithmECDSAP256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
+		}
+		return key, nil
+	case KeyAlgorithmEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate Ed25519 key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %q", algorithm)
+	}
+}
+
+// encodePrivateKey returns a key as PKCS#8 PEM
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// createCSR builds a PEM-encoded certificate request. The common name is
+// the agent ID, or empty at bootstrap when the backend assigns one.
+func createCSR(key crypto.Signer, commonName string) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSR: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
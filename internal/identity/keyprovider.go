@@ -0,0 +1,151 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/unitechio/agent/internal/config"
+)
+
+// Key providers, selected with key_provider
+const (
+	KeyProviderFile   = "file"
+	KeyProviderPKCS11 = "pkcs11"
+)
+
+// KeyProvider keeps the agent private key. What tls.key_file holds depends on
+// the provider: the file provider stores the PEM key itself, while hardware
+// providers keep the key non-exportable and store only a reference to it.
+// Either way the file is staged and renamed like the certificate, so key and
+// certificate rotate together.
+type KeyProvider interface {
+	// Generate creates a new key and returns it with the reference to store
+	Generate(algorithm string) (crypto.Signer, []byte, error)
+
+	// Load returns the key a stored reference points to
+	Load(ref []byte) (crypto.Signer, error)
+
+	// Delete destroys a key that has been replaced or was never used
+	Delete(ref []byte) error
+
+	// DeriveKey derives a stable secret from the key, e.g. the buffer key
+	DeriveKey(ref []byte, label string) ([]byte, error)
+
+	// Close releases the provider, e.g. a PKCS#11 session
+	Close() error
+}
+
+// newKeyProvider returns the key provider configured for this agent
+func newKeyProvider(cfg *config.Config) (KeyProvider, error) {
+	switch cfg.KeyProvider {
+	case "", KeyProviderFile:
+		return fileKeyProvider{}, nil
+	case KeyProviderPKCS11:
+		return newPKCS11KeyProvider(cfg.PKCS11)
+	default:
+		return nil, fmt.Errorf("unknown key provider %q", cfg.KeyProvider)
+	}
+}
+
+// fileKeyProvider stores the private key as PEM in the key file
+type fileKeyProvider struct{}
+
+func (fileKeyProvider) Generate(algorithm string) (crypto.Signer, []byte, error) {
+	key, err := generateKey(algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, keyPEM, nil
+}
+
+func (fileKeyProvider) Load(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		// Issued by servers that generated keys for agents
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// Delete is a no-op; replacing the file removes the old key
+func (fileKeyProvider) Delete([]byte) error {
+	return nil
+}
+
+func (fileKeyProvider) DeriveKey(keyPEM []byte, label string) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key")
+	}
+
+	mac := hmac.New(sha256.New, block.Bytes)
+	mac.Write([]byte(label))
+	return mac.Sum(nil), nil
+}
+
+func (fileKeyProvider) Close() error {
+	return nil
+}
+
+// keyPair combines a PEM certificate chain with the key keyRef points to
+func (m *Manager) keyPair(certPEM, keyRef []byte) (tls.Certificate, error) {
+	var cert tls.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, fmt.Errorf("failed to decode certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	signer, err := m.keys.Load(keyRef)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(leaf.PublicKey) {
+		return tls.Certificate{}, fmt.Errorf("private key does not match certificate")
+	}
+
+	cert.PrivateKey = signer
+	cert.Leaf = leaf
+	return cert, nil
+}
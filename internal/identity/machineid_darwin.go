@@ -0,0 +1,26 @@
+//go:build darwin
+// +build darwin
+
+package identity
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// machineID returns the IOPlatformUUID of the Mac
+func machineID() string {
+	out, err := exec.Command("ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.Contains(line, `"IOPlatformUUID"`) {
+			continue
+		}
+		if _, value, ok := strings.Cut(line, "="); ok {
+			return strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return ""
+}
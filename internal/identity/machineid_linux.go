@@ -0,0 +1,21 @@
+//go:build linux
+// +build linux
+
+package identity
+
+import (
+	"os"
+	"strings"
+)
+
+// machineID returns the systemd/D-Bus machine ID
+func machineID() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if data, err := os.ReadFile(path); err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package identity
+
+// machineID is not available on this platform; the other components still apply
+func machineID() string {
+	return ""
+}
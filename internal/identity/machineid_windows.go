@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package identity
+
+import "golang.org/x/sys/windows/registry"
+
+// machineID returns the MachineGuid written when Windows was installed
+func machineID() string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Cryptography`, registry.QUERY_VALUE|registry.WOW64_64KEY)
+	if err != nil {
+		return ""
+	}
+	defer key.Close()
+
+	id, _, err := key.GetStringValue("MachineGuid")
+	if err != nil {
+		return ""
+	}
+	return id
+}
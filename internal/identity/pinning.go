@@ -0,0 +1,184 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/unitechio/agent/internal/config"
+)
+
+// Bootstrap server pinning
+//
+// The install token is sent before the agent has any certificate of its own,
+// so by default it trusts whatever the system roots trust, including a
+// TLS-intercepting proxy with a corporate root. Bootstrap can instead be
+// pinned to a CA bundle (bootstrap_ca), SHA-256 SPKI hashes (bootstrap_pins)
+// or both, taken from the config or enrollment bundle or compiled in. Which
+// trust was used is written to the audit log.
+
+// Bootstrap trust compiled in with -ldflags, used when the config pins
+// nothing, e.g.
+//
+//	go build -ldflags "-X github.com/unitechio/agent/internal/identity.builtinBootstrapPins=sha256/..." ./cmd/agent
+var (
+	builtinBootstrapCA   string // PEM bundle
+	builtinBootstrapPins string // comma-separated sha256/<base64> SPKI hashes
+)
+
+// Where the bootstrap trust came from
+const (
+	trustSourceConfig  = "config"
+	trustSourceBuiltin = "builtin"
+	trustSourceSystem  = "system"
+)
+
+// ErrPinMismatch is returned when the bootstrap server presents no pinned key
+var ErrPinMismatch = errors.New("bootstrap server certificate does not match any pinned key")
+
+// bootstrapTrust decides which bootstrap servers the agent sends its install token to
+type bootstrapTrust struct {
+	roots  *x509.CertPool // nil uses the system roots
+	pins   [][]byte       // SHA-256 hashes of acceptable SubjectPublicKeyInfo
+	host   string         // of the bootstrap URL, for servers addressed by IP (no SNI)
+	source string
+}
+
+// bootstrapServerTrust returns the pinned trust from the config, else the built-in
+// one, else the system roots
+func (m *Manager) bootstrapServerTrust() (*bootstrapTrust, error) {
+	caPEM, pins, source := m.cfg.BootstrapCA, m.cfg.BootstrapPins, trustSourceConfig
+	if caPEM == "" && len(pins) == 0 {
+		caPEM, pins, source = builtinBootstrapCA, splitPins(builtinBootstrapPins), trustSourceBuiltin
+	}
+	if caPEM == "" && len(pins) == 0 {
+		return &bootstrapTrust{source: trustSourceSystem}, nil
+	}
+
+	trust := &bootstrapTrust{source: source}
+	if u, err := url.Parse(m.bootstrapURL()); err == nil {
+		trust.host = u.Hostname()
+	}
+	if caPEM != "" {
+		trust.roots = x509.NewCertPool()
+		if !trust.roots.AppendCertsFromPEM([]byte(caPEM)) {
+			return nil, fmt.Errorf("%s bootstrap CA contains no PEM certificates", source)
+		}
+	}
+	for _, pin := range pins {
+		hash, err := config.ParseSPKIPin(pin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s bootstrap pin: %w", source, err)
+		}
+		trust.pins = append(trust.pins, hash)
+	}
+	return trust, nil
+}
+
+// mode summarizes the trust for logs and audit events
+func (t *bootstrapTrust) mode() string {
+	var modes []string
+	if t.roots != nil {
+		modes = append(modes, "pinned_ca")
+	}
+	if len(t.pins) > 0 {
+		modes = append(modes, "spki_pin")
+	}
+	if len(modes) == 0 {
+		return "system_roots"
+	}
+	return strings.Join(modes, "+")
+}
+
+// client returns an HTTPS client that only connects to trusted bootstrap
+// servers, through the proxies proxyFunc picks
+func (t *bootstrapTrust) client(proxyFunc func(*http.Request) (*url.URL, error)) *http.Client {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.source != trustSourceSystem {
+		// Verified against the pinned trust in VerifyConnection instead
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = t.verifyConnection
+	}
+
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               proxyFunc,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// verifyConnection checks the bootstrap server's chain and hostname against
+// the pinned CA (or the system roots) and requires a pinned key in the chain.
+// A pinned leaf key identifies the server by itself, so without a pinned CA
+// its chain is not checked.
+func (t *bootstrapTrust) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	host := cs.ServerName
+	if host == "" {
+		host = t.host
+	}
+
+	if t.roots == nil && t.pinned(leaf) {
+		return leaf.VerifyHostname(host)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         t.roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(t.pins) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if t.pinned(cert) {
+				return nil
+			}
+		}
+	}
+	return ErrPinMismatch
+}
+
+// pinned reports whether the certificate's public key is pinned
+func (t *bootstrapTrust) pinned(cert *x509.Certificate) bool {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range t.pins {
+		if bytes.Equal(pin, hash[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPins splits a comma-separated pin list
+func splitPins(list string) []string {
+	var pins []string
+	for _, pin := range strings.Split(list, ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+	return pins
+}
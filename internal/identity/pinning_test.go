@@ -0,0 +1,92 @@
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/unitechio/agent/internal/config"
+)
+
+func spkiPin(t *testing.T, cert *x509.Certificate) string {
+	t.Helper()
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestBootstrapServerTrust(t *testing.T) {
+	ca := newTestCA(t)
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serverCert, err := tls.X509KeyPair(ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "bootstrap"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, serverKey.Public()), marshalKey(t, serverKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(serverCert.Certificate[0])
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server.StartTLS()
+	defer server.Close()
+
+	other := newTestCA(t)
+	tests := []struct {
+		name string
+		ca   string
+		pins []string
+		mode string
+		ok   bool
+	}{
+		{"system roots", "", nil, "system_roots", false},
+		{"pinned CA", string(ca.pem), nil, "pinned_ca", true},
+		{"other CA", string(other.pem), nil, "pinned_ca", false},
+		{"pinned leaf key", "", []string{spkiPin(t, leaf)}, "spki_pin", true},
+		{"pinned CA key", string(ca.pem), []string{spkiPin(t, ca.cert)}, "pinned_ca+spki_pin", true},
+		{"wrong key", string(ca.pem), []string{spkiPin(t, other.cert)}, "pinned_ca+spki_pin", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Manager{
+				cfg:    &config.Config{BootstrapURL: server.URL, BootstrapCA: tt.ca, BootstrapPins: tt.pins},
+				logger: log.New(io.Discard, "", 0),
+			}
+			trust, err := m.bootstrapServerTrust()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if trust.mode() != tt.mode {
+				t.Errorf("Expected mode %s, got %s", tt.mode, trust.mode())
+			}
+
+			resp, err := trust.client(nil).Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tt.ok && err != nil {
+				t.Errorf("Expected the server to be trusted: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("Expected the server to be refused")
+			}
+			if tt.name == "wrong key" && !errors.Is(err, ErrPinMismatch) {
+				t.Errorf("Expected ErrPinMismatch, got %v", err)
+			}
+		})
+	}
+}
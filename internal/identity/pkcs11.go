@@ -0,0 +1,163 @@
+//go:build pkcs11
+// +build pkcs11
+
+package identity
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+
+	"github.com/unitechio/agent/internal/config"
+)
+
+// PKCS#11 keys
+//
+// The agent key is generated inside the token and never leaves it. Each key
+// pair gets a random CKA_ID and a companion HMAC secret with the same ID, from
+// which DeriveKey computes the buffer key. tls.key_file holds only
+// "pkcs11:id=<hex>", the reference to the current pair.
+
+// pkcs11Label marks objects created by the agent
+const pkcs11Label = "unitechio-agent"
+
+// pkcs11RefPrefix starts a key reference
+const pkcs11RefPrefix = "pkcs11:id="
+
+// pkcs11KeyProvider keeps the agent key in a PKCS#11 token
+type pkcs11KeyProvider struct {
+	ctx *crypto11.Context
+}
+
+// newPKCS11KeyProvider opens the configured token. The PIN falls back to the
+// PKCS11_PIN environment variable.
+func newPKCS11KeyProvider(cfg config.PKCS11Config) (KeyProvider, error) {
+	if cfg.Module == "" || cfg.TokenLabel == "" {
+		return nil, fmt.Errorf("pkcs11.module and pkcs11.token_label are required")
+	}
+
+	pin := cfg.Pin
+	if pin == "" {
+		pin = os.Getenv("PKCS11_PIN")
+	}
+
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       cfg.Module,
+		TokenLabel: cfg.TokenLabel,
+		Pin:        pin,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PKCS#11 token %q: %w", cfg.TokenLabel, err)
+	}
+	return &pkcs11KeyProvider{ctx: ctx}, nil
+}
+
+func (p *pkcs11KeyProvider) Generate(algorithm string) (crypto.Signer, []byte, error) {
+	if algorithm != "" && algorithm != KeyAlgorithmECDSAP256 {
+		return nil, nil, fmt.Errorf("key algorithm %q is not supported with PKCS#11", algorithm)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key ID: %w", err)
+	}
+
+	key, err := p.ctx.GenerateECDSAKeyPairWithLabel(id, []byte(pkcs11Label), elliptic.P256())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key in token: %w", err)
+	}
+	if _, err := p.ctx.GenerateSecretKeyWithLabel(id, []byte(pkcs11Label), 256, crypto11.CipherHMACSHA256); err != nil {
+		key.Delete()
+		return nil, nil, fmt.Errorf("failed to generate secret in token: %w", err)
+	}
+
+	return key, []byte(pkcs11RefPrefix + hex.EncodeToString(id) + "\n"), nil
+}
+
+func (p *pkcs11KeyProvider) Load(ref []byte) (crypto.Signer, error) {
+	id, err := parsePKCS11Ref(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := p.ctx.FindKeyPair(id, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find key in token: %w", err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("key %x not found in token", id)
+	}
+	return key, nil
+}
+
+func (p *pkcs11KeyProvider) Delete(ref []byte) error {
+	id, err := parsePKCS11Ref(ref)
+	if err != nil {
+		return err
+	}
+
+	if key, err := p.ctx.FindKeyPair(id, nil); err != nil {
+		return fmt.Errorf("failed to find key in token: %w", err)
+	} else if key != nil {
+		if err := key.Delete(); err != nil {
+			return fmt.Errorf("failed to delete key: %w", err)
+		}
+	}
+
+	if secret, err := p.ctx.FindKey(id, nil); err != nil {
+		return fmt.Errorf("failed to find secret in token: %w", err)
+	} else if secret != nil {
+		if err := secret.Delete(); err != nil {
+			return fmt.Errorf("failed to delete secret: %w", err)
+		}
+	}
+	return nil
+}
+
+func (p *pkcs11KeyProvider) DeriveKey(ref []byte, label string) ([]byte, error) {
+	id, err := parsePKCS11Ref(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := p.ctx.FindKey(id, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find secret in token: %w", err)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("secret %x not found in token", id)
+	}
+
+	mac, err := secret.NewHMAC(pkcs11.CKM_SHA256_HMAC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start HMAC: %w", err)
+	}
+	if _, err := mac.Write([]byte(label)); err != nil {
+		return nil, fmt.Errorf("failed to compute HMAC: %w", err)
+	}
+	return mac.Sum(nil), nil
+}
+
+func (p *pkcs11KeyProvider) Close() error {
+	return p.ctx.Close()
+}
+
+// parsePKCS11Ref returns the CKA_ID in a key reference
+func parsePKCS11Ref(ref []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(ref))
+	if !strings.HasPrefix(s, pkcs11RefPrefix) {
+		return nil, fmt.Errorf("key file does not reference a PKCS#11 key")
+	}
+	id, err := hex.DecodeString(strings.TrimPrefix(s, pkcs11RefPrefix))
+	if err != nil || len(id) == 0 {
+		return nil, fmt.Errorf("invalid PKCS#11 key reference")
+	}
+	return id, nil
+}
@@ -0,0 +1,15 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package identity
+
+import (
+	"fmt"
+
+	"github.com/unitechio/agent/internal/config"
+)
+
+// newPKCS11KeyProvider reports that PKCS#11 support was not compiled in
+func newPKCS11KeyProvider(config.PKCS11Config) (KeyProvider, error) {
+	return nil, fmt.Errorf("agent built without PKCS#11 support (rebuild with -tags pkcs11)")
+}
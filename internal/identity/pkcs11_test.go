@@ -0,0 +1,77 @@
+//go:build pkcs11
+// +build pkcs11
+
+package identity
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/unitechio/agent/internal/config"
+)
+
+// TestPKCS11KeyProvider runs against a software token. To run it:
+//
+//	softhsm2-util --init-token --free --label agent-test --pin 1234 --so-pin 5678
+//	PKCS11_TEST_MODULE=/usr/lib/softhsm/libsofthsm2.so PKCS11_TEST_TOKEN=agent-test \
+//	PKCS11_PIN=1234 go test -tags pkcs11 ./internal/identity
+func TestPKCS11KeyProvider(t *testing.T) {
+	module := os.Getenv("PKCS11_TEST_MODULE")
+	token := os.Getenv("PKCS11_TEST_TOKEN")
+	if module == "" || token == "" {
+		t.Skip("PKCS11_TEST_MODULE and PKCS11_TEST_TOKEN not set")
+	}
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		KeyProvider: KeyProviderPKCS11,
+		PKCS11:      config.PKCS11Config{Module: module, TokenLabel: token},
+		TLSConfig: config.TLSConfig{
+			CertFile: filepath.Join(dir, "agent.crt"),
+			KeyFile:  filepath.Join(dir, "agent.key"),
+			CAFile:   filepath.Join(dir, "ca.crt"),
+		},
+	}
+	m, err := NewManager(cfg, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	key, keyRef, err := m.keys.Generate(KeyAlgorithmECDSAP256)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	if bytes.Contains(keyRef, []byte("PRIVATE KEY")) {
+		t.Fatal("Key reference must not contain key material")
+	}
+
+	ca := newTestCA(t)
+	os.WriteFile(m.caPath, ca.pem, 0644)
+	if err := m.installCertificate(ca.issueAgent(t, testAgentID, key.Public()), keyRef); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyIdentity(); err != nil {
+		t.Fatalf("Token-backed identity does not verify: %v", err)
+	}
+
+	first, err := m.BufferKey()
+	if err != nil {
+		t.Fatalf("BufferKey failed: %v", err)
+	}
+	second, _ := m.BufferKey()
+	if len(first) != 32 || !bytes.Equal(first, second) {
+		t.Error("Expected a stable 32-byte buffer key")
+	}
+
+	if err := m.keys.Delete(keyRef); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := m.keys.Load(keyRef); err == nil {
+		t.Error("Expected the deleted key to be gone")
+	}
+}
@@ -0,0 +1,480 @@
+package identity
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/unitechio/agent/internal/retry"
+)
+
+// Certificate renewal
+//
+// The renewal loop renews the agent certificate once cert_renew_fraction of
+// its lifetime has passed. A new key is generated locally and only a CSR is
+// sent, authenticated with the current certificate. The new key and
+// certificate are first written next to the current ones with a .new suffix
+// and then renamed into place, key first. If the agent stops in between,
+// NewManager completes or discards the rotation on the next start.
+//
+// The replaced key is kept with a .old suffix until the telemetry buffer,
+// whose keyring is wrapped under a key derived from it, has been re-wrapped
+// under the new identity (see PreviousBufferKey and DiscardPreviousKey).
+
+// Renewal timing
+const (
+	defaultRenewFraction = 2.0 / 3.0
+	minRenewRetry        = 1 * time.Minute
+	maxRenewRetry        = 1 * time.Hour
+)
+
+// Suffixes of a key or certificate being rotated in, and of the replaced key
+const (
+	pendingSuffix = ".new"
+	retiredSuffix = ".old"
+)
+
+// RenewRequest asks the backend to sign a new agent certificate
+type RenewRequest struct {
+	AgentID string `json:"agent_id"`
+	CSR     string `json:"csr"` // PEM-encoded PKCS#10 certificate request
+}
+
+// RenewResponse carries the renewed certificate
+type RenewResponse struct {
+	Certificate string `json:"certificate"`       // PEM-encoded X.509 certificate
+	CACert      string `json:"ca_cert,omitempty"` // PEM-encoded CA certificate, if it changed
+	ExpiresAt   string `json:"expires_at"`        // Certificate expiration timestamp (RFC3339)
+}
+
+// StartRenewal renews the certificate in the background before it expires
+func (m *Manager) StartRenewal(ctx context.Context) {
+	go func() {
+		for {
+			wait, err := m.untilRenewal()
+			if err != nil {
+				m.logger.Printf("Cannot schedule certificate renewal: %v", err)
+				wait = maxRenewRetry
+			} else if wait > 0 {
+				m.logger.Printf("Next certificate renewal in %v", wait.Round(time.Minute))
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+
+			if err != nil {
+				continue
+			}
+
+			if err := m.Renew(ctx); err != nil {
+				m.logger.Printf("Certificate renewal failed: %v", err)
+
+				// Retry sooner as expiry approaches, but never in a tight loop
+				retryIn := maxRenewRetry
+				if notAfter, err := m.certificateExpiry(); err == nil {
+					retryIn = time.Until(notAfter) / 10
+				}
+				if retryIn < minRenewRetry {
+					retryIn = minRenewRetry
+				}
+				if retryIn > maxRenewRetry {
+					retryIn = maxRenewRetry
+				}
+
+				select {
+				case <-time.After(retryIn):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+}
+
+// untilRenewal returns how long until the current certificate is due for renewal
+func (m *Manager) untilRenewal() (time.Duration, error) {
+	cert, err := m.loadCertificate()
+	if err != nil {
+		return 0, err
+	}
+
+	fraction := m.cfg.CertRenewFraction
+	if fraction <= 0 || fraction >= 1 {
+		fraction = defaultRenewFraction
+	}
+
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	renewAt := cert.NotBefore.Add(time.Duration(float64(lifetime) * fraction))
+	if wait := time.Until(renewAt); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// Renew replaces the agent key and certificate and switches every client
+// from GetHTTPClient over to them
+func (m *Manager) Renew(ctx context.Context) error {
+	if err := m.renew(ctx); err != nil {
+		m.auditRotation(false, err)
+		return err
+	}
+	return m.activate(Change{Reason: ChangeRenewed})
+}
+
+// renew generates a new key, has the backend sign a CSR for it and installs the result
+func (m *Manager) renew(ctx context.Context) error {
+	m.rotateMu.Lock()
+	defer m.rotateMu.Unlock()
+
+	key, keyRef, err := m.keys.Generate(m.cfg.KeyAlgorithm)
+	if err != nil {
+		return err
+	}
+	installed := false
+	defer func() {
+		if !installed {
+			m.keys.Delete(keyRef)
+		}
+	}()
+
+	agentID := m.GetAgentID()
+	csr, err := createCSR(key, agentID)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(RenewRequest{AgentID: agentID, CSR: string(csr)})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	// Bypass authTransport so a refused renewal does not report itself again
+	client := &http.Client{Transport: m.transport, Timeout: 30 * time.Second}
+
+	var resp RenewResponse
+	err = retry.Do(ctx, m.renewRetryConfig(), func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "POST", m.cfg.APIBaseURL+"/api/v1/agents/renew", bytes.NewReader(body))
+		if err != nil {
+			return retry.Permanent(fmt.Errorf("failed to create request: %w", err))
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		httpResp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("HTTP request failed: %w", err)
+		}
+		defer httpResp.Body.Close()
+
+		if httpResp.StatusCode != http.StatusOK {
+			return retry.NewStatusError(httpResp)
+		}
+		return json.NewDecoder(httpResp.Body).Decode(&resp)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := m.checkIssued([]byte(resp.Certificate), []byte(resp.CACert), key.Public(), agentID); err != nil {
+		return err
+	}
+
+	if resp.CACert != "" {
+		if err := writeFileAtomic(m.caPath, []byte(resp.CACert), 0644); err != nil {
+			return fmt.Errorf("failed to write CA certificate: %w", err)
+		}
+	}
+	if err := m.installCertificate([]byte(resp.Certificate), keyRef); err != nil {
+		return err
+	}
+	installed = true
+	return nil
+}
+
+// renewRetryConfig retries renewal briefly; a refusal fails at once
+func (m *Manager) renewRetryConfig() retry.Config {
+	return retry.Config{
+		InitialDelay: 2 * time.Second,
+		MaxDelay:     30 * time.Second,
+		MaxAttempts:  3,
+		Multiplier:   2.0,
+		Jitter:       true,
+	}
+}
+
+// checkIssued verifies that a certificate from the backend is for our new
+// key and agent ID and chains to the org CA (the new one, if the server sent one)
+func (m *Manager) checkIssued(certPEM, caPEM []byte, public crypto.PublicKey, agentID string) error {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return fmt.Errorf("issued certificate is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse issued certificate: %w", err)
+	}
+
+	if pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(public) {
+		return fmt.Errorf("issued certificate does not match the new key")
+	}
+	if cert.Subject.CommonName != agentID {
+		return fmt.Errorf("issued certificate is for %q, not %q", cert.Subject.CommonName, agentID)
+	}
+
+	roots := x509.NewCertPool()
+	if len(caPEM) > 0 {
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("failed to parse CA certificate")
+		}
+	} else if roots, err = m.CACertPool(); err != nil {
+		return err
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("issued certificate is not trusted: %w", err)
+	}
+	return nil
+}
+
+// installCertificate swaps in a new certificate and key (or key reference).
+// Both are staged with pendingSuffix and synced before either replaces the
+// current files.
+func (m *Manager) installCertificate(certPEM, keyRef []byte) error {
+	pendingKey, pendingCert := m.keyPath+pendingSuffix, m.certPath+pendingSuffix
+
+	if err := writeFileSynced(pendingKey, keyRef, 0600); err != nil {
+		return fmt.Errorf("failed to stage private key: %w", err)
+	}
+	if err := writeFileSynced(pendingCert, certPEM, 0600); err != nil {
+		os.Remove(pendingKey)
+		return fmt.Errorf("failed to stage certificate: %w", err)
+	}
+
+	return m.commitPending()
+}
+
+// commitPending renames staged files into place, key first. The replaced
+// key is retired rather than destroyed.
+func (m *Manager) commitPending() error {
+	pendingKey, pendingCert := m.keyPath+pendingSuffix, m.certPath+pendingSuffix
+
+	// Keep the current key before the staged one replaces it, unless the
+	// key was already renamed before a restart
+	destroyOld := false
+	oldRef, err := os.ReadFile(m.keyPath)
+	if _, pendingErr := os.Stat(pendingKey); pendingErr == nil && err == nil {
+		retired, err := m.retireKey(oldRef)
+		if err != nil {
+			return err
+		}
+		destroyOld = !retired
+	}
+
+	// The host fingerprint is signed with the replaced key; re-sign it once
+	// the new key is in place
+	var recorded Fingerprint
+	keyRefs, recordErr := m.fingerprintKeys()
+	if recordErr == nil {
+		recorded, _, recordErr = m.readFingerprint(keyRefs...)
+	}
+
+	if err := os.Rename(pendingKey, m.keyPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to replace private key: %w", err)
+	}
+	if err := os.Rename(pendingCert, m.certPath); err != nil {
+		return fmt.Errorf("failed to replace certificate: %w", err)
+	}
+	if err := syncDir(filepath.Dir(m.certPath)); err != nil {
+		return err
+	}
+
+	if recordErr == nil {
+		if err := m.writeFingerprint(recorded); err != nil {
+			m.logger.Printf("Warning: %v", err)
+		}
+	}
+
+	if destroyOld {
+		if err := m.keys.Delete(oldRef); err != nil {
+			m.logger.Printf("Warning: failed to delete replaced key: %v", err)
+		}
+	}
+	return nil
+}
+
+// retireKey keeps a key that is about to be replaced until the buffer has
+// been re-wrapped. It reports false if an older key is already retired: the
+// buffer is still wrapped under that one, so ref is not needed.
+func (m *Manager) retireKey(ref []byte) (bool, error) {
+	retired := m.keyPath + retiredSuffix
+	if _, err := os.Stat(retired); err == nil {
+		return false, nil
+	}
+	if err := writeFileSynced(retired, ref, 0600); err != nil {
+		return false, fmt.Errorf("failed to keep replaced key: %w", err)
+	}
+	return true, nil
+}
+
+// PreviousBufferKey derives the buffer key of the identity replaced last,
+// or returns nil if no replaced key is kept
+func (m *Manager) PreviousBufferKey() ([]byte, error) {
+	keyRef, err := os.ReadFile(m.keyPath + retiredSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replaced key: %w", err)
+	}
+	return m.keys.DeriveKey(keyRef, bufferKeyLabel)
+}
+
+// DiscardPreviousKey destroys the replaced key. Call it once the buffer
+// keyring is wrapped under the current BufferKey.
+func (m *Manager) DiscardPreviousKey() error {
+	retired := m.keyPath + retiredSuffix
+	keyRef, err := os.ReadFile(retired)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read replaced key: %w", err)
+	}
+	current, err := os.ReadFile(m.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read private key: %w", err)
+	}
+	// A rotation that failed after retiring the key left a copy of the current one
+	if !bytes.Equal(current, keyRef) {
+		if err := m.keys.Delete(keyRef); err != nil {
+			return fmt.Errorf("failed to delete replaced key: %w", err)
+		}
+	}
+	return os.Remove(retired)
+}
+
+// recoverPendingRotation finishes a rotation interrupted between the two
+// renames, or discards one that never completed staging
+func (m *Manager) recoverPendingRotation() {
+	pendingKey, pendingCert := m.keyPath+pendingSuffix, m.certPath+pendingSuffix
+
+	certPEM, err := os.ReadFile(pendingCert)
+	if err != nil {
+		// Without a staged certificate a staged key is useless
+		if keyRef, err := os.ReadFile(pendingKey); err == nil {
+			m.keys.Delete(keyRef)
+			os.Remove(pendingKey)
+		}
+		return
+	}
+
+	keyRef, err := os.ReadFile(pendingKey)
+	staged := err == nil
+	if os.IsNotExist(err) {
+		// The key was already renamed into place
+		keyRef, err = os.ReadFile(m.keyPath)
+	}
+	if err == nil {
+		_, err = m.keyPair(certPEM, keyRef)
+	}
+	if err != nil {
+		m.logger.Printf("Warning: discarding incomplete certificate rotation: %v", err)
+		if staged {
+			m.keys.Delete(keyRef)
+		}
+		os.Remove(pendingKey)
+		os.Remove(pendingCert)
+		return
+	}
+
+	if err := m.commitPending(); err != nil {
+		m.logger.Printf("Warning: failed to complete certificate rotation: %v", err)
+		return
+	}
+	m.logger.Println("Completed interrupted certificate rotation")
+}
+
+// loadCertificate parses the certificate on disk
+func (m *Manager) loadCertificate() (*x509.Certificate, error) {
+	certPEM, err := os.ReadFile(m.certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// certificateExpiry returns when the certificate on disk expires
+func (m *Manager) certificateExpiry() (time.Time, error) {
+	cert, err := m.loadCertificate()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// writeFileSynced writes a file and flushes it to disk
+func writeFileSynced(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeFileAtomic replaces a file so readers never see it half-written
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := writeFileSynced(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes directory entries so a rename survives a crash
+func syncDir(dir string) error {
+	// Windows does not support fsync on directories
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
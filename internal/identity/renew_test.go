@@ -0,0 +1,375 @@
+package identity
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/unitechio/agent/internal/buffer"
+	"github.com/unitechio/agent/internal/config"
+)
+
+const testAgentID = "3f2c9a4e-1b7d-4e8a-9c61-2d5f0b8e7a13"
+
+// testCA issues agent and server certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Org CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate, pub crypto.PublicKey) []byte {
+	t.Helper()
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Minute)
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func (ca *testCA) issueAgent(t *testing.T, agentID string, pub crypto.PublicKey) []byte {
+	return ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: agentID},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, pub)
+}
+
+// newTestManager writes an agent identity issued by ca to a temp dir
+func newTestManager(t *testing.T, ca *testCA, apiBaseURL string) *Manager {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		AgentID:    testAgentID,
+		APIBaseURL: apiBaseURL,
+		TLSConfig: config.TLSConfig{
+			CertFile: filepath.Join(dir, "agent.crt"),
+			KeyFile:  filepath.Join(dir, "agent.key"),
+			CAFile:   filepath.Join(dir, "ca.crt"),
+		},
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	os.WriteFile(cfg.TLSConfig.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	os.WriteFile(cfg.TLSConfig.CertFile, ca.issueAgent(t, testAgentID, key.Public()), 0600)
+	os.WriteFile(cfg.TLSConfig.CAFile, ca.pem, 0644)
+
+	m, err := NewManager(cfg, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// newRenewServer signs renewal CSRs from clients holding a certificate
+// issued by ca, reporting each client certificate to seen if it is set
+func newRenewServer(t *testing.T, ca *testCA, seen func(*x509.Certificate)) *httptest.Server {
+	t.Helper()
+	return newBackend(t, ca, renewHandler(t, ca, seen))
+}
+
+// newBackend serves handler over mTLS to clients holding a certificate issued by ca
+func newBackend(t *testing.T, ca *testCA, handler http.Handler) *httptest.Server {
+	t.Helper()
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serverCert, err := tls.X509KeyPair(ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "backend"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, serverKey.Public()), marshalKey(t, serverKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// renewHandler answers the renew endpoint with a certificate issued by ca
+func renewHandler(t *testing.T, ca *testCA, seen func(*x509.Certificate)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if seen != nil {
+			seen(r.TLS.PeerCertificates[0])
+		}
+
+		var req RenewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		block, _ := pem.Decode([]byte(req.CSR))
+		if block == nil {
+			http.Error(w, "no CSR", http.StatusBadRequest)
+			return
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil || csr.CheckSignature() != nil {
+			http.Error(w, "bad CSR", http.StatusBadRequest)
+			return
+		}
+		if r.TLS.PeerCertificates[0].Subject.CommonName != req.AgentID {
+			http.Error(w, "agent mismatch", http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(RenewResponse{
+			Certificate: string(ca.issueAgent(t, csr.Subject.CommonName, csr.PublicKey)),
+			ExpiresAt:   time.Now().Add(time.Hour).Format(time.RFC3339),
+		})
+	}
+}
+
+func marshalKey(t *testing.T, key crypto.Signer) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestRenewReplacesKeyAndCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	server := newRenewServer(t, ca, nil)
+	m := newTestManager(t, ca, server.URL)
+
+	if err := m.reloadCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	oldKey, _ := os.ReadFile(m.keyPath)
+	if err := m.recordFingerprint(hostFingerprint()); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan Change, 1)
+	m.Subscribe(func(c Change) { changes <- c })
+
+	if err := m.Renew(context.Background()); err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+
+	newKey, _ := os.ReadFile(m.keyPath)
+	if string(newKey) == string(oldKey) {
+		t.Error("Expected a new private key")
+	}
+	if err := m.VerifyIdentity(); err != nil {
+		t.Errorf("Renewed identity does not verify: %v", err)
+	}
+	if _, err := os.Stat(m.certPath + pendingSuffix); !os.IsNotExist(err) {
+		t.Error("Expected no staged certificate after renewal")
+	}
+	// The recorded fingerprint is re-signed with the new key, so it verifies
+	// once the replaced key is gone
+	if err := m.DiscardPreviousKey(); err != nil {
+		t.Fatal(err)
+	}
+	if drift, err := m.CheckFingerprint(); err != nil || drift != nil {
+		t.Errorf("Expected the fingerprint to verify after renewal, got %+v (%v)", drift, err)
+	}
+
+	select {
+	case c := <-changes:
+		if c.Reason != ChangeRenewed || c.AgentID != testAgentID {
+			t.Errorf("Unexpected change: %+v", c)
+		}
+	default:
+		t.Error("Expected subscribers to be notified")
+	}
+}
+
+func TestConcurrentRotationsAreSerialized(t *testing.T) {
+	ca := newTestCA(t)
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	server := newRenewServer(t, ca, func(*x509.Certificate) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	})
+	m := newTestManager(t, ca, server.URL)
+	if err := m.reloadCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The renewal loop and auth failure recovery may both rotate at once
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- m.renew(context.Background())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Renew failed: %v", err)
+		}
+	}
+
+	if maxInFlight != 1 {
+		t.Errorf("Expected one rotation at a time, saw %d", maxInFlight)
+	}
+	if err := m.VerifyIdentity(); err != nil {
+		t.Errorf("Installed key and certificate do not match: %v", err)
+	}
+}
+
+func TestRenewKeepsBufferReadable(t *testing.T) {
+	ca := newTestCA(t)
+	server := newRenewServer(t, ca, nil)
+	m := newTestManager(t, ca, server.URL)
+	if err := m.reloadCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	bufferDir := t.TempDir()
+	buf, err := buffer.New(bufferDir, 1<<20, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufferKey, _ := m.BufferKey()
+	if err := buf.SetEncryptionKey(bufferKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := buf.Write(map[string]interface{}{"batch": "before"}); err != nil {
+		t.Fatal(err)
+	}
+	buf.Close()
+
+	// Renewed twice with no sender to re-wrap the keyring, as after a
+	// crash right after the key was replaced
+	for i := 0; i < 2; i++ {
+		if err := m.Renew(context.Background()); err != nil {
+			t.Fatalf("Renew failed: %v", err)
+		}
+	}
+
+	buf, err = buffer.New(bufferDir, 1<<20, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buf.Close()
+	bufferKey, _ = m.BufferKey()
+	previousKey, err := m.PreviousBufferKey()
+	if err != nil || previousKey == nil {
+		t.Fatalf("Expected the replaced key to be kept, got %v", err)
+	}
+	if err := buf.SetEncryptionKey(bufferKey, previousKey); err != nil {
+		t.Fatalf("Buffer is unreadable after renewal: %v", err)
+	}
+	records, err := buf.ReadAll()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Expected the buffered record, got %q (%v)", records, err)
+	}
+
+	if err := m.DiscardPreviousKey(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(m.keyPath + retiredSuffix); !os.IsNotExist(err) {
+		t.Error("Expected the replaced key to be removed")
+	}
+}
+
+func TestRecoverPendingRotation(t *testing.T) {
+	ca := newTestCA(t)
+	m := newTestManager(t, ca, "")
+
+	// Interrupted after the key was renamed into place
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newCert := ca.issueAgent(t, testAgentID, key.Public())
+	os.WriteFile(m.keyPath, marshalKey(t, key), 0600)
+	os.WriteFile(m.certPath+pendingSuffix, newCert, 0600)
+
+	m.recoverPendingRotation()
+
+	cert, _ := os.ReadFile(m.certPath)
+	if string(cert) != string(newCert) {
+		t.Error("Expected the staged certificate to be installed")
+	}
+	if err := m.VerifyIdentity(); err != nil {
+		t.Errorf("Recovered identity does not verify: %v", err)
+	}
+
+	// A staged certificate without a matching key is discarded
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	os.WriteFile(m.certPath+pendingSuffix, ca.issueAgent(t, testAgentID, other.Public()), 0600)
+
+	m.recoverPendingRotation()
+
+	if _, err := os.Stat(m.certPath + pendingSuffix); !os.IsNotExist(err) {
+		t.Error("Expected the mismatched certificate to be discarded")
+	}
+	if err := m.VerifyIdentity(); err != nil {
+		t.Errorf("Current identity should be untouched: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package identity
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Hot-reloading mTLS
+//
+// Every component shares one pooled http.Transport. Its tls.Config carries
+// no certificates; GetClientCertificate and VerifyConnection consult the
+// credentials cache on each handshake, and the cache reloads the agent
+// certificate, key and CA bundle whenever the files on disk change. A
+// renewal, re-bootstrap or a replaced ca.crt therefore takes effect on the
+// next connection without rebuilding any client.
+
+// credentials caches the parsed client certificate and CA pool
+type credentials struct {
+	certPath string
+	keyPath  string
+	caPath   string
+	keyPair  func(certPEM, keyRef []byte) (tls.Certificate, error)
+	logger   *log.Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certStamp fileStamp // of the certificate and key together
+	roots     *x509.CertPool
+	caStamp   fileStamp
+}
+
+// fileStamp identifies one version of a file (or pair of files) on disk
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// stat returns the combined stamp of the given files
+func stat(paths ...string) (fileStamp, error) {
+	var stamp fileStamp
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fileStamp{}, err
+		}
+		if info.ModTime().After(stamp.modTime) {
+			stamp.modTime = info.ModTime()
+		}
+		stamp.size += info.Size()
+	}
+	return stamp, nil
+}
+
+// clientCertificate returns the agent certificate, reloading it if the files changed
+func (c *credentials) clientCertificate() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stamp, err := stat(c.certPath, c.keyPath)
+	if err == nil && c.cert != nil && stamp == c.certStamp {
+		return c.cert, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = c.load(); err == nil {
+			c.cert, c.certStamp = &cert, stamp
+			return c.cert, nil
+		}
+	}
+
+	// Mid-rotation the key and certificate may briefly not match; keep
+	// using the last good pair until they do
+	if c.cert != nil {
+		c.logger.Printf("Warning: keeping current client certificate: %v", err)
+		return c.cert, nil
+	}
+	return nil, fmt.Errorf("failed to load certificate/key: %w", err)
+}
+
+// load reads the certificate and key from disk
+func (c *credentials) load() (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(c.certPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyRef, err := os.ReadFile(c.keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return c.keyPair(certPEM, keyRef)
+}
+
+// rootCAs returns the org CA pool, reloading it if ca.crt changed
+func (c *credentials) rootCAs() (*x509.CertPool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stamp, err := stat(c.caPath)
+	if err == nil && c.roots != nil && stamp == c.caStamp {
+		return c.roots, nil
+	}
+	if err == nil {
+		var caPEM []byte
+		if caPEM, err = os.ReadFile(c.caPath); err == nil {
+			roots := x509.NewCertPool()
+			if roots.AppendCertsFromPEM(caPEM) {
+				c.roots, c.caStamp = roots, stamp
+				return c.roots, nil
+			}
+			err = fmt.Errorf("no certificates in %s", c.caPath)
+		}
+	}
+
+	if c.roots != nil {
+		c.logger.Printf("Warning: keeping current CA certificates: %v", err)
+		return c.roots, nil
+	}
+	return nil, fmt.Errorf("failed to load CA certificate: %w", err)
+}
+
+// invalidate forces the next handshake to reload everything from disk
+func (c *credentials) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certStamp, c.caStamp = fileStamp{}, fileStamp{}
+}
+
+// newTransport builds the pooled transport shared by every mTLS client
+func (m *Manager) newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:               m.proxy.Proxy,
+		TLSClientConfig:     m.tlsConfig(),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        20,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// tlsConfig returns a TLS configuration that reads the current credentials
+// on every handshake
+func (m *Manager) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return m.creds.clientCertificate()
+		},
+		// The CA pool can change between handshakes, so the server
+		// certificate is verified in VerifyConnection instead
+		InsecureSkipVerify: true,
+		VerifyConnection:   m.verifyConnection,
+	}
+}
+
+// verifyConnection checks the server certificate chain and hostname against
+// the current CA pool
+func (m *Manager) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+
+	roots, err := m.creds.rootCAs()
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// reloadCredentials switches the shared transport to the files on disk and
+// drops idle connections made with the previous certificate
+func (m *Manager) reloadCredentials() error {
+	m.creds.invalidate()
+	if _, err := m.creds.clientCertificate(); err != nil {
+		return err
+	}
+	if _, err := m.creds.rootCAs(); err != nil {
+		return err
+	}
+
+	m.transport.CloseIdleConnections()
+	return nil
+}
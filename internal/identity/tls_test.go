@@ -0,0 +1,67 @@
+package identity
+
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestSharedTransportUsesRenewedCertificate(t *testing.T) {
+	ca := newTestCA(t)
+
+	var mu sync.Mutex
+	var presented []*x509.Certificate
+	server := newRenewServer(t, ca, func(cert *x509.Certificate) {
+		mu.Lock()
+		presented = append(presented, cert)
+		mu.Unlock()
+	})
+	m := newTestManager(t, ca, server.URL)
+
+	if err := m.Renew(context.Background()); err != nil {
+		t.Fatalf("First renewal failed: %v", err)
+	}
+	renewed, err := m.loadCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second renewal authenticates with the certificate from the first
+	if err := m.Renew(context.Background()); err != nil {
+		t.Fatalf("Second renewal failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(presented) != 2 || !presented[1].Equal(renewed) {
+		t.Errorf("Expected the second request to present the renewed certificate")
+	}
+}
+
+func TestCAPoolReloadsWhenFileChanges(t *testing.T) {
+	ca := newTestCA(t)
+	m := newTestManager(t, ca, "")
+
+	before, err := m.creds.rootCAs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestCA(t)
+	if err := os.WriteFile(m.caPath, append(ca.pem, other.pem...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := m.creds.rootCAs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after == before {
+		t.Fatal("Expected the CA pool to be reloaded")
+	}
+	if _, err := other.cert.Verify(x509.VerifyOptions{Roots: after}); err != nil {
+		t.Errorf("Expected the new CA to be trusted: %v", err)
+	}
+}
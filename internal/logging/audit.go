@@ -101,6 +101,20 @@ func (a *AuditLogger) LogBootstrap(success bool, orgID string, err error) {
 	a.LogEvent(event)
 }
 
+// LogBootstrapTrust logs whether bootstrap trusted a pinned CA or key or the system roots
+func (a *AuditLogger) LogBootstrapTrust(bootstrapURL, mode, source string) {
+	a.LogEvent(AuditEvent{
+		EventType: "bootstrap_trust",
+		Severity:  "INFO",
+		Action:    "tls_verification",
+		Resource:  bootstrapURL,
+		Result:    mode,
+		Details: map[string]interface{}{
+			"source": source,
+		},
+	})
+}
+
 // LogPolicyChange logs policy update event
 func (a *AuditLogger) LogPolicyChange(oldVersion, newVersion string) {
 	a.LogEvent(AuditEvent{
@@ -115,6 +129,20 @@ func (a *AuditLogger) LogPolicyChange(oldVersion, newVersion string) {
 	})
 }
 
+// LogPolicyRejected logs a policy that failed verification and was not applied
+func (a *AuditLogger) LogPolicyRejected(currentVersion string, reason string) {
+	a.LogEvent(AuditEvent{
+		EventType: "policy_change",
+		Severity:  "WARNING",
+		Action:    "policy_rejected",
+		Result:    "failure",
+		Details: map[string]interface{}{
+			"kept_version": currentVersion,
+		},
+		ErrorMsg: reason,
+	})
+}
+
 // LogUpdate logs agent update event
 func (a *AuditLogger) LogUpdate(oldVersion, newVersion string, success bool, err error) {
 	event := AuditEvent{
@@ -174,6 +202,36 @@ func (a *AuditLogger) LogCertRotation(success bool, expiryDate time.Time, err er
 	a.LogEvent(event)
 }
 
+// LogFingerprintDrift logs a host fingerprint that no longer matches the bootstrapped host
+func (a *AuditLogger) LogFingerprintDrift(changed []string, recorded, current string) {
+	a.LogEvent(AuditEvent{
+		EventType: "fingerprint_drift",
+		Severity:  "WARNING",
+		Action:    "host_verification",
+		Result:    "mismatch",
+		Details: map[string]interface{}{
+			"changed":  changed,
+			"recorded": recorded,
+			"current":  current,
+		},
+	})
+}
+
+// LogDriftReaction logs a fingerprint drift reaction that could not be
+// applied, and the reaction used instead
+func (a *AuditLogger) LogDriftReaction(wanted, applied string, err error) {
+	a.LogEvent(AuditEvent{
+		EventType: "fingerprint_drift",
+		Severity:  "WARNING",
+		Action:    wanted,
+		Result:    "fallback",
+		Details: map[string]interface{}{
+			"applied": applied,
+			"error":   err.Error(),
+		},
+	})
+}
+
 // LogServiceStart logs service start event
 func (a *AuditLogger) LogServiceStart(version string) {
 	a.LogEvent(AuditEvent{
@@ -0,0 +1,84 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cachedPolicy is the on-disk form of the last known good policy.
+// The signed document is stored as received so it is re-verified on load.
+type cachedPolicy struct {
+	Version      string          `json:"version"`
+	FetchedAt    time.Time       `json:"fetched_at"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	Document     json.RawMessage `json:"document"`
+
+	Policy *Policy `json:"-"`
+}
+
+// loadCached reads, verifies and validates the last known good policy from disk
+func (e *Engine) loadCached() (*cachedPolicy, error) {
+	if e.cfg.PolicyCacheFile == "" {
+		return nil, os.ErrNotExist
+	}
+
+	data, err := os.ReadFile(e.cfg.PolicyCacheFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var cached cachedPolicy
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, fmt.Errorf("failed to decode cached policy: %w", err)
+	}
+
+	cached.Policy, err = e.verify(cached.Document)
+	if err != nil {
+		return nil, fmt.Errorf("cached policy rejected: %w", err)
+	}
+
+	return &cached, nil
+}
+
+// loadBootstrapPolicy verifies the initial policy delivered with the agent certificate
+func (e *Engine) loadBootstrapPolicy() (*Policy, error) {
+	document, err := e.identity.BootstrapPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.verify(document)
+}
+
+// saveCached atomically writes a signed policy document to the cache file
+func (e *Engine) saveCached(cached cachedPolicy) error {
+	if e.cfg.PolicyCacheFile == "" {
+		return nil
+	}
+
+	cached.FetchedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(cached, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal policy: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(e.cfg.PolicyCacheFile), 0755); err != nil {
+		return fmt.Errorf("failed to create policy cache directory: %w", err)
+	}
+
+	// Write to a temp file and rename so a crash never leaves a torn cache
+	tmpPath := e.cfg.PolicyCacheFile + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write policy cache: %w", err)
+	}
+	if err := os.Rename(tmpPath, e.cfg.PolicyCacheFile); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace policy cache: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+package policy
+
+import "errors"
+
+var (
+	ErrUnsignedPolicy    = errors.New("policy is not signed")
+	ErrUntrustedSigner   = errors.New("policy signer is not trusted by the org CA")
+	ErrInvalidSignature  = errors.New("policy signature is invalid")
+	ErrInvalidPolicy     = errors.New("invalid policy")
+	ErrUnsupportedSchema = errors.New("unsupported policy schema version")
+	ErrPolicyRollback    = errors.New("policy is older than the active policy")
+)
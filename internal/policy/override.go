@@ -0,0 +1,342 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Source identifies where an effective policy value came from
+type Source string
+
+const (
+	SourceDefault   Source = "default"   // Built-in defaults
+	SourceBootstrap Source = "bootstrap" // Signed policy issued at bootstrap
+	SourceCache     Source = "cache"     // Last known good server policy on disk
+	SourceServer    Source = "server"    // Fetched from the backend
+	SourceLocal     Source = "local"     // Unlocked value from the override file
+	SourceLocked    Source = "locked"    // Locked value from the override file
+)
+
+// Override is a local policy file merged over the server policy.
+//
+// Precedence, lowest to highest:
+//  1. built-in defaults
+//  2. unlocked override values
+//  3. any policy issued by the org (server, cache or bootstrap)
+//  4. locked override values
+//
+// Unlocked values therefore only take effect on hosts that have never received
+// an org policy, such as air-gapped machines. Locked values always win, which
+// lets a host pin settings the server must not change, e.g.
+// "collectors.network.options.collect_mac". A lock also covers every key below
+// it, so "collectors.processes" locks all values set for that collector.
+type Override struct {
+	Collectors map[string]CollectorOverride `json:"collectors,omitempty"`
+	Update     UpdateOverride               `json:"update"`
+	Telemetry  TelemetryOverride            `json:"telemetry"`
+	Identity   IdentityOverride             `json:"identity"`
+	Locked     []string                     `json:"locked,omitempty"`
+}
+
+// CollectorOverride holds the collector settings set by the override file
+type CollectorOverride struct {
+	Enabled  *bool                  `json:"enabled,omitempty"`
+	Interval *Duration              `json:"interval,omitempty"`
+	Priority *string                `json:"priority,omitempty"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+}
+
+// UpdateOverride holds the update settings set by the override file
+type UpdateOverride struct {
+	Enabled       *bool     `json:"enabled,omitempty"`
+	Channel       *string   `json:"channel,omitempty"`
+	CheckInterval *Duration `json:"check_interval,omitempty"`
+}
+
+// TelemetryOverride holds the telemetry settings set by the override file
+type TelemetryOverride struct {
+	BatchSize     *int      `json:"batch_size,omitempty"`
+	MaxBatchBytes *int      `json:"max_batch_bytes,omitempty"`
+	FlushInterval *Duration `json:"flush_interval,omitempty"`
+	Compression   *bool     `json:"compression,omitempty"`
+	Codec         *string   `json:"codec,omitempty"`
+}
+
+// IdentityOverride holds the identity settings set by the override file
+type IdentityOverride struct {
+	OnFingerprintDrift *string `json:"on_fingerprint_drift,omitempty"`
+}
+
+// Duration accepts either a Go duration string ("5m") or nanoseconds,
+// so hand-written override files stay readable
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+
+	var ns int64
+	if err := json.Unmarshal(data, &ns); err != nil {
+		return fmt.Errorf("duration must be a string like \"5m\" or nanoseconds: %w", err)
+	}
+	*d = Duration(ns)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadOverride reads an override file
+func LoadOverride(path string) (*Override, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var o Override
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil, fmt.Errorf("failed to parse policy override: %w", err)
+	}
+
+	return &o, nil
+}
+
+// IsLocked reports whether a key is covered by a lock
+func (o *Override) IsLocked(key string) bool {
+	for _, lock := range o.Locked {
+		if key == lock || strings.HasPrefix(key, lock+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply merges the override over a base policy from the given source and
+// returns the effective policy together with the origin of every value.
+// The base policy is not modified.
+func (o *Override) Apply(base *Policy, source Source) (*Policy, map[string]Source) {
+	return o.merge(base, source, false)
+}
+
+// ApplyLocked is Apply without the unlocked values
+func (o *Override) ApplyLocked(base *Policy, source Source) (*Policy, map[string]Source) {
+	return o.merge(base, source, true)
+}
+
+func (o *Override) merge(base *Policy, source Source, lockedOnly bool) (*Policy, map[string]Source) {
+	effective := base.clone()
+	origins := effective.origins(source)
+
+	if o == nil {
+		return effective, origins
+	}
+
+	// set reports whether an override value for key wins over the base
+	set := func(key string) bool {
+		switch {
+		case o.IsLocked(key):
+			origins[key] = SourceLocked
+		case source == SourceDefault && !lockedOnly:
+			origins[key] = SourceLocal
+		default:
+			return false
+		}
+		return true
+	}
+
+	defaults := defaultPolicy()
+	for name, co := range o.Collectors {
+		prefix := "collectors." + name
+		collector, ok := effective.Collectors[name]
+		if !ok {
+			// The base does not define this collector: keep it disabled unless
+			// the override enables it, with the default interval and priority
+			collector = CollectorPolicy{
+				Interval: defaults.Collectors[name].Interval,
+				Priority: defaults.Collectors[name].Priority,
+			}
+		}
+		changed := false
+
+		if co.Enabled != nil && set(prefix+".enabled") {
+			collector.Enabled = *co.Enabled
+			changed = true
+		}
+		if co.Interval != nil && set(prefix+".interval") {
+			collector.Interval = time.Duration(*co.Interval)
+			changed = true
+		}
+		if co.Priority != nil && set(prefix+".priority") {
+			collector.Priority = *co.Priority
+			changed = true
+		}
+		for option, value := range co.Options {
+			if set(prefix + ".options." + option) {
+				if collector.Options == nil {
+					collector.Options = make(map[string]interface{})
+				}
+				collector.Options[option] = value
+				changed = true
+			}
+		}
+
+		if changed {
+			effective.Collectors[name] = collector
+		}
+	}
+
+	if o.Update.Enabled != nil && set("update.enabled") {
+		effective.Update.Enabled = *o.Update.Enabled
+	}
+	if o.Update.Channel != nil && set("update.channel") {
+		effective.Update.Channel = *o.Update.Channel
+	}
+	if o.Update.CheckInterval != nil && set("update.check_interval") {
+		effective.Update.CheckInterval = time.Duration(*o.Update.CheckInterval)
+	}
+
+	if o.Telemetry.BatchSize != nil && set("telemetry.batch_size") {
+		effective.Telemetry.BatchSize = *o.Telemetry.BatchSize
+	}
+	if o.Telemetry.MaxBatchBytes != nil && set("telemetry.max_batch_bytes") {
+		effective.Telemetry.MaxBatchBytes = *o.Telemetry.MaxBatchBytes
+	}
+	if o.Telemetry.FlushInterval != nil && set("telemetry.flush_interval") {
+		effective.Telemetry.FlushInterval = time.Duration(*o.Telemetry.FlushInterval)
+	}
+	if o.Telemetry.Compression != nil && set("telemetry.compression") {
+		effective.Telemetry.Compression = *o.Telemetry.Compression
+	}
+	if o.Telemetry.Codec != nil && set("telemetry.codec") {
+		effective.Telemetry.Codec = *o.Telemetry.Codec
+	}
+
+	if o.Identity.OnFingerprintDrift != nil && set("identity.on_fingerprint_drift") {
+		effective.Identity.OnFingerprintDrift = *o.Identity.OnFingerprintDrift
+	}
+
+	return effective, origins
+}
+
+// UnusedLocks returns locks that do not cover any value set by the override.
+// Such locks have no effect, since a lock pins the override's own value.
+func (o *Override) UnusedLocks() []string {
+	var unused []string
+	for _, lock := range o.Locked {
+		used := false
+		for _, key := range o.Keys() {
+			if key == lock || strings.HasPrefix(key, lock+".") {
+				used = true
+				break
+			}
+		}
+		if !used {
+			unused = append(unused, lock)
+		}
+	}
+	return unused
+}
+
+// Keys returns every key the override sets, sorted
+func (o *Override) Keys() []string {
+	var keys []string
+	for name, co := range o.Collectors {
+		prefix := "collectors." + name
+		if co.Enabled != nil {
+			keys = append(keys, prefix+".enabled")
+		}
+		if co.Interval != nil {
+			keys = append(keys, prefix+".interval")
+		}
+		if co.Priority != nil {
+			keys = append(keys, prefix+".priority")
+		}
+		for option := range co.Options {
+			keys = append(keys, prefix+".options."+option)
+		}
+	}
+	if o.Update.Enabled != nil {
+		keys = append(keys, "update.enabled")
+	}
+	if o.Update.Channel != nil {
+		keys = append(keys, "update.channel")
+	}
+	if o.Update.CheckInterval != nil {
+		keys = append(keys, "update.check_interval")
+	}
+	if o.Telemetry.BatchSize != nil {
+		keys = append(keys, "telemetry.batch_size")
+	}
+	if o.Telemetry.MaxBatchBytes != nil {
+		keys = append(keys, "telemetry.max_batch_bytes")
+	}
+	if o.Telemetry.FlushInterval != nil {
+		keys = append(keys, "telemetry.flush_interval")
+	}
+	if o.Telemetry.Compression != nil {
+		keys = append(keys, "telemetry.compression")
+	}
+	if o.Telemetry.Codec != nil {
+		keys = append(keys, "telemetry.codec")
+	}
+	if o.Identity.OnFingerprintDrift != nil {
+		keys = append(keys, "identity.on_fingerprint_drift")
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// clone returns a deep copy of the policy
+func (p *Policy) clone() *Policy {
+	c := *p
+	c.Collectors = make(map[string]CollectorPolicy, len(p.Collectors))
+	for name, collector := range p.Collectors {
+		if collector.Options != nil {
+			options := make(map[string]interface{}, len(collector.Options))
+			for k, v := range collector.Options {
+				options[k] = v
+			}
+			collector.Options = options
+		}
+		c.Collectors[name] = collector
+	}
+	return &c
+}
+
+// origins attributes every value of the policy to a single source
+func (p *Policy) origins(source Source) map[string]Source {
+	origins := map[string]Source{
+		"update.enabled":                source,
+		"update.channel":                source,
+		"update.check_interval":         source,
+		"telemetry.batch_size":          source,
+		"telemetry.max_batch_bytes":     source,
+		"telemetry.flush_interval":      source,
+		"telemetry.compression":         source,
+		"telemetry.codec":               source,
+		"identity.on_fingerprint_drift": source,
+	}
+	for name, collector := range p.Collectors {
+		prefix := "collectors." + name
+		origins[prefix+".enabled"] = source
+		origins[prefix+".interval"] = source
+		origins[prefix+".priority"] = source
+		for option := range collector.Options {
+			origins[prefix+".options."+option] = source
+		}
+	}
+	return origins
+}
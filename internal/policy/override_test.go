@@ -0,0 +1,137 @@
+package policy
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+const testOverride = `{
+	"collectors": {
+		"network": {"options": {"collect_mac": false}},
+		"cpu": {"interval": "2m"}
+	},
+	"telemetry": {"batch_size": 50},
+	"locked": ["collectors.network"]
+}`
+
+func parseOverride(t *testing.T, data string) *Override {
+	t.Helper()
+
+	var o Override
+	if err := json.Unmarshal([]byte(data), &o); err != nil {
+		t.Fatalf("Failed to parse override: %v", err)
+	}
+	return &o
+}
+
+func TestOverrideAppliesOverDefaults(t *testing.T) {
+	o := parseOverride(t, testOverride)
+
+	effective, origins := o.Apply(defaultPolicy(), SourceDefault)
+
+	if effective.Collectors["cpu"].Interval != 2*time.Minute {
+		t.Errorf("Expected cpu interval 2m, got %v", effective.Collectors["cpu"].Interval)
+	}
+	if effective.Telemetry.BatchSize != 50 {
+		t.Errorf("Expected batch size 50, got %d", effective.Telemetry.BatchSize)
+	}
+	if origins["collectors.cpu.interval"] != SourceLocal {
+		t.Errorf("Expected cpu interval from local, got %s", origins["collectors.cpu.interval"])
+	}
+	if origins["collectors.memory.interval"] != SourceDefault {
+		t.Errorf("Expected memory interval from default, got %s", origins["collectors.memory.interval"])
+	}
+}
+
+func TestServerPolicyWinsOverUnlockedValues(t *testing.T) {
+	o := parseOverride(t, testOverride)
+
+	server := defaultPolicy()
+	server.Collectors["network"] = CollectorPolicy{
+		Enabled:  true,
+		Interval: time.Minute,
+		Options:  map[string]interface{}{"collect_mac": true},
+	}
+
+	effective, origins := o.Apply(server, SourceServer)
+
+	if effective.Collectors["cpu"].Interval != server.Collectors["cpu"].Interval {
+		t.Errorf("Unlocked override should not beat the server, got %v", effective.Collectors["cpu"].Interval)
+	}
+	if origins["collectors.cpu.interval"] != SourceServer {
+		t.Errorf("Expected cpu interval from server, got %s", origins["collectors.cpu.interval"])
+	}
+
+	// Locked keys win even over the server
+	if effective.Collectors["network"].Options["collect_mac"] != false {
+		t.Error("Locked collect_mac=false was overridden by the server")
+	}
+	if origins["collectors.network.options.collect_mac"] != SourceLocked {
+		t.Errorf("Expected collect_mac from locked, got %s", origins["collectors.network.options.collect_mac"])
+	}
+
+	// The base policy must not be modified
+	if server.Collectors["network"].Options["collect_mac"] != true {
+		t.Error("Apply modified the base policy")
+	}
+}
+
+func TestUnusedLocks(t *testing.T) {
+	o := parseOverride(t, `{"locked": ["collectors.processes.enabled", "telemetry"], "telemetry": {"compression": true}}`)
+
+	unused := o.UnusedLocks()
+	if len(unused) != 1 || unused[0] != "collectors.processes.enabled" {
+		t.Errorf("Expected only collectors.processes.enabled to be unused, got %v", unused)
+	}
+}
+
+func TestLocksSurviveInvalidMerge(t *testing.T) {
+	o := parseOverride(t, `{
+		"collectors": {
+			"network": {"options": {"collect_mac": false}},
+			"cpu": {"enabled": true}
+		},
+		"telemetry": {"batch_size": 0},
+		"locked": ["collectors.network.options.collect_mac", "collectors.cpu.enabled"]
+	}`)
+	e := &Engine{logger: log.New(io.Discard, "", 0), override: o}
+
+	// The unlocked batch_size makes the merge invalid; only it is dropped
+	if _, _, err := e.apply(defaultPolicy(), SourceDefault); err != nil {
+		t.Fatalf("Expected the locked values alone to apply, got %v", err)
+	}
+	if e.Get().Telemetry.BatchSize != defaultPolicy().Telemetry.BatchSize {
+		t.Errorf("Expected the invalid unlocked batch size to be dropped, got %d", e.Get().Telemetry.BatchSize)
+	}
+	if e.Origins()["collectors.network.options.collect_mac"] != SourceLocked {
+		t.Error("Locked collect_mac was dropped with the unlocked values")
+	}
+
+	// A server policy without the network collector still gets the lock,
+	// without enabling the collector
+	server := defaultPolicy()
+	server.Version = "2.0.0"
+	delete(server.Collectors, "network")
+	if err := e.activate(server, SourceServer); err != nil {
+		t.Fatalf("Expected a lock on a missing collector to apply, got %v", err)
+	}
+	network := e.Get().Collectors["network"]
+	if network.Enabled || network.Options["collect_mac"] != false {
+		t.Errorf("Expected network disabled with collect_mac=false, got %+v", network)
+	}
+
+	// A server policy the locks make invalid is refused as a whole
+	conflicting := defaultPolicy()
+	conflicting.Version = "3.0.0"
+	conflicting.Collectors["cpu"] = CollectorPolicy{Enabled: false, Interval: time.Second}
+	conflicting.Collectors["network"] = CollectorPolicy{Enabled: true, Interval: time.Minute, Options: map[string]interface{}{"collect_mac": true}}
+	if err := e.activate(conflicting, SourceServer); err == nil {
+		t.Fatal("Expected a policy conflicting with the locks to be refused")
+	}
+	if e.Get().Version != "2.0.0" || e.Get().Collectors["network"].Options["collect_mac"] != false {
+		t.Errorf("Expected policy 2.0.0 with collect_mac=false to stay in effect, got %s", e.Get().Version)
+	}
+}
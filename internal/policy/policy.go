@@ -2,15 +2,33 @@ package policy
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/unitechio/agent/internal/buffer"
 	"github.com/unitechio/agent/internal/config"
 	"github.com/unitechio/agent/internal/identity"
+	"github.com/unitechio/agent/internal/logging"
+	"github.com/unitechio/agent/internal/retry"
+)
+
+// maxPolicySize caps the size of a policy document read from the server
+const maxPolicySize = 1 << 20
+
+// Bounds for the server-suggested policy refresh interval
+const (
+	defaultRefreshInterval = 5 * time.Minute
+	minRefreshInterval     = 1 * time.Minute
+	maxRefreshInterval     = 24 * time.Hour
 )
 
 // Engine manages agent policy
@@ -18,23 +36,40 @@ type Engine struct {
 	cfg      *config.Config
 	identity *identity.Manager
 	logger   *log.Logger
+	audit    *logging.AuditLogger
 	mu       sync.RWMutex
-	current  *Policy
+	current  *Policy // effective policy after the local override is applied
+	base     *Policy // policy as issued by the org, or the built-in defaults
+	source   Source
+	origins  map[string]Source
+	override *Override
+
+	// Conditional fetch state from the last successful response
+	etag         string
+	lastModified string
+	nextRefresh  time.Duration
+
+	subMu       sync.Mutex
+	subscribers map[int]func(Change)
+	nextSubID   int
 }
 
 // Policy represents the agent's runtime configuration
 type Policy struct {
-	Version    string                     `json:"version"`
-	UpdatedAt  time.Time                  `json:"updated_at"`
-	Collectors map[string]CollectorPolicy `json:"collectors"`
-	Update     UpdatePolicy               `json:"update"`
-	Telemetry  TelemetryPolicy            `json:"telemetry"`
+	SchemaVersion int                        `json:"schema_version"`
+	Version       string                     `json:"version"`
+	UpdatedAt     time.Time                  `json:"updated_at"`
+	Collectors    map[string]CollectorPolicy `json:"collectors"`
+	Update        UpdatePolicy               `json:"update"`
+	Telemetry     TelemetryPolicy            `json:"telemetry"`
+	Identity      IdentityPolicy             `json:"identity"`
 }
 
 // CollectorPolicy defines settings for a specific collector
 type CollectorPolicy struct {
 	Enabled  bool                   `json:"enabled"`
 	Interval time.Duration          `json:"interval,omitempty"`
+	Priority string                 `json:"priority,omitempty"` // offline buffer retention class: low, normal or high
 	Options  map[string]interface{} `json:"options,omitempty"`
 }
 
@@ -47,22 +82,144 @@ type UpdatePolicy struct {
 
 // TelemetryPolicy defines data transmission settings
 type TelemetryPolicy struct {
-	BatchSize     int           `json:"batch_size"`
-	FlushInterval time.Duration `json:"flush_interval"`
+	BatchSize     int           `json:"batch_size"`                // records per batch
+	MaxBatchBytes int           `json:"max_batch_bytes,omitempty"` // uncompressed JSON bytes per batch; zero uses the default
+	FlushInterval time.Duration `json:"flush_interval"`            // longest a record waits before its batch is sent
 	Compression   bool          `json:"compression"`
+	Codec         string        `json:"codec,omitempty"` // gzip (default) or zstd, used when compression is enabled
 }
 
-// NewEngine creates a new policy engine
+// IdentityPolicy defines how the agent protects its identity
+type IdentityPolicy struct {
+	OnFingerprintDrift string `json:"on_fingerprint_drift,omitempty"` // report (default), refuse or rebootstrap
+}
+
+// Change describes a policy transition delivered to subscribers
+type Change struct {
+	Old  *Policy
+	New  *Policy
+	Diff Diff
+}
+
+// Diff summarizes which sections of the policy changed
+type Diff struct {
+	VersionChanged    bool
+	CollectorsAdded   []string // present in the new policy only
+	CollectorsRemoved []string // present in the old policy only
+	CollectorsChanged []string // present in both with different settings
+	UpdateChanged     bool
+	TelemetryChanged  bool
+	IdentityChanged   bool
+}
+
+// NewEngine creates a new policy engine.
+// The last known good policy is loaded from disk if present, so the built-in
+// defaults are only used on hosts that have never fetched a policy. A local
+// override file named in the config is merged on top (see Override).
 func NewEngine(cfg *config.Config, identityMgr *identity.Manager, logger *log.Logger) (*Engine, error) {
-	return &Engine{
-		cfg:      cfg,
-		identity: identityMgr,
-		logger:   logger,
-		current:  defaultPolicy(),
-	}, nil
+	e := &Engine{
+		cfg:         cfg,
+		identity:    identityMgr,
+		logger:      logger,
+		nextRefresh: defaultRefreshInterval,
+		subscribers: make(map[int]func(Change)),
+	}
+
+	// A broken override must not be skipped silently: its locks may be
+	// what keeps sensitive collection disabled on this host
+	if cfg.PolicyOverrideFile != "" {
+		override, err := LoadOverride(cfg.PolicyOverrideFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load policy override: %w", err)
+		}
+		e.override = override
+		logger.Printf("Loaded policy override %s (%d keys, %d locks)",
+			cfg.PolicyOverrideFile, len(override.Keys()), len(override.Locked))
+		for _, lock := range override.UnusedLocks() {
+			logger.Printf("Warning: policy override lock %q has no value to pin and is ignored", lock)
+		}
+	}
+
+	if _, _, err := e.apply(e.loadInitial()); err != nil {
+		// The locked values must hold, so fall back to the defaults under them
+		logger.Printf("Warning: %v, using built-in default policy", err)
+		if _, _, err := e.apply(defaultPolicy(), SourceDefault); err != nil {
+			return nil, fmt.Errorf("failed to load policy override: %w", err)
+		}
+	}
+
+	return e, nil
 }
 
-// Refresh fetches the latest policy from the server
+// loadInitial picks the starting policy: cache, then bootstrap, then defaults
+func (e *Engine) loadInitial() (*Policy, Source) {
+	cached, err := e.loadCached()
+	switch {
+	case err == nil:
+		e.etag = cached.ETag
+		e.lastModified = cached.LastModified
+		e.logger.Printf("Loaded cached policy %s (fetched %s)", cached.Version, cached.FetchedAt.Format(time.RFC3339))
+		return cached.Policy, SourceCache
+	case os.IsNotExist(err):
+		e.logger.Println("No cached policy found")
+	default:
+		e.logger.Printf("Warning: ignoring cached policy: %v", err)
+	}
+
+	// Fall back to the signed policy issued at bootstrap before the built-in defaults
+	p, err := e.loadBootstrapPolicy()
+	if err == nil {
+		e.logger.Printf("Using bootstrap policy %s", p.Version)
+		return p, SourceBootstrap
+	}
+	if !os.IsNotExist(err) {
+		e.logger.Printf("Warning: ignoring bootstrap policy: %v", err)
+	}
+
+	e.logger.Println("Using built-in default policy")
+	return defaultPolicy(), SourceDefault
+}
+
+// SetAuditLogger enables audit events for rejected policies
+func (e *Engine) SetAuditLogger(audit *logging.AuditLogger) {
+	e.audit = audit
+}
+
+// Subscribe registers a callback invoked after every policy change.
+// Callbacks run synchronously on the refreshing goroutine and must not block.
+// The returned function removes the subscription.
+func (e *Engine) Subscribe(fn func(Change)) func() {
+	e.subMu.Lock()
+	defer e.subMu.Unlock()
+
+	id := e.nextSubID
+	e.nextSubID++
+	e.subscribers[id] = fn
+
+	return func() {
+		e.subMu.Lock()
+		defer e.subMu.Unlock()
+		delete(e.subscribers, id)
+	}
+}
+
+// notify delivers a change to all subscribers
+func (e *Engine) notify(change Change) {
+	e.subMu.Lock()
+	subscribers := make([]func(Change), 0, len(e.subscribers))
+	for _, fn := range e.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	e.subMu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(change)
+	}
+}
+
+// Refresh fetches the latest policy from the server.
+// The request is conditional on the last seen ETag / Last-Modified, so an
+// unchanged policy costs a 304 instead of a full download.
 func (e *Engine) Refresh(ctx context.Context) error {
 	e.logger.Println("Refreshing policy from server...")
 
@@ -72,35 +229,276 @@ func (e *Engine) Refresh(ctx context.Context) error {
 	}
 
 	url := e.cfg.APIBaseURL + "/api/v1/policy"
-	req, err := client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	e.mu.RLock()
+	if e.etag != "" {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+	if e.lastModified != "" {
+		req.Header.Set("If-Modified-Since", e.lastModified)
+	}
+	e.mu.RUnlock()
+
+	resp, err := client.Do(req)
 	if err != nil {
+		e.setNextRefresh(defaultRefreshInterval)
 		return fmt.Errorf("failed to fetch policy: %w", err)
 	}
-	defer req.Body.Close()
+	defer resp.Body.Close()
+
+	e.setNextRefresh(refreshInterval(resp, time.Now()))
 
-	if req.StatusCode != 200 {
-		body, _ := io.ReadAll(req.Body)
-		return fmt.Errorf("policy fetch failed with status %d: %s", req.StatusCode, string(body))
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		e.logger.Printf("Policy %s unchanged, next refresh in %v", e.Get().Version, e.NextRefresh())
+		return nil
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("policy fetch failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	var newPolicy Policy
-	if err := json.NewDecoder(req.Body).Decode(&newPolicy); err != nil {
-		return fmt.Errorf("failed to decode policy: %w", err)
+	document, err := io.ReadAll(io.LimitReader(resp.Body, maxPolicySize))
+	if err != nil {
+		return fmt.Errorf("failed to read policy: %w", err)
+	}
+
+	newPolicy, err := e.verify(document)
+	if err == nil {
+		err = e.checkRollback(newPolicy)
+	}
+	if err != nil {
+		e.reject(err)
+		return fmt.Errorf("rejected policy from server: %w", err)
+	}
+
+	if err := e.activate(newPolicy, SourceServer); err != nil {
+		e.reject(err)
+		return fmt.Errorf("rejected policy from server: %w", err)
+	}
+
+	// Only an active policy becomes the last known good one; remembering the
+	// validators of a refused one would keep it behind 304s
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+
+	// Keep a copy so an offline restart doesn't fall back to the defaults
+	if err := e.saveCached(cachedPolicy{
+		Version:      newPolicy.Version,
+		ETag:         etag,
+		LastModified: lastModified,
+		Document:     document,
+	}); err != nil {
+		e.logger.Printf("Warning: failed to cache policy: %v", err)
 	}
 
-	// Update current policy
 	e.mu.Lock()
-	oldVersion := e.current.Version
-	e.current = &newPolicy
+	e.etag = etag
+	e.lastModified = lastModified
 	e.mu.Unlock()
+	return nil
+}
 
-	if oldVersion != newPolicy.Version {
-		e.logger.Printf("Policy updated: %s -> %s", oldVersion, newPolicy.Version)
+// NextRefresh returns how long to wait before the next Refresh, as suggested
+// by the server on the last response
+func (e *Engine) NextRefresh() time.Duration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.nextRefresh
+}
+
+func (e *Engine) setNextRefresh(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.nextRefresh = d
+}
+
+// refreshInterval derives the next refresh delay from Retry-After (on 429/503)
+// or Cache-Control max-age, clamped to sane bounds
+func refreshInterval(resp *http.Response, now time.Time) time.Duration {
+	interval := defaultRefreshInterval
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if d, ok := retry.ParseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			interval = d
+		}
+	} else if d, ok := parseMaxAge(resp.Header.Get("Cache-Control")); ok {
+		interval = d
+	}
+
+	if interval < minRefreshInterval {
+		interval = minRefreshInterval
+	}
+	if interval > maxRefreshInterval {
+		interval = maxRefreshInterval
+	}
+	return interval
+}
+
+// parseMaxAge extracts max-age from a Cache-Control header
+func parseMaxAge(value string) (time.Duration, bool) {
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil || seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// verify checks the document signature against the org CA and validates the policy
+func (e *Engine) verify(document []byte) (*Policy, error) {
+	roots, err := e.identity.CACertPool()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load org CA: %w", err)
 	}
 
+	p, err := VerifyDocument(document, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", p.Version, err)
+	}
+
+	return p, nil
+}
+
+// checkRollback refuses a signed policy older than the active one, so a
+// replayed policy cannot undo a newer one. The built-in defaults carry no
+// issue date and never block a policy.
+func (e *Engine) checkRollback(p *Policy) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.base == nil || e.source == SourceDefault {
+		return nil
+	}
+	if p.UpdatedAt.Before(e.base.UpdatedAt) {
+		return fmt.Errorf("%w: policy %s was updated %s, active policy %s was updated %s", ErrPolicyRollback,
+			p.Version, p.UpdatedAt.Format(time.RFC3339), e.base.Version, e.base.UpdatedAt.Format(time.RFC3339))
+	}
 	return nil
 }
 
+// reject records a policy that was not activated
+func (e *Engine) reject(err error) {
+	e.logger.Printf("Rejected policy, keeping %s: %v", e.Get().Version, err)
+	if e.audit != nil {
+		e.audit.LogPolicyRejected(e.Get().Version, err.Error())
+	}
+}
+
+// activate swaps in a verified policy and notifies subscribers
+func (e *Engine) activate(newBase *Policy, source Source) error {
+	oldPolicy, newPolicy, err := e.apply(newBase, source)
+	if err != nil {
+		return err
+	}
+
+	diff := Compare(oldPolicy, newPolicy)
+	if diff.Empty() {
+		return nil
+	}
+
+	e.logger.Printf("Policy updated: %s -> %s", oldPolicy.Version, newPolicy.Version)
+	e.notify(Change{Old: oldPolicy, New: newPolicy, Diff: diff})
+	return nil
+}
+
+// apply merges the local override over a base policy and makes the result current.
+// If the merge produces an invalid policy the unlocked override values are
+// dropped; if the locked values alone still make it invalid, the base policy
+// is refused and the current policy stays in effect.
+func (e *Engine) apply(base *Policy, source Source) (oldPolicy, newPolicy *Policy, err error) {
+	effective, origins := e.override.Apply(base, source)
+	if err := effective.Validate(); err != nil {
+		e.logger.Printf("Warning: unlocked policy override values ignored, merged policy is invalid: %v", err)
+		effective, origins = e.override.ApplyLocked(base, source)
+		if err := effective.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("policy %s conflicts with locked override values: %w", base.Version, err)
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	oldPolicy = e.current
+	if oldPolicy == nil {
+		oldPolicy = effective
+	}
+	e.current = effective
+	e.base = base
+	e.source = source
+	e.origins = origins
+
+	return oldPolicy, effective, nil
+}
+
+// Origins returns the source of every value in the effective policy,
+// keyed like "collectors.network.options.collect_mac"
+func (e *Engine) Origins() map[string]Source {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	origins := make(map[string]Source, len(e.origins))
+	for key, source := range e.origins {
+		origins[key] = source
+	}
+	return origins
+}
+
+// Compare computes the differences between two policies
+func Compare(oldPolicy, newPolicy *Policy) Diff {
+	diff := Diff{
+		VersionChanged:   oldPolicy.Version != newPolicy.Version,
+		UpdateChanged:    oldPolicy.Update != newPolicy.Update,
+		TelemetryChanged: oldPolicy.Telemetry != newPolicy.Telemetry,
+		IdentityChanged:  oldPolicy.Identity != newPolicy.Identity,
+	}
+
+	for name, newCollector := range newPolicy.Collectors {
+		oldCollector, ok := oldPolicy.Collectors[name]
+		switch {
+		case !ok:
+			diff.CollectorsAdded = append(diff.CollectorsAdded, name)
+		case !reflect.DeepEqual(oldCollector, newCollector):
+			diff.CollectorsChanged = append(diff.CollectorsChanged, name)
+		}
+	}
+	for name := range oldPolicy.Collectors {
+		if _, ok := newPolicy.Collectors[name]; !ok {
+			diff.CollectorsRemoved = append(diff.CollectorsRemoved, name)
+		}
+	}
+
+	sort.Strings(diff.CollectorsAdded)
+	sort.Strings(diff.CollectorsRemoved)
+	sort.Strings(diff.CollectorsChanged)
+
+	return diff
+}
+
+// CollectorsModified reports whether any collector was added, removed or changed
+func (d Diff) CollectorsModified() bool {
+	return len(d.CollectorsAdded) > 0 || len(d.CollectorsRemoved) > 0 || len(d.CollectorsChanged) > 0
+}
+
+// Empty reports whether nothing changed
+func (d Diff) Empty() bool {
+	return !d.VersionChanged && !d.CollectorsModified() && !d.UpdateChanged && !d.TelemetryChanged && !d.IdentityChanged
+}
+
 // Get returns the current policy (thread-safe)
 func (e *Engine) Get() *Policy {
 	e.mu.RLock()
@@ -130,16 +528,58 @@ func (e *Engine) GetCollectorInterval(name string) time.Duration {
 	return e.cfg.CollectionInterval
 }
 
+// GetCollectorPriority returns the offline buffer priority for a collector's data
+func (e *Engine) GetCollectorPriority(name string) buffer.Priority {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	// Priorities are checked by Validate, so a parse error cannot happen here
+	priority, _ := buffer.ParsePriority(e.current.Collectors[name].Priority)
+	return priority
+}
+
+// GetTelemetryPolicy returns the current telemetry settings
+func (e *Engine) GetTelemetryPolicy() TelemetryPolicy {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.current.Telemetry
+}
+
+// GetFingerprintDriftReaction returns how to react when the host fingerprint changes
+func (e *Engine) GetFingerprintDriftReaction() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.current.Identity.OnFingerprintDrift == "" {
+		return identity.DriftReport
+	}
+	return e.current.Identity.OnFingerprintDrift
+}
+
+// GetCollectorOptions returns the policy options for a collector
+func (e *Engine) GetCollectorOptions(name string) map[string]interface{} {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if collectorPolicy, ok := e.current.Collectors[name]; ok {
+		return collectorPolicy.Options
+	}
+	return nil
+}
+
 // defaultPolicy returns a safe default policy
 func defaultPolicy() *Policy {
 	return &Policy{
-		Version:   "1.0.0",
-		UpdatedAt: time.Now(),
+		SchemaVersion: SupportedSchemaVersion,
+		Version:       "1.0.0",
+		UpdatedAt:     time.Now(),
 		Collectors: map[string]CollectorPolicy{
-			"system": {Enabled: true},
-			"cpu":    {Enabled: true, Interval: 60 * time.Second},
-			"memory": {Enabled: true, Interval: 60 * time.Second},
+			"system": {Enabled: true, Interval: 60 * time.Second},
+			"cpu":    {Enabled: true, Interval: 60 * time.Second, Priority: "low"},
+			"memory": {Enabled: true, Interval: 60 * time.Second, Priority: "low"},
 			"disk":   {Enabled: true, Interval: 300 * time.Second},
+			// Collected on every host before collectors were policy-driven
+			"processes": {Enabled: true, Interval: 300 * time.Second},
 			"network": {
 				Enabled:  true,
 				Interval: 60 * time.Second,
@@ -155,8 +595,13 @@ func defaultPolicy() *Policy {
 		},
 		Telemetry: TelemetryPolicy{
 			BatchSize:     100,
+			MaxBatchBytes: 1 << 20,
 			FlushInterval: 5 * time.Minute,
 			Compression:   true,
+			Codec:         "gzip",
+		},
+		Identity: IdentityPolicy{
+			OnFingerprintDrift: identity.DriftReport,
 		},
 	}
 }
@@ -0,0 +1,451 @@
+package policy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/unitechio/agent/internal/config"
+	"github.com/unitechio/agent/internal/identity"
+)
+
+// newTestEngine returns an engine that fetches policies from handler over
+// mTLS, with an agent identity and server certificate issued by pki
+func newTestEngine(t *testing.T, pki *testPKI, handler http.Handler) *Engine {
+	return newTestEngineWithOverride(t, pki, "", handler)
+}
+
+// newTestEngineWithOverride is newTestEngine with a local policy override
+func newTestEngineWithOverride(t *testing.T, pki *testPKI, override string, handler http.Handler) *Engine {
+	t.Helper()
+	dir := t.TempDir()
+
+	serverKey, serverCert := pki.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "backend"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	serverPair, err := tls.X509KeyPair(serverCert, marshalTestKey(t, serverKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverPair}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	cfg := config.NewBootstrapConfig()
+	cfg.APIBaseURL = server.URL
+	cfg.TLSConfig.CertFile = filepath.Join(dir, "certs", "agent.crt")
+	cfg.TLSConfig.KeyFile = filepath.Join(dir, "certs", "agent.key")
+	cfg.TLSConfig.CAFile = filepath.Join(dir, "certs", "ca.crt")
+	cfg.PolicyCacheFile = filepath.Join(dir, "policy.json")
+	if override != "" {
+		cfg.PolicyOverrideFile = filepath.Join(dir, "override.json")
+		os.WriteFile(cfg.PolicyOverrideFile, []byte(override), 0600)
+	}
+
+	agentKey, agentCert := pki.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "test-agent"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	os.MkdirAll(filepath.Dir(cfg.TLSConfig.CertFile), 0700)
+	os.WriteFile(cfg.TLSConfig.CertFile, agentCert, 0600)
+	os.WriteFile(cfg.TLSConfig.KeyFile, marshalTestKey(t, agentKey), 0600)
+	os.WriteFile(cfg.TLSConfig.CAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.caCert.Raw}), 0644)
+
+	logger := log.New(io.Discard, "", 0)
+	identityMgr, err := identity.NewManager(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { identityMgr.Close() })
+
+	e, err := NewEngine(cfg, identityMgr, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func marshalTestKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// serveDocuments answers each policy request with the next document
+func serveDocuments(documents ...[]byte) http.Handler {
+	next := 0
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if next >= len(documents) {
+			http.Error(w, "no more policies", http.StatusNotFound)
+			return
+		}
+		w.Write(documents[next])
+		next++
+	})
+}
+
+// testPolicy returns a valid policy with the given version and issue date
+func testPolicy(version string, updatedAt time.Time) *Policy {
+	p := defaultPolicy()
+	p.Version = version
+	p.UpdatedAt = updatedAt
+	return p
+}
+
+func TestRefreshRejectsRollback(t *testing.T) {
+	pki := newTestPKI(t)
+	now := time.Now().UTC()
+
+	e := newTestEngine(t, pki, serveDocuments(
+		pki.sign(t, testPolicy("2.0", now)),
+		pki.sign(t, testPolicy("1.0", now.Add(-time.Hour))),
+		pki.sign(t, testPolicy("2.1", now.Add(time.Hour))),
+	))
+
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+
+	// A validly signed but older policy is replayed
+	if err := e.Refresh(context.Background()); !errors.Is(err, ErrPolicyRollback) {
+		t.Fatalf("Expected ErrPolicyRollback, got %v", err)
+	}
+	if e.Get().Version != "2.0" {
+		t.Errorf("Expected policy 2.0 to stay active, got %s", e.Get().Version)
+	}
+
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if e.Get().Version != "2.1" {
+		t.Errorf("Expected newer policy 2.1, got %s", e.Get().Version)
+	}
+}
+
+func TestRefreshDoesNotCacheRefusedPolicy(t *testing.T) {
+	pki := newTestPKI(t)
+
+	// The locked cpu collector cannot be enabled without an interval
+	conflicting := testPolicy("2.0", time.Now())
+	conflicting.Collectors["cpu"] = CollectorPolicy{Enabled: false}
+	document := pki.sign(t, conflicting)
+
+	var ifNoneMatch []string
+	e := newTestEngineWithOverride(t, pki, `{
+		"collectors": {"cpu": {"enabled": true}},
+		"locked": ["collectors.cpu.enabled"]
+	}`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", `"v2"`)
+		w.Write(document)
+	}))
+
+	for i := 0; i < 2; i++ {
+		if err := e.Refresh(context.Background()); err == nil {
+			t.Fatal("Expected the conflicting policy to be refused")
+		}
+	}
+
+	if e.Get().Version == "2.0" {
+		t.Error("Expected the refused policy not to be active")
+	}
+	if ifNoneMatch[1] != "" {
+		t.Errorf("Expected no If-None-Match for a refused policy, got %q", ifNoneMatch[1])
+	}
+	if _, err := os.Stat(e.cfg.PolicyCacheFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the refused policy not to be cached, got %v", err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(p *Policy)
+		want   Diff
+	}{
+		{
+			name:   "unchanged",
+			change: func(p *Policy) {},
+			want:   Diff{},
+		},
+		{
+			name:   "version",
+			change: func(p *Policy) { p.Version = "2.0" },
+			want:   Diff{VersionChanged: true},
+		},
+		{
+			name: "collector added",
+			change: func(p *Policy) {
+				p.Collectors["gpu"] = CollectorPolicy{Enabled: true, Interval: time.Minute}
+			},
+			want: Diff{CollectorsAdded: []string{"gpu"}},
+		},
+		{
+			name:   "collector removed",
+			change: func(p *Policy) { delete(p.Collectors, "disk") },
+			want:   Diff{CollectorsRemoved: []string{"disk"}},
+		},
+		{
+			name: "collectors changed",
+			change: func(p *Policy) {
+				p.Collectors["memory"] = CollectorPolicy{Enabled: false}
+				cpu := p.Collectors["cpu"]
+				cpu.Interval = 2 * time.Minute
+				p.Collectors["cpu"] = cpu
+			},
+			want: Diff{CollectorsChanged: []string{"cpu", "memory"}},
+		},
+		{
+			name: "collector options changed",
+			change: func(p *Policy) {
+				network := p.Collectors["network"]
+				network.Options = map[string]interface{}{"collect_mac": true}
+				p.Collectors["network"] = network
+			},
+			want: Diff{CollectorsChanged: []string{"network"}},
+		},
+		{
+			name:   "telemetry batch size",
+			change: func(p *Policy) { p.Telemetry.BatchSize++ },
+			want:   Diff{TelemetryChanged: true},
+		},
+		{
+			name:   "telemetry codec",
+			change: func(p *Policy) { p.Telemetry.Codec = "zstd" },
+			want:   Diff{TelemetryChanged: true},
+		},
+		{
+			name:   "telemetry flush interval",
+			change: func(p *Policy) { p.Telemetry.FlushInterval = time.Hour },
+			want:   Diff{TelemetryChanged: true},
+		},
+		{
+			name:   "update",
+			change: func(p *Policy) { p.Update.Channel = "beta" },
+			want:   Diff{UpdateChanged: true},
+		},
+		{
+			name:   "identity",
+			change: func(p *Policy) { p.Identity.OnFingerprintDrift = "refuse" },
+			want:   Diff{IdentityChanged: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldPolicy := defaultPolicy()
+			newPolicy := oldPolicy.clone()
+			tt.change(newPolicy)
+
+			diff := Compare(oldPolicy, newPolicy)
+			if !reflect.DeepEqual(diff, tt.want) {
+				t.Errorf("Expected %+v, got %+v", tt.want, diff)
+			}
+			if diff.Empty() != reflect.DeepEqual(tt.want, Diff{}) {
+				t.Errorf("Expected Empty() to be %v", !diff.Empty())
+			}
+		})
+	}
+}
+
+func TestRefreshNotifiesSubscribers(t *testing.T) {
+	pki := newTestPKI(t)
+
+	updated := testPolicy("2.0", time.Now())
+	updated.Collectors["memory"] = CollectorPolicy{Enabled: false}
+	updated.Telemetry.BatchSize = 10
+	document := pki.sign(t, updated)
+	e := newTestEngine(t, pki, serveDocuments(document, document))
+
+	var changes []Change
+	unsubscribe := e.Subscribe(func(change Change) {
+		changes = append(changes, change)
+	})
+	defer unsubscribe()
+
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("Expected 1 change, got %d", len(changes))
+	}
+
+	want := Diff{
+		VersionChanged:    true,
+		CollectorsChanged: []string{"memory"},
+		TelemetryChanged:  true,
+	}
+	if !reflect.DeepEqual(changes[0].Diff, want) {
+		t.Errorf("Expected %+v, got %+v", want, changes[0].Diff)
+	}
+	if changes[0].Old.Version != defaultPolicy().Version || changes[0].New.Version != "2.0" {
+		t.Errorf("Expected %s -> 2.0, got %s -> %s", defaultPolicy().Version, changes[0].Old.Version, changes[0].New.Version)
+	}
+
+	// The same policy again is not a change
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if len(changes) != 1 {
+		t.Errorf("Expected no notification for an unchanged policy, got %d changes", len(changes))
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	pki := newTestPKI(t)
+	e := newTestEngine(t, pki, serveDocuments(pki.sign(t, testPolicy("2.0", time.Now()))))
+
+	notified := false
+	unsubscribe := e.Subscribe(func(Change) { notified = true })
+	unsubscribe()
+
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if notified {
+		t.Error("Expected no notification after unsubscribing")
+	}
+}
+
+func TestRefreshRevalidatesWithValidators(t *testing.T) {
+	pki := newTestPKI(t)
+	document := pki.sign(t, testPolicy("2.0", time.Now()))
+	const lastModified = "Mon, 12 Oct 2026 10:00:00 GMT"
+
+	var requests []http.Header
+	e := newTestEngine(t, pki, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Clone())
+		if r.Header.Get("If-None-Match") == `"v2"` {
+			w.Header().Set("Cache-Control", "max-age=600")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v2"`)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Header().Set("Cache-Control", "private, max-age=120")
+		w.Write(document)
+	}))
+
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if requests[0].Get("If-None-Match") != "" || requests[0].Get("If-Modified-Since") != "" {
+		t.Errorf("Expected an unconditional first request, got %v", requests[0])
+	}
+	if e.NextRefresh() != 2*time.Minute {
+		t.Errorf("Expected next refresh in 2m, got %v", e.NextRefresh())
+	}
+
+	notified := false
+	defer e.Subscribe(func(Change) { notified = true })()
+
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if requests[1].Get("If-None-Match") != `"v2"` {
+		t.Errorf("Expected If-None-Match %q, got %q", `"v2"`, requests[1].Get("If-None-Match"))
+	}
+	if requests[1].Get("If-Modified-Since") != lastModified {
+		t.Errorf("Expected If-Modified-Since %q, got %q", lastModified, requests[1].Get("If-Modified-Since"))
+	}
+	if e.Get().Version != "2.0" || notified {
+		t.Errorf("Expected a 304 to keep policy 2.0 without a change, got %s (notified %v)", e.Get().Version, notified)
+	}
+	if e.NextRefresh() != 10*time.Minute {
+		t.Errorf("Expected next refresh in 10m, got %v", e.NextRefresh())
+	}
+}
+
+func TestParseMaxAge(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"max-age=300", 5 * time.Minute, true},
+		{"private, max-age=60", time.Minute, true},
+		{"no-transform,max-age=0", 0, true},
+		{"", 0, false},
+		{"no-cache", 0, false},
+		{"max-age=soon", 0, false},
+		{"max-age=-1", 0, false},
+		{"s-maxage=60", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseMaxAge(tt.header)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseMaxAge(%q) = %v, %v; expected %v, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRefreshInterval(t *testing.T) {
+	now := time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		want   time.Duration
+	}{
+		{"no hint", http.StatusOK, http.Header{}, defaultRefreshInterval},
+		{"max-age", http.StatusOK, http.Header{"Cache-Control": {"max-age=900"}}, 15 * time.Minute},
+		{"max-age on 304", http.StatusNotModified, http.Header{"Cache-Control": {"max-age=900"}}, 15 * time.Minute},
+		{"max-age below minimum", http.StatusOK, http.Header{"Cache-Control": {"max-age=5"}}, minRefreshInterval},
+		{"max-age above maximum", http.StatusOK, http.Header{"Cache-Control": {"max-age=604800"}}, maxRefreshInterval},
+		{"retry-after seconds", http.StatusServiceUnavailable, http.Header{"Retry-After": {"600"}}, 10 * time.Minute},
+		{"retry-after date", http.StatusTooManyRequests, http.Header{"Retry-After": {now.Add(2 * time.Hour).Format(http.TimeFormat)}}, 2 * time.Hour},
+		{"retry-after below minimum", http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}}, minRefreshInterval},
+		{"retry-after above maximum", http.StatusServiceUnavailable, http.Header{"Retry-After": {"172800"}}, maxRefreshInterval},
+		{"retry-after ignored on 200", http.StatusOK, http.Header{"Retry-After": {"600"}}, defaultRefreshInterval},
+		{"max-age ignored on 503", http.StatusServiceUnavailable, http.Header{"Cache-Control": {"max-age=900"}}, defaultRefreshInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: tt.header}
+			if got := refreshInterval(resp, now); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRefreshBacksOffOnServiceUnavailable(t *testing.T) {
+	pki := newTestPKI(t)
+	e := newTestEngine(t, pki, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1800")
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	}))
+
+	if err := e.Refresh(context.Background()); err == nil {
+		t.Fatal("Expected Refresh to fail on 503")
+	}
+	if e.NextRefresh() != 30*time.Minute {
+		t.Errorf("Expected next refresh in 30m, got %v", e.NextRefresh())
+	}
+}
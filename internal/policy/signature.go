@@ -0,0 +1,109 @@
+package policy
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+)
+
+// PolicySigningOID is the extended key usage a certificate needs to sign
+// policies. Agent certificates chain to the same org CA, so chaining alone
+// must not make a certificate a policy signer.
+var PolicySigningOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 59611, 1, 1}
+
+// SignedPolicy is the wire format of a policy document with a detached signature.
+// The signing certificate must chain to the org CA distributed at bootstrap and
+// carry the PolicySigningOID extended key usage.
+type SignedPolicy struct {
+	Policy      json.RawMessage `json:"policy"`       // Exact bytes that were signed
+	Signature   string          `json:"signature"`    // Base64-encoded signature over Policy
+	SigningCert string          `json:"signing_cert"` // PEM-encoded signer certificate
+}
+
+// VerifyDocument checks the signature of a signed policy document against the
+// given CA pool and returns the decoded policy
+func VerifyDocument(document []byte, roots *x509.CertPool) (*Policy, error) {
+	var signed SignedPolicy
+	if err := json.Unmarshal(document, &signed); err != nil {
+		return nil, fmt.Errorf("failed to decode signed policy: %w", err)
+	}
+
+	if len(signed.Policy) == 0 || signed.Signature == "" || signed.SigningCert == "" {
+		return nil, ErrUnsignedPolicy
+	}
+
+	// Verify the signer chains to the org CA
+	block, _ := pem.Decode([]byte(signed.SigningCert))
+	if block == nil {
+		return nil, fmt.Errorf("%w: signing certificate is not PEM", ErrUntrustedSigner)
+	}
+	signer, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUntrustedSigner, err)
+	}
+	if _, err := signer.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUntrustedSigner, err)
+	}
+	if err := checkSignerUsage(signer); err != nil {
+		return nil, err
+	}
+
+	// Verify the detached signature over the raw policy bytes
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	algorithm, err := signatureAlgorithm(signer)
+	if err != nil {
+		return nil, err
+	}
+	if err := signer.CheckSignature(algorithm, signed.Policy, signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	var p Policy
+	if err := json.Unmarshal(signed.Policy, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode policy: %w", err)
+	}
+
+	return &p, nil
+}
+
+// checkSignerUsage requires the policy signing usage and rejects client
+// certificates, which every agent holds
+func checkSignerUsage(cert *x509.Certificate) error {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageClientAuth || usage == x509.ExtKeyUsageAny {
+			return fmt.Errorf("%w: signing certificate is not limited to policy signing", ErrUntrustedSigner)
+		}
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		if oid.Equal(PolicySigningOID) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: signing certificate lacks the policy signing usage", ErrUntrustedSigner)
+}
+
+// signatureAlgorithm returns the SHA-256 based algorithm matching the signer's key
+func signatureAlgorithm(cert *x509.Certificate) (x509.SignatureAlgorithm, error) {
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, nil
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256, nil
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	default:
+		return x509.UnknownSignatureAlgorithm, fmt.Errorf("%w: unsupported signer key type %T", ErrInvalidSignature, cert.PublicKey)
+	}
+}
@@ -0,0 +1,180 @@
+package policy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testPKI is a throwaway org CA with a policy signing certificate
+type testPKI struct {
+	roots      *x509.CertPool
+	caCert     *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	signerKey  *ecdsa.PrivateKey
+	signerCert []byte
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Org CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	pki := &testPKI{roots: roots, caCert: caCert, caKey: caKey}
+	pki.signerKey, pki.signerCert = pki.issue(t, &x509.Certificate{
+		SerialNumber:       big.NewInt(2),
+		Subject:            pkix.Name{CommonName: "Policy Signer"},
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{PolicySigningOID},
+	})
+	return pki
+}
+
+// issue signs a certificate for a new key with the test CA
+func (p *testPKI) issue(t *testing.T, template *x509.Certificate) (*ecdsa.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, p.caCert, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func (p *testPKI) sign(t *testing.T, policy *Policy) []byte {
+	t.Helper()
+
+	body, err := json.Marshal(policy)
+	if err != nil {
+		t.Fatalf("Failed to marshal policy: %v", err)
+	}
+	digest := sha256.Sum256(body)
+	signature, err := ecdsa.SignASN1(rand.Reader, p.signerKey, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign policy: %v", err)
+	}
+
+	document, _ := json.Marshal(SignedPolicy{
+		Policy:      body,
+		Signature:   base64.StdEncoding.EncodeToString(signature),
+		SigningCert: string(p.signerCert),
+	})
+	return document
+}
+
+func TestVerifyDocument(t *testing.T) {
+	pki := newTestPKI(t)
+
+	p, err := VerifyDocument(pki.sign(t, defaultPolicy()), pki.roots)
+	if err != nil {
+		t.Fatalf("Failed to verify signed policy: %v", err)
+	}
+
+	if p.Version != defaultPolicy().Version {
+		t.Errorf("Expected version %s, got %s", defaultPolicy().Version, p.Version)
+	}
+}
+
+func TestVerifyDocumentRejectsTampering(t *testing.T) {
+	pki := newTestPKI(t)
+
+	var signed SignedPolicy
+	json.Unmarshal(pki.sign(t, defaultPolicy()), &signed)
+
+	tampered := defaultPolicy()
+	tampered.Collectors["network"] = CollectorPolicy{
+		Enabled:  true,
+		Interval: time.Minute,
+		Options:  map[string]interface{}{"collect_mac": true},
+	}
+	signed.Policy, _ = json.Marshal(tampered)
+	document, _ := json.Marshal(signed)
+
+	if _, err := VerifyDocument(document, pki.roots); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature, got %v", err)
+	}
+}
+
+func TestVerifyDocumentRejectsUnsigned(t *testing.T) {
+	pki := newTestPKI(t)
+
+	body, _ := json.Marshal(defaultPolicy())
+	document, _ := json.Marshal(SignedPolicy{Policy: body})
+
+	if _, err := VerifyDocument(document, pki.roots); !errors.Is(err, ErrUnsignedPolicy) {
+		t.Errorf("Expected ErrUnsignedPolicy, got %v", err)
+	}
+}
+
+func TestVerifyDocumentRejectsForeignCA(t *testing.T) {
+	pki := newTestPKI(t)
+	other := newTestPKI(t)
+
+	if _, err := VerifyDocument(pki.sign(t, defaultPolicy()), other.roots); !errors.Is(err, ErrUntrustedSigner) {
+		t.Errorf("Expected ErrUntrustedSigner, got %v", err)
+	}
+}
+
+func TestVerifyDocumentRejectsAgentCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+
+	signers := map[string]*x509.Certificate{
+		// What every agent receives at bootstrap and renewal
+		"client auth": {
+			SerialNumber: big.NewInt(3),
+			Subject:      pkix.Name{CommonName: "agent-1234"},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		},
+		"client auth with policy signing": {
+			SerialNumber:       big.NewInt(4),
+			Subject:            pkix.Name{CommonName: "agent-5678"},
+			KeyUsage:           x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			UnknownExtKeyUsage: []asn1.ObjectIdentifier{PolicySigningOID},
+		},
+	}
+	for name, template := range signers {
+		pki.signerKey, pki.signerCert = pki.issue(t, template)
+		if _, err := VerifyDocument(pki.sign(t, defaultPolicy()), pki.roots); !errors.Is(err, ErrUntrustedSigner) {
+			t.Errorf("%s: expected ErrUntrustedSigner, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/unitechio/agent/internal/buffer"
+	"github.com/unitechio/agent/internal/collectors"
+	"github.com/unitechio/agent/internal/identity"
+)
+
+// SupportedSchemaVersion is the newest policy schema this agent understands.
+// Bump it whenever a policy field is added whose absence would change behavior.
+const SupportedSchemaVersion = 1
+
+// Limits enforced on policy values
+const (
+	minCollectorInterval   = 10 * time.Second
+	minUpdateCheckInterval = 1 * time.Minute
+	minFlushInterval       = 1 * time.Second
+	maxBatchSize           = 1000
+	maxBatchBytes          = 16 << 20
+)
+
+var updateChannels = map[string]bool{
+	"stable": true,
+	"beta":   true,
+	"dev":    true,
+}
+
+// compressionCodecs are the request body encodings the sender supports
+var compressionCodecs = map[string]bool{
+	"":     true, // gzip
+	"gzip": true,
+	"zstd": true,
+}
+
+// driftReactions are the reactions to a host fingerprint drift
+var driftReactions = map[string]bool{
+	"":                        true, // report
+	identity.DriftReport:      true,
+	identity.DriftRefuse:      true,
+	identity.DriftRebootstrap: true,
+}
+
+// ValidationError lists every problem found in a policy
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInvalidPolicy, strings.Join(e.Problems, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidPolicy
+}
+
+// Validate checks that a policy is complete and understood by this agent.
+// A policy from a newer schema is refused outright rather than half-applied.
+func (p *Policy) Validate() error {
+	// A missing schema version predates versioning and is treated as 1
+	if p.SchemaVersion > SupportedSchemaVersion {
+		return fmt.Errorf("%w: policy uses schema %d, agent supports up to %d",
+			ErrUnsupportedSchema, p.SchemaVersion, SupportedSchemaVersion)
+	}
+
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if p.Version == "" {
+		addProblem("version is empty")
+	}
+	if p.SchemaVersion < 0 {
+		addProblem("schema_version %d is negative", p.SchemaVersion)
+	}
+
+	// Collectors
+	if p.Collectors == nil {
+		addProblem("collectors section is missing")
+	}
+	known := make(map[string]bool)
+	for _, name := range collectors.Names() {
+		known[name] = true
+	}
+	for name, collector := range p.Collectors {
+		if !known[name] {
+			addProblem("collectors.%s: unknown collector", name)
+			continue
+		}
+		if collector.Enabled && collector.Interval < minCollectorInterval {
+			addProblem("collectors.%s.interval: %v is below the minimum of %v", name, collector.Interval, minCollectorInterval)
+		}
+		if _, err := buffer.ParsePriority(collector.Priority); err != nil {
+			addProblem("collectors.%s.priority: unknown priority %q", name, collector.Priority)
+		}
+	}
+
+	// Update
+	if !updateChannels[p.Update.Channel] {
+		addProblem("update.channel: unknown channel %q", p.Update.Channel)
+	}
+	if p.Update.Enabled && p.Update.CheckInterval < minUpdateCheckInterval {
+		addProblem("update.check_interval: %v is below the minimum of %v", p.Update.CheckInterval, minUpdateCheckInterval)
+	}
+
+	// Telemetry
+	if p.Telemetry.BatchSize < 1 || p.Telemetry.BatchSize > maxBatchSize {
+		addProblem("telemetry.batch_size: %d must be between 1 and %d", p.Telemetry.BatchSize, maxBatchSize)
+	}
+	if p.Telemetry.MaxBatchBytes < 0 || p.Telemetry.MaxBatchBytes > maxBatchBytes {
+		addProblem("telemetry.max_batch_bytes: %d must be between 0 and %d", p.Telemetry.MaxBatchBytes, maxBatchBytes)
+	}
+	if p.Telemetry.FlushInterval < minFlushInterval {
+		addProblem("telemetry.flush_interval: %v is below the minimum of %v", p.Telemetry.FlushInterval, minFlushInterval)
+	}
+	if !compressionCodecs[p.Telemetry.Codec] {
+		addProblem("telemetry.codec: unknown codec %q", p.Telemetry.Codec)
+	}
+
+	// Identity
+	if !driftReactions[p.Identity.OnFingerprintDrift] {
+		addProblem("identity.on_fingerprint_drift: unknown reaction %q", p.Identity.OnFingerprintDrift)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
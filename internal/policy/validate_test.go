@@ -0,0 +1,52 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDefaultPolicyIsValid(t *testing.T) {
+	if err := defaultPolicy().Validate(); err != nil {
+		t.Errorf("Default policy failed validation: %v", err)
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	p := defaultPolicy()
+	p.Collectors["cpu"] = CollectorPolicy{Enabled: true, Interval: 0}
+	p.Collectors["keylogger"] = CollectorPolicy{Enabled: true}
+	p.Update.Channel = "nightly"
+	p.Telemetry.BatchSize = 0
+	p.Telemetry.Codec = "brotli"
+
+	err := p.Validate()
+	if !errors.Is(err, ErrInvalidPolicy) {
+		t.Fatalf("Expected ErrInvalidPolicy, got %v", err)
+	}
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected *ValidationError, got %T", err)
+	}
+	if len(validationErr.Problems) != 5 {
+		t.Errorf("Expected 5 problems, got %d: %v", len(validationErr.Problems), validationErr.Problems)
+	}
+}
+
+func TestValidateRejectsNewerSchema(t *testing.T) {
+	p := defaultPolicy()
+	p.SchemaVersion = SupportedSchemaVersion + 1
+
+	if err := p.Validate(); !errors.Is(err, ErrUnsupportedSchema) {
+		t.Errorf("Expected ErrUnsupportedSchema, got %v", err)
+	}
+}
+
+func TestValidateAllowsDisabledCollectorWithoutInterval(t *testing.T) {
+	p := defaultPolicy()
+	p.Collectors["processes"] = CollectorPolicy{Enabled: false}
+
+	if err := p.Validate(); err != nil {
+		t.Errorf("Disabled collector without interval should be valid: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// matcher implements proxy.no_proxy with the same rules as NO_PROXY: "*"
+// matches everything, an IP or CIDR matches addresses, and a domain matches
+// itself and its subdomains ("corp.example" and ".corp.example" alike). Any
+// entry may end in :port to match only that port.
+type matcher struct {
+	all     bool
+	nets    []*net.IPNet
+	ips     []hostPort
+	domains []hostPort
+}
+
+type hostPort struct {
+	host string
+	port string // empty matches any port
+}
+
+func newMatcher(entries []string) (*matcher, error) {
+	m := &matcher{}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			m.all = true
+			continue
+		}
+
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			m.nets = append(m.nets, ipNet)
+			continue
+		}
+
+		host, port := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			host, port = h, p
+		}
+		host = strings.Trim(host, "[]")
+
+		if net.ParseIP(host) != nil {
+			m.ips = append(m.ips, hostPort{host, port})
+			continue
+		}
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+		if host == "" {
+			return nil, fmt.Errorf("invalid no_proxy entry %q", entry)
+		}
+		m.domains = append(m.domains, hostPort{host, port})
+	}
+	return m, nil
+}
+
+// match reports whether requests to u should bypass the proxy
+func (m *matcher) match(u *url.URL) bool {
+	if m.all {
+		return true
+	}
+
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	portMatches := func(hp hostPort) bool {
+		return hp.port == "" || hp.port == port
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range m.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		for _, hp := range m.ips {
+			if ip.Equal(net.ParseIP(hp.host)) && portMatches(hp) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, hp := range m.domains {
+		if (host == hp.host || strings.HasSuffix(host, "."+hp.host)) && portMatches(hp) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// Limits on PAC files, which come from outside the agent
+const (
+	maxPACSize      = 1 << 20
+	pacTimeout      = time.Second // per FindProxyForURL call
+	pacFetchTimeout = 10 * time.Second
+)
+
+// pacScript evaluates a proxy auto-config file in an embedded JavaScript VM
+type pacScript struct {
+	mu        sync.Mutex // the VM is not safe for concurrent use
+	vm        *goja.Runtime
+	findProxy goja.Callable // FindProxyForURL
+}
+
+// loadPAC reads a PAC file from a path, file:// URL or http(s) URL. PAC
+// files served over http(s) are fetched directly, never through a proxy.
+func loadPAC(location string) (*pacScript, error) {
+	var data []byte
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		client := &http.Client{
+			Timeout:   pacFetchTimeout,
+			Transport: &http.Transport{Proxy: nil},
+		}
+		resp, err := client.Get(location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", location, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch %s: status %d", location, resp.StatusCode)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, maxPACSize)); err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", location, err)
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(strings.TrimPrefix(location, "file://")); err != nil {
+			return nil, fmt.Errorf("failed to read PAC file: %w", err)
+		}
+	}
+	return newPAC(string(data))
+}
+
+// newPAC compiles a PAC file
+func newPAC(source string) (*pacScript, error) {
+	vm := goja.New()
+	registerPACFunctions(vm)
+
+	if _, err := vm.RunString(source); err != nil {
+		return nil, fmt.Errorf("failed to evaluate PAC file: %w", err)
+	}
+	find, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, fmt.Errorf("PAC file does not define FindProxyForURL")
+	}
+	return &pacScript{vm: vm, findProxy: find}, nil
+}
+
+// find runs FindProxyForURL for u and returns the proxy it picks, or nil for DIRECT
+func (p *pacScript) find(u *url.URL) (*url.URL, error) {
+	// Like browsers, hide credentials and, for https, the path and query
+	target := *u
+	target.User = nil
+	if target.Scheme == "https" {
+		target.Path, target.RawPath, target.RawQuery, target.Fragment = "/", "", "", ""
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.vm.ClearInterrupt()
+	timer := time.AfterFunc(pacTimeout, func() {
+		p.vm.Interrupt("FindProxyForURL timed out")
+	})
+	defer timer.Stop()
+
+	result, err := p.findProxy(goja.Undefined(), p.vm.ToValue(target.String()), p.vm.ToValue(u.Hostname()))
+	if err != nil {
+		return nil, err
+	}
+	if goja.IsNull(result) || goja.IsUndefined(result) {
+		return nil, nil
+	}
+	return parsePACResult(result.String())
+}
+
+// parsePACResult returns the first supported entry of a result such as
+// "PROXY proxy.corp.example:3128; DIRECT". SOCKS entries are skipped.
+func parsePACResult(result string) (*url.URL, error) {
+	entries := 0
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		entries++
+
+		switch keyword := strings.ToUpper(fields[0]); {
+		case keyword == "DIRECT":
+			return nil, nil
+		case (keyword == "PROXY" || keyword == "HTTP") && len(fields) == 2:
+			return &url.URL{Scheme: "http", Host: fields[1]}, nil
+		case keyword == "HTTPS" && len(fields) == 2:
+			return &url.URL{Scheme: "https", Host: fields[1]}, nil
+		}
+	}
+
+	// An empty result means DIRECT
+	if entries == 0 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("no supported proxy in PAC result %q", result)
+}
+
+// registerPACFunctions defines the standard PAC helper functions. dateRange
+// is not supported.
+func registerPACFunctions(vm *goja.Runtime) {
+	vm.Set("isPlainHostName", func(host string) bool {
+		return !strings.Contains(host, ".")
+	})
+	vm.Set("dnsDomainIs", func(host, domain string) bool {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+	})
+	vm.Set("localHostOrDomainIs", func(host, hostdom string) bool {
+		host, hostdom = strings.ToLower(host), strings.ToLower(hostdom)
+		return host == hostdom || (!strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."))
+	})
+	vm.Set("isResolvable", func(host string) bool {
+		return resolve(host) != nil
+	})
+	vm.Set("dnsResolve", func(host string) goja.Value {
+		if ip := resolve(host); ip != nil {
+			return vm.ToValue(ip.String())
+		}
+		return goja.Null()
+	})
+	vm.Set("isInNet", func(host, pattern, mask string) bool {
+		ip, network, netmask := resolve(host), net.ParseIP(pattern).To4(), net.ParseIP(mask).To4()
+		if ip == nil || network == nil || netmask == nil {
+			return false
+		}
+		return ip.Mask(net.IPMask(netmask)).Equal(network.Mask(net.IPMask(netmask)))
+	})
+	vm.Set("myIpAddress", func() string {
+		return myIPAddress()
+	})
+	vm.Set("dnsDomainLevels", func(host string) int {
+		return strings.Count(host, ".")
+	})
+	vm.Set("shExpMatch", func(str, shexp string) bool {
+		pattern := regexp.QuoteMeta(shexp)
+		pattern = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(pattern)
+		matched, _ := regexp.MatchString("^"+pattern+"$", str)
+		return matched
+	})
+	vm.Set("weekdayRange", func(call goja.FunctionCall) goja.Value {
+		args, now := pacRangeArgs(call)
+		days := []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+		index := func(day string) int {
+			for i, d := range days {
+				if strings.EqualFold(d, day) {
+					return i
+				}
+			}
+			return -1
+		}
+		if len(args) == 0 {
+			return vm.ToValue(false)
+		}
+		from, to := index(args[0]), index(args[0])
+		if len(args) > 1 {
+			to = index(args[1])
+		}
+		return vm.ToValue(inRange(int(now.Weekday()), from, to))
+	})
+	vm.Set("timeRange", func(call goja.FunctionCall) goja.Value {
+		args, now := pacRangeArgs(call)
+		var hours []int
+		for _, arg := range args {
+			var h int
+			if _, err := fmt.Sscan(arg, &h); err == nil {
+				hours = append(hours, h)
+			}
+		}
+		switch len(hours) {
+		case 1:
+			return vm.ToValue(now.Hour() == hours[0])
+		case 2:
+			// timeRange(9, 17) covers 9:00 to 16:59
+			return vm.ToValue(inRange(now.Hour(), hours[0], hours[1]-1))
+		}
+		panic(vm.NewTypeError("timeRange only supports hour arguments"))
+	})
+	vm.Set("dateRange", func(goja.FunctionCall) goja.Value {
+		panic(vm.NewTypeError("dateRange is not supported"))
+	})
+	vm.Set("alert", func(string) {})
+}
+
+// pacRangeArgs returns the arguments of a *Range function without its
+// trailing "GMT", and the time to compare with
+func pacRangeArgs(call goja.FunctionCall) ([]string, time.Time) {
+	var args []string
+	for _, arg := range call.Arguments {
+		args = append(args, arg.String())
+	}
+	now := time.Now()
+	if len(args) > 0 && strings.EqualFold(args[len(args)-1], "GMT") {
+		args, now = args[:len(args)-1], now.UTC()
+	}
+	return args, now
+}
+
+// inRange reports whether v lies in [from, to], wrapping around if from > to
+func inRange(v, from, to int) bool {
+	if from < 0 || to < 0 {
+		return false
+	}
+	if from <= to {
+		return v >= from && v <= to
+	}
+	return v >= from || v <= to
+}
+
+// resolve returns the IPv4 address of host, which may already be an IP
+func resolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ip := addr.To4(); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// myIPAddress returns the first non-loopback IPv4 address of this host
+func myIPAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "127.0.0.1"
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			if ip := ipNet.IP.To4(); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
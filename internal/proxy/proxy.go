@@ -0,0 +1,120 @@
+// Package proxy decides which HTTP proxy, if any, each agent request goes through.
+//
+// Every agent client (bootstrap, sender, policy, heartbeat, updater) uses a
+// transport whose Proxy function is a Resolver. HTTPS requests are tunneled
+// with HTTP CONNECT; proxy credentials are sent as basic auth. A request is
+// resolved in this order:
+//
+//  1. hosts matching proxy.no_proxy go direct
+//  2. a PAC file (proxy.pac_url) is evaluated locally
+//  3. proxy.url, with proxy.username and proxy.password
+//  4. HTTPS_PROXY, HTTP_PROXY and NO_PROXY from the environment
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/unitechio/agent/internal/config"
+)
+
+// Resolver picks the proxy for each request
+type Resolver struct {
+	proxyURL *url.URL // explicit proxy, with credentials
+	user     *url.Userinfo
+	noProxy  *matcher
+	pac      *pacScript
+	logger   *log.Logger
+}
+
+// New builds a resolver from the proxy configuration. A PAC file that cannot
+// be loaded is logged and skipped, so the agent falls back to proxy.url or
+// the environment rather than not starting.
+func New(cfg config.ProxyConfig, logger *log.Logger) (*Resolver, error) {
+	r := &Resolver{logger: logger}
+
+	if cfg.Username != "" {
+		r.user = url.UserPassword(cfg.Username, cfg.Password)
+	}
+
+	if cfg.URL != "" {
+		u, err := parseProxyURL(cfg.URL)
+		if err != nil {
+			return nil, err
+		}
+		if u.User == nil {
+			u.User = r.user
+		}
+		r.proxyURL = u
+	}
+
+	if len(cfg.NoProxy) > 0 {
+		noProxy, err := newMatcher(cfg.NoProxy)
+		if err != nil {
+			return nil, err
+		}
+		r.noProxy = noProxy
+	}
+
+	if cfg.PACURL != "" {
+		pac, err := loadPAC(cfg.PACURL)
+		if err != nil {
+			logger.Printf("Warning: ignoring proxy PAC file: %v", err)
+		} else {
+			r.pac = pac
+		}
+	}
+
+	switch {
+	case r.pac != nil:
+		logger.Printf("Using proxy PAC file %s", cfg.PACURL)
+	case r.proxyURL != nil:
+		logger.Printf("Using proxy %s", r.proxyURL.Redacted())
+	}
+	return r, nil
+}
+
+// Proxy returns the proxy for a request, or nil to connect directly. It has
+// the signature of http.Transport.Proxy.
+func (r *Resolver) Proxy(req *http.Request) (*url.URL, error) {
+	if r == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	if r.noProxy != nil && r.noProxy.match(req.URL) {
+		return nil, nil
+	}
+
+	if r.pac != nil {
+		proxyURL, err := r.pac.find(req.URL)
+		if err == nil {
+			if proxyURL != nil && proxyURL.User == nil {
+				proxyURL.User = r.user
+			}
+			return proxyURL, nil
+		}
+		r.logger.Printf("Warning: proxy PAC file failed for %s, not using it: %v", req.URL.Host, err)
+	}
+
+	if r.proxyURL != nil {
+		return r.proxyURL, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// parseProxyURL accepts host:port or an http(s) URL
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		// host:port without a scheme
+		if u, err = url.Parse("http://" + raw); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", raw)
+		}
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q (use http or https)", u.Scheme)
+	}
+	return u, nil
+}
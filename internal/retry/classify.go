@@ -0,0 +1,138 @@
+package retry
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxErrorBody caps how much of an error response is kept for the message
+const maxErrorBody = 4 << 10
+
+// StatusError is an unexpected HTTP response
+type StatusError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // zero if the server did not ask for a delay
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("server returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("server returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// NewStatusError builds a StatusError from a response, reading (part of)
+// its body and any Retry-After header
+func NewStatusError(resp *http.Response) *StatusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	e := &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	if d, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		e.RetryAfter = d
+	}
+	return e
+}
+
+// permanentError marks an error as not worth retrying
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not retryable, e.g. a response that can never be parsed
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsRetryable reports whether an operation that failed with err may succeed
+// if tried again. Network errors, 408, 429 and 5xx responses are retried;
+// other 4xx responses, certificate errors, cancellation and errors marked
+// Permanent are not. Unknown errors are retried.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var status *StatusError
+	if errors.As(err, &status) {
+		return retryableStatus(status.StatusCode)
+	}
+
+	// A certificate the server presents will not become valid by retrying
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCert x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &invalidCert) || errors.As(err, &hostname) {
+		return false
+	}
+
+	// Connection refused, resets, timeouts and DNS failures are usually transient
+	return true
+}
+
+// retryableStatus reports whether a response status is worth retrying
+func retryableStatus(code int) bool {
+	switch {
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return true
+	case code == http.StatusNotImplemented, code == http.StatusHTTPVersionNotSupported:
+		return false
+	case code >= 500:
+		return true
+	default:
+		return false
+	}
+}
+
+// RetryAfter returns the delay requested by the server, if any
+func RetryAfter(err error) (time.Duration, bool) {
+	var status *StatusError
+	if errors.As(err, &status) && status.RetryAfter > 0 {
+		return status.RetryAfter, true
+	}
+	return 0, false
+}
+
+// StatusCode returns the HTTP status of err, or 0 if it is not a StatusError
+func StatusCode(err error) int {
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.StatusCode
+	}
+	return 0
+}
+
+// ParseRetryAfter accepts both delay-seconds and HTTP-date forms
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return at.Sub(now), true
+	}
+	return 0, false
+}
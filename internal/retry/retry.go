@@ -0,0 +1,129 @@
+// Package retry runs operations with exponential backoff, retrying only
+// errors that are worth retrying and honoring server-requested delays.
+package retry
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Config holds one caller's retry settings
+type Config struct {
+	InitialDelay  time.Duration // delay before the first retry
+	MaxDelay      time.Duration // maximum backoff between retries
+	MaxAttempts   int           // attempts in total, including the first
+	Multiplier    float64       // backoff multiplier (e.g. 2.0 for doubling)
+	Jitter        bool          // add ±25% random jitter to prevent thundering herds
+	MaxRetryAfter time.Duration // cap on a server-requested Retry-After; zero uses MaxDelay
+
+	// Hooks for logging and metrics; either may be nil
+	OnAttempt func(Attempt)
+	OnOutcome func(Outcome)
+}
+
+// Attempt describes one finished attempt
+type Attempt struct {
+	Number    int           // 1-based
+	Err       error         // nil on success
+	Retryable bool          // whether Err will be retried
+	Delay     time.Duration // wait before the next attempt, if any
+}
+
+// Outcome describes a finished operation
+type Outcome struct {
+	Attempts int
+	Err      error // nil on success
+	Elapsed  time.Duration
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable,
+// runs out of attempts or ctx is done
+func Do(ctx context.Context, cfg Config, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	attempts := 0
+
+	finish := func(err error) error {
+		if cfg.OnOutcome != nil {
+			cfg.OnOutcome(Outcome{Attempts: attempts, Err: err, Elapsed: time.Since(start)})
+		}
+		return err
+	}
+
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	for {
+		attempts++
+		err := fn(ctx)
+
+		attempt := Attempt{Number: attempts, Err: err}
+		if err != nil {
+			attempt.Retryable = IsRetryable(err) && attempts < maxAttempts && ctx.Err() == nil
+			if attempt.Retryable {
+				attempt.Delay = cfg.delay(attempts-1, err)
+			}
+		}
+		if cfg.OnAttempt != nil {
+			cfg.OnAttempt(attempt)
+		}
+
+		switch {
+		case err == nil:
+			return finish(nil)
+		case ctx.Err() != nil:
+			return finish(fmt.Errorf("retry cancelled: %w", err))
+		case !IsRetryable(err):
+			return finish(err)
+		case attempts >= maxAttempts:
+			return finish(fmt.Errorf("max retry attempts (%d) exceeded: %w", maxAttempts, err))
+		}
+
+		timer := time.NewTimer(attempt.Delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return finish(fmt.Errorf("retry cancelled: %w", ctx.Err()))
+		case <-timer.C:
+		}
+	}
+}
+
+// delay returns the wait after the given failed attempt (0-based). A
+// server-requested Retry-After replaces the backoff.
+func (cfg Config) delay(attempt int, err error) time.Duration {
+	if d, ok := RetryAfter(err); ok {
+		limit := cfg.MaxRetryAfter
+		if limit <= 0 {
+			limit = cfg.MaxDelay
+		}
+		if limit > 0 && d > limit {
+			d = limit
+		}
+		return d
+	}
+
+	return cfg.backoff(attempt)
+}
+
+// backoff computes the exponential delay for an attempt with optional jitter
+func (cfg Config) backoff(attempt int) time.Duration {
+	// InitialDelay * (Multiplier ^ attempt)
+	delay := float64(cfg.InitialDelay) * math.Pow(cfg.Multiplier, float64(attempt))
+
+	// Cap at max delay
+	if cfg.MaxDelay > 0 && delay > float64(cfg.MaxDelay) {
+		delay = float64(cfg.MaxDelay)
+	}
+
+	// Add jitter if enabled (±25% random variation)
+	if cfg.Jitter {
+		delay += delay * 0.25 * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(delay)
+}
@@ -0,0 +1,132 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testConfig() Config {
+	return Config{
+		InitialDelay: time.Millisecond,
+		MaxDelay:     10 * time.Millisecond,
+		MaxAttempts:  5,
+		Multiplier:   2.0,
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&StatusError{StatusCode: http.StatusBadRequest}, false},
+		{&StatusError{StatusCode: http.StatusUnauthorized}, false},
+		{&StatusError{StatusCode: http.StatusForbidden}, false},
+		{&StatusError{StatusCode: http.StatusNotFound}, false},
+		{fmt.Errorf("bootstrap rejected: %w", &StatusError{StatusCode: http.StatusForbidden}), false},
+		{errors.New("connection refused"), true},
+		{Permanent(errors.New("malformed response")), false},
+		{context.Canceled, false},
+	}
+
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDoFailsFastOnPermanentError(t *testing.T) {
+	var attempts []Attempt
+	var outcome Outcome
+	cfg := testConfig()
+	cfg.OnAttempt = func(a Attempt) { attempts = append(attempts, a) }
+	cfg.OnOutcome = func(o Outcome) { outcome = o }
+
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		return &StatusError{StatusCode: http.StatusForbidden}
+	})
+
+	if StatusCode(err) != http.StatusForbidden {
+		t.Fatalf("Expected the 403 to be returned, got %v", err)
+	}
+	if len(attempts) != 1 || attempts[0].Retryable {
+		t.Errorf("Expected a single non-retryable attempt, got %+v", attempts)
+	}
+	if outcome.Attempts != 1 || outcome.Err == nil {
+		t.Errorf("Expected a failed outcome after 1 attempt, got %+v", outcome)
+	}
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), testConfig(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return &StatusError{StatusCode: http.StatusBadGateway}
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls)
+	}
+}
+
+func TestDoStopsAfterMaxAttempts(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), testConfig(), func(ctx context.Context) error {
+		calls++
+		return errors.New("connection reset")
+	})
+
+	if err == nil || calls != 5 {
+		t.Errorf("Expected failure after 5 calls, got %d calls: %v", calls, err)
+	}
+}
+
+func TestDoHonorsRetryAfter(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": []string{"120"}},
+		Body:       io.NopCloser(strings.NewReader("slow down")),
+	}
+	statusErr := NewStatusError(resp)
+	if statusErr.RetryAfter != 2*time.Minute || statusErr.Body != "slow down" {
+		t.Fatalf("Unexpected status error: %+v", statusErr)
+	}
+
+	// The requested delay is capped at MaxRetryAfter
+	cfg := testConfig()
+	cfg.MaxRetryAfter = 20 * time.Millisecond
+	var delays []time.Duration
+	cfg.OnAttempt = func(a Attempt) {
+		if a.Retryable {
+			delays = append(delays, a.Delay)
+		}
+	}
+
+	calls := 0
+	Do(context.Background(), cfg, func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			return statusErr
+		}
+		return nil
+	})
+
+	if len(delays) != 1 || delays[0] != 20*time.Millisecond {
+		t.Errorf("Expected one capped 20ms delay, got %v", delays)
+	}
+}
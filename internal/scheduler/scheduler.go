@@ -7,23 +7,38 @@ import (
 	"sync"
 	"time"
 
+	"github.com/unitechio/agent/internal/buffer"
 	"github.com/unitechio/agent/internal/collectors"
 	"github.com/unitechio/agent/internal/config"
 	"github.com/unitechio/agent/internal/identity"
 	"github.com/unitechio/agent/internal/policy"
+	"github.com/unitechio/agent/internal/sender"
 )
 
+// collectorPolicy is the part of the policy engine the scheduler follows
+type collectorPolicy interface {
+	IsCollectorEnabled(name string) bool
+	GetCollectorInterval(name string) time.Duration
+	GetCollectorOptions(name string) map[string]interface{}
+	GetCollectorPriority(name string) buffer.Priority
+	Subscribe(fn func(policy.Change)) func()
+}
+
 // Scheduler manages periodic execution of collectors with jitter
 type Scheduler struct {
-	cfg        *config.Config
-	policy     *policy.Engine
-	identity   *identity.Manager
-	logger     *log.Logger
-	collectors []collectors.Collector
-	stopCh     chan struct{}
-	wg         sync.WaitGroup
-	mu         sync.Mutex
-	running    bool
+	cfg         *config.Config
+	policy      collectorPolicy
+	identity    *identity.Manager
+	logger      *log.Logger
+	sender      *sender.Sender
+	collectors  []collectors.Collector
+	jobs        map[string]*Job
+	ctx         context.Context
+	unsubscribe func()
+	stopCh      chan struct{}
+	wg          sync.WaitGroup
+	mu          sync.Mutex
+	running     bool
 }
 
 // Job represents a scheduled collection job
@@ -36,13 +51,15 @@ type Job struct {
 }
 
 // New creates a new scheduler
-func New(cfg *config.Config, policyEngine *policy.Engine, identityMgr *identity.Manager, logger *log.Logger) *Scheduler {
+func New(cfg *config.Config, policyEngine *policy.Engine, identityMgr *identity.Manager, snd *sender.Sender, logger *log.Logger) *Scheduler {
 	return &Scheduler{
 		cfg:        cfg,
 		policy:     policyEngine,
 		identity:   identityMgr,
 		logger:     logger,
+		sender:     snd,
 		collectors: collectors.NewDefaultCollectors(),
+		jobs:       make(map[string]*Job),
 		stopCh:     make(chan struct{}),
 	}
 }
@@ -58,19 +75,76 @@ func (s *Scheduler) Start(ctx context.Context) error {
 
 	s.logger.Println("Starting scheduler...")
 	s.running = true
+	s.ctx = ctx
 
-	// Start each collector as a separate job
+	// Start a job for each collector enabled by the current policy
 	for _, collector := range s.collectors {
-		s.startCollectorJob(ctx, collector)
+		s.applyPolicy(collector)
 	}
 
+	// Follow collector changes in later policy versions
+	s.unsubscribe = s.policy.Subscribe(s.onPolicyChange)
+
 	return nil
 }
 
-// startCollectorJob starts a periodic job for a collector
-func (s *Scheduler) startCollectorJob(ctx context.Context, collector collectors.Collector) {
-	interval := s.cfg.CollectionInterval
+// onPolicyChange reconciles jobs when the collectors section changes
+func (s *Scheduler) onPolicyChange(change policy.Change) {
+	if change.Diff.CollectorsModified() {
+		s.Reconcile()
+	}
+}
+
+// Reconcile re-reads the current policy and starts, stops or re-times
+// collector jobs so they match it. Jobs whose settings are unchanged keep running.
+func (s *Scheduler) Reconcile() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running {
+		return
+	}
+
+	for _, collector := range s.collectors {
+		s.applyPolicy(collector)
+	}
+}
+
+// applyPolicy brings a single collector's job in line with the current policy.
+// Must be called with s.mu held.
+func (s *Scheduler) applyPolicy(collector collectors.Collector) {
+	name := collector.Name()
+	job, running := s.jobs[name]
+
+	if !s.policy.IsCollectorEnabled(name) {
+		if running {
+			s.logger.Printf("Collector '%s' disabled by policy", name)
+			s.stopJob(job)
+		}
+		return
+	}
 
+	// Options are applied in place; the next collection picks them up
+	if configurable, ok := collector.(collectors.Configurable); ok {
+		configurable.Configure(s.policy.GetCollectorOptions(name))
+	}
+
+	interval := s.policy.GetCollectorInterval(name)
+	if running {
+		if job.Interval == interval {
+			return
+		}
+		s.logger.Printf("Collector '%s' interval changed: %v -> %v", name, job.Interval, interval)
+		s.stopJob(job)
+	}
+
+	// Only collect immediately for newly enabled collectors, not re-timed ones
+	s.startCollectorJob(collector, interval, !running)
+}
+
+// startCollectorJob starts a periodic job for a collector.
+// Must be called with s.mu held.
+func (s *Scheduler) startCollectorJob(collector collectors.Collector, interval time.Duration, runNow bool) {
 	// Add jitter: ±10% of interval
 	jitter := time.Duration(float64(interval) * 0.1 * (rand.Float64()*2 - 1))
 	actualInterval := interval + jitter
@@ -78,20 +152,32 @@ func (s *Scheduler) startCollectorJob(ctx context.Context, collector collectors.
 	s.logger.Printf("Starting collector '%s' with interval %v (jitter: %v)",
 		collector.Name(), actualInterval, jitter)
 
+	job := &Job{
+		Name:      collector.Name(),
+		Interval:  interval,
+		Collector: collector,
+		ticker:    time.NewTicker(actualInterval),
+		stopCh:    make(chan struct{}),
+	}
+	s.jobs[job.Name] = job
+
+	ctx := s.ctx
+
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
+		defer job.ticker.Stop()
 
-		ticker := time.NewTicker(actualInterval)
-		defer ticker.Stop()
-
-		// Run immediately on start
-		s.runCollector(ctx, collector)
+		if runNow {
+			s.runCollector(ctx, collector)
+		}
 
 		for {
 			select {
-			case <-ticker.C:
+			case <-job.ticker.C:
 				s.runCollector(ctx, collector)
+			case <-job.stopCh:
+				return
 			case <-s.stopCh:
 				s.logger.Printf("Stopping collector '%s'", collector.Name())
 				return
@@ -103,6 +189,13 @@ func (s *Scheduler) startCollectorJob(ctx context.Context, collector collectors.
 	}()
 }
 
+// stopJob signals a single job to stop and forgets it.
+// Must be called with s.mu held.
+func (s *Scheduler) stopJob(job *Job) {
+	close(job.stopCh)
+	delete(s.jobs, job.Name)
+}
+
 // runCollector executes a single collection
 func (s *Scheduler) runCollector(ctx context.Context, collector collectors.Collector) {
 	s.logger.Printf("Running collector: %s", collector.Name())
@@ -122,9 +215,18 @@ func (s *Scheduler) runCollector(ctx context.Context, collector collectors.Colle
 
 	s.logger.Printf("Collector '%s' completed in %v", collector.Name(), duration)
 
-	// TODO: Send data to backend via sender
-	// For now, just log the data
-	s.logger.Printf("Collected data from '%s': %+v", collector.Name(), data)
+	// Wrap the result so the backend knows where and when it was collected
+	record := map[string]interface{}{
+		"collector":    collector.Name(),
+		"collected_at": start.UTC(),
+		"duration_ms":  duration.Milliseconds(),
+		"data":         data,
+	}
+
+	priority := s.policy.GetCollectorPriority(collector.Name())
+	if err := s.sender.Send(ctx, priority, record); err != nil {
+		s.logger.Printf("Failed to send data from '%s': %v", collector.Name(), err)
+	}
 }
 
 // Stop gracefully stops the scheduler
@@ -137,6 +239,7 @@ func (s *Scheduler) Stop() {
 	}
 
 	s.logger.Println("Stopping scheduler...")
+	s.unsubscribe()
 	close(s.stopCh)
 
 	// Wait for all jobs to complete (with timeout)
@@ -153,6 +256,7 @@ func (s *Scheduler) Stop() {
 		s.logger.Println("Warning: timeout waiting for collector jobs to stop")
 	}
 
+	s.jobs = make(map[string]*Job)
 	s.running = false
 }
 
@@ -163,9 +267,9 @@ func (s *Scheduler) AddCollector(collector collectors.Collector) {
 
 	s.collectors = append(s.collectors, collector)
 
-	// If scheduler is already running, start this collector immediately
+	// If scheduler is already running, start this collector if policy allows
 	if s.running {
-		s.startCollectorJob(context.Background(), collector)
+		s.applyPolicy(collector)
 	}
 }
 
@@ -177,6 +281,9 @@ func (s *Scheduler) RemoveCollector(name string) {
 	for i, collector := range s.collectors {
 		if collector.Name() == name {
 			s.collectors = append(s.collectors[:i], s.collectors[i+1:]...)
+			if job, ok := s.jobs[name]; ok {
+				s.stopJob(job)
+			}
 			s.logger.Printf("Removed collector: %s", name)
 			return
 		}
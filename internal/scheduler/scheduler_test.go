@@ -0,0 +1,192 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/unitechio/agent/internal/buffer"
+	"github.com/unitechio/agent/internal/collectors"
+	"github.com/unitechio/agent/internal/policy"
+)
+
+// testPolicy is a collectors section the test changes between reconciles
+type testPolicy struct {
+	mu         sync.Mutex
+	collectors map[string]policy.CollectorPolicy
+	subscriber func(policy.Change)
+}
+
+func (p *testPolicy) IsCollectorEnabled(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.collectors[name].Enabled
+}
+
+func (p *testPolicy) GetCollectorInterval(name string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.collectors[name].Interval
+}
+
+func (p *testPolicy) GetCollectorOptions(name string) map[string]interface{} {
+	return nil
+}
+
+func (p *testPolicy) GetCollectorPriority(name string) buffer.Priority {
+	return buffer.PriorityNormal
+}
+
+func (p *testPolicy) Subscribe(fn func(policy.Change)) func() {
+	p.subscriber = fn
+	return func() { p.subscriber = nil }
+}
+
+// set replaces the collectors section and notifies the scheduler
+func (p *testPolicy) set(collectors map[string]policy.CollectorPolicy, diff policy.Diff) {
+	p.mu.Lock()
+	p.collectors = collectors
+	p.mu.Unlock()
+	p.subscriber(policy.Change{Diff: diff})
+}
+
+// testCollector counts collections and never produces data, so nothing is sent
+type testCollector struct {
+	name string
+	runs chan struct{}
+}
+
+func (c *testCollector) Name() string {
+	return c.name
+}
+
+func (c *testCollector) Collect(ctx context.Context) (interface{}, error) {
+	c.runs <- struct{}{}
+	return nil, errors.New("test collector")
+}
+
+func newTestScheduler(p *testPolicy, names ...string) (*Scheduler, map[string]*testCollector) {
+	s := &Scheduler{
+		policy: p,
+		logger: log.New(io.Discard, "", 0),
+		jobs:   make(map[string]*Job),
+		stopCh: make(chan struct{}),
+	}
+	byName := make(map[string]*testCollector)
+	for _, name := range names {
+		c := &testCollector{name: name, runs: make(chan struct{}, 10)}
+		s.collectors = append(s.collectors, collectors.Collector(c))
+		byName[name] = c
+	}
+	return s, byName
+}
+
+// job returns the running job for a collector, or nil
+func (s *Scheduler) job(name string) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[name]
+}
+
+func TestSchedulerFollowsPolicy(t *testing.T) {
+	p := &testPolicy{collectors: map[string]policy.CollectorPolicy{
+		"cpu":    {Enabled: true, Interval: time.Hour},
+		"memory": {Enabled: true, Interval: time.Hour},
+		"disk":   {Enabled: false},
+	}}
+	s, collected := newTestScheduler(p, "cpu", "memory", "disk")
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if s.job("cpu") == nil || s.job("memory") == nil || s.job("disk") != nil {
+		t.Fatalf("Expected jobs for the enabled collectors only, got %v", s.jobs)
+	}
+	<-collected["cpu"].runs // newly enabled collectors run at once
+
+	memory := s.job("memory")
+	p.set(map[string]policy.CollectorPolicy{
+		"cpu":    {Enabled: true, Interval: time.Hour},
+		"memory": {Enabled: false},
+		"disk":   {Enabled: true, Interval: time.Hour},
+	}, policy.Diff{CollectorsChanged: []string{"disk", "memory"}})
+
+	if s.job("memory") != nil {
+		t.Error("Expected the disabled collector's job to stop")
+	}
+	select {
+	case <-memory.stopCh:
+	default:
+		t.Error("Expected the disabled collector's goroutine to be signalled")
+	}
+	if s.job("disk") == nil {
+		t.Error("Expected a job for the newly enabled collector")
+	}
+	select {
+	case <-collected["disk"].runs:
+	case <-time.After(time.Second):
+		t.Error("Expected the newly enabled collector to run at once")
+	}
+}
+
+func TestSchedulerRetimesChangedInterval(t *testing.T) {
+	p := &testPolicy{collectors: map[string]policy.CollectorPolicy{
+		"cpu":    {Enabled: true, Interval: time.Hour},
+		"memory": {Enabled: true, Interval: time.Hour},
+	}}
+	s, collected := newTestScheduler(p, "cpu", "memory")
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	<-collected["cpu"].runs
+	<-collected["memory"].runs
+
+	cpu, memory := s.job("cpu"), s.job("memory")
+	p.set(map[string]policy.CollectorPolicy{
+		"cpu":    {Enabled: true, Interval: 2 * time.Hour},
+		"memory": {Enabled: true, Interval: time.Hour},
+	}, policy.Diff{CollectorsChanged: []string{"cpu"}})
+
+	if job := s.job("cpu"); job == cpu || job.Interval != 2*time.Hour {
+		t.Errorf("Expected a new cpu job every 2h, got %+v", job)
+	}
+	if s.job("memory") != memory {
+		t.Error("Expected the unchanged collector's job to keep running")
+	}
+
+	// A re-timed collector waits for its next tick
+	select {
+	case <-collected["cpu"].runs:
+		t.Error("Expected the re-timed collector not to run at once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSchedulerIgnoresOtherPolicyChanges(t *testing.T) {
+	p := &testPolicy{collectors: map[string]policy.CollectorPolicy{
+		"cpu": {Enabled: true, Interval: time.Hour},
+	}}
+	s, _ := newTestScheduler(p, "cpu")
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// The collectors section is changed without being reported as changed
+	p.set(map[string]policy.CollectorPolicy{
+		"cpu": {Enabled: false},
+	}, policy.Diff{TelemetryChanged: true})
+
+	if s.job("cpu") == nil {
+		t.Error("Expected a telemetry-only change to leave the jobs alone")
+	}
+}
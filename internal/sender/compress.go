@@ -0,0 +1,145 @@
+package sender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/unitechio/agent/internal/policy"
+)
+
+// Codec is a request body encoding
+type Codec string
+
+const (
+	CodecIdentity Codec = "identity"
+	CodecGzip     Codec = "gzip"
+	CodecZstd     Codec = "zstd"
+)
+
+// fallbackCodecs lists the codecs to try, in order, when the server rejects one
+var fallbackCodecs = []Codec{CodecZstd, CodecGzip, CodecIdentity}
+
+// maxDecodedSize caps a decompressed batch, which only happens when a
+// buffered batch is replayed or re-encoded
+const maxDecodedSize = 64 << 20
+
+// Magic numbers that start a compressed payload. Plain batches are JSON
+// objects and always start with '{'.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd creates the shared zstd encoder and decoder on first use
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize))
+	})
+	return zstdErr
+}
+
+// policyCodec returns the codec selected by the telemetry policy
+func policyCodec(p policy.TelemetryPolicy) Codec {
+	if !p.Compression {
+		return CodecIdentity
+	}
+	if p.Codec == string(CodecZstd) {
+		return CodecZstd
+	}
+	return CodecGzip
+}
+
+// contentEncoding returns the Content-Encoding header value for a codec
+func (c Codec) contentEncoding() string {
+	if c == CodecIdentity {
+		return ""
+	}
+	return string(c)
+}
+
+// detectCodec identifies the codec of an encoded batch from its magic number
+func detectCodec(data []byte) Codec {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return CodecGzip
+	case bytes.HasPrefix(data, zstdMagic):
+		return CodecZstd
+	default:
+		return CodecIdentity
+	}
+}
+
+// compress encodes a request body with the given codec
+func compress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecIdentity:
+		return data, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to gzip batch: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("failed to gzip batch: %w", err)
+		}
+		return buf.Bytes(), nil
+	case CodecZstd:
+		if err := initZstd(); err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+}
+
+// decompress decodes a request body encoded with the given codec
+func decompress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecIdentity:
+		return data, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to gunzip batch: %w", err)
+		}
+		defer r.Close()
+
+		decoded, err := io.ReadAll(io.LimitReader(r, maxDecodedSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to gunzip batch: %w", err)
+		}
+		if len(decoded) > maxDecodedSize {
+			return nil, fmt.Errorf("decompressed batch exceeds %d bytes", maxDecodedSize)
+		}
+		return decoded, nil
+	case CodecZstd:
+		if err := initZstd(); err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		decoded, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress zstd batch: %w", err)
+		}
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+}
@@ -0,0 +1,57 @@
+package sender
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"batch_id":"abc","data":[{"cpu":12.5}]}`), 50)
+
+	for _, codec := range fallbackCodecs {
+		encoded, err := compress(codec, data)
+		if err != nil {
+			t.Fatalf("%s: compress failed: %v", codec, err)
+		}
+		if got := detectCodec(encoded); got != codec {
+			t.Errorf("%s: detected codec %s", codec, got)
+		}
+		if codec != CodecIdentity && len(encoded) >= len(data) {
+			t.Errorf("%s: expected compression, got %d of %d bytes", codec, len(encoded), len(data))
+		}
+
+		decoded, err := decompress(codec, encoded)
+		if err != nil {
+			t.Fatalf("%s: decompress failed: %v", codec, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("%s: round trip changed the data", codec)
+		}
+	}
+}
+
+func TestDecodeBufferedKeepsBatchID(t *testing.T) {
+	data := []byte(`{"batch_id":"abc","agent_id":"agent-1","data":[]}`)
+
+	encoded, err := compress(CodecZstd, data)
+	if err != nil {
+		t.Fatalf("Compress failed: %v", err)
+	}
+
+	batch, err := decodeBuffered(encoded)
+	if err != nil {
+		t.Fatalf("decodeBuffered failed: %v", err)
+	}
+	if batch.id != "abc" || batch.codec != CodecZstd {
+		t.Errorf("Expected batch abc with zstd, got %s with %s", batch.id, batch.codec)
+	}
+
+	// Plain batches from older agents get a content-derived ID
+	legacy, err := decodeBuffered([]byte(`{"agent_id":"agent-1","data":[]}`))
+	if err != nil {
+		t.Fatalf("decodeBuffered failed: %v", err)
+	}
+	if legacy.id == "" || legacy.codec != CodecIdentity {
+		t.Errorf("Expected a derived ID and no codec, got %q with %s", legacy.id, legacy.codec)
+	}
+}
@@ -0,0 +1,9 @@
+package sender
+
+import "errors"
+
+var (
+	ErrQueueFull       = errors.New("send queue full")
+	ErrInvalidOverflow = errors.New("invalid send queue overflow policy")
+	ErrStopped         = errors.New("sender stopped")
+)
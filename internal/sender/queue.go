@@ -0,0 +1,283 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/unitechio/agent/internal/buffer"
+)
+
+// Send queue
+//
+// Send only appends to a bounded in-memory queue; a single delivery goroutine
+// (see run) takes batches off the queue and does all network I/O, so a slow
+// or unreachable backend never blocks collectors. When the queue is full the
+// overflow policy decides what gives. A spill is written by the Send call
+// that overflowed, after it releases the queue lock, so other collectors
+// never wait on the disk.
+
+// Overflow decides what Send does when the queue is full
+type Overflow string
+
+const (
+	// OverflowSpill writes the queued records to the disk buffer, to be
+	// delivered once the backend catches up
+	OverflowSpill Overflow = "spill"
+	// OverflowDropOldest discards the oldest queued record
+	OverflowDropOldest Overflow = "drop_oldest"
+	// OverflowBlock waits for the delivery goroutine to make room, up to the
+	// queue timeout, and then fails with ErrQueueFull
+	OverflowBlock Overflow = "block"
+)
+
+// Queue defaults
+const (
+	defaultQueueSize    = 1000
+	defaultQueueTimeout = 5 * time.Second
+)
+
+// ParseOverflow parses an overflow policy, defaulting to OverflowSpill when empty
+func ParseOverflow(name string) (Overflow, error) {
+	switch overflow := Overflow(name); overflow {
+	case "":
+		return OverflowSpill, nil
+	case OverflowSpill, OverflowDropOldest, OverflowBlock:
+		return overflow, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidOverflow, name)
+	}
+}
+
+// QueueStats describes the in-memory send queue
+type QueueStats struct {
+	Depth    int   `json:"depth"`     // records waiting for delivery
+	Bytes    int   `json:"bytes"`     // JSON bytes of those records
+	Capacity int   `json:"capacity"`  // maximum depth
+	MaxDepth int   `json:"max_depth"` // highest depth since startup
+	Spilled  int64 `json:"spilled"`   // records moved to the disk buffer on overflow
+	Dropped  int64 `json:"dropped"`   // records discarded on overflow
+	TimedOut int64 `json:"timed_out"` // Send calls that gave up waiting for room
+}
+
+// queuedRecord is a record waiting to be batched
+type queuedRecord struct {
+	priority buffer.Priority
+	data     json.RawMessage
+	added    time.Time
+}
+
+// Send queues data for transmission. The priority decides how long the data
+// survives in the offline buffer if it cannot be delivered. Send does not
+// wait for the network; with the block overflow policy it may wait for room
+// in the queue until the queue timeout or ctx expires.
+func (s *Sender) Send(ctx context.Context, priority buffer.Priority, data map[string]interface{}) error {
+	record, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal telemetry record: %w", err)
+	}
+
+	s.mu.Lock()
+	spilled, err := s.enqueue(ctx, priority, record)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Records displaced by a spill are written to disk without holding s.mu,
+	// so other collectors are not held up by disk I/O
+	if spilled != nil {
+		defer s.spills.Done()
+		s.spill(spilled)
+	}
+	return nil
+}
+
+// enqueue appends a record, making room first if the queue is full. It
+// returns the batches the spill policy took off the queue, which the caller
+// must spill and then mark done on s.spills. Must be called with s.mu held.
+func (s *Sender) enqueue(ctx context.Context, priority buffer.Priority, record json.RawMessage) ([][]queuedRecord, error) {
+	if s.stopped {
+		return nil, ErrStopped
+	}
+
+	var spilled [][]queuedRecord
+	if len(s.queue) >= s.queueSize {
+		var err error
+		if spilled, err = s.overflow(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	s.queue = append(s.queue, queuedRecord{priority: priority, data: record, added: time.Now()})
+	s.queued += len(record)
+	if len(s.queue) > s.stats.MaxDepth {
+		s.stats.MaxDepth = len(s.queue)
+	}
+
+	// Wake the delivery goroutine to arm its timer or send a full batch
+	telemetry := s.policy.GetTelemetryPolicy()
+	if len(s.queue) == 1 || len(s.queue) >= telemetry.BatchSize || s.queued >= maxBatchBytes(telemetry.MaxBatchBytes) {
+		s.wakeUp()
+	}
+
+	// Stop waits for spills before closing the buffer
+	if spilled != nil {
+		s.spills.Add(1)
+	}
+	return spilled, nil
+}
+
+// overflow makes room in a full queue according to the overflow policy.
+// With the spill policy it returns the batches to write to the disk buffer.
+// Must be called with s.mu held.
+func (s *Sender) overflow(ctx context.Context) ([][]queuedRecord, error) {
+	switch s.overflowPolicy {
+	case OverflowDropOldest:
+		dropped := s.queue[0]
+		s.queue = s.queue[1:]
+		s.queued -= len(dropped.data)
+		s.stats.Dropped++
+		return nil, nil
+
+	case OverflowBlock:
+		timer := time.NewTimer(s.queueTimeout)
+		defer timer.Stop()
+
+		for len(s.queue) >= s.queueSize {
+			freed := s.freed
+			s.mu.Unlock()
+			select {
+			case <-freed:
+				s.mu.Lock()
+			case <-timer.C:
+				s.mu.Lock()
+				s.stats.TimedOut++
+				return nil, fmt.Errorf("%w after waiting %v", ErrQueueFull, s.queueTimeout)
+			case <-ctx.Done():
+				s.mu.Lock()
+				return nil, ctx.Err()
+			}
+			if s.stopped {
+				return nil, ErrStopped
+			}
+		}
+		return nil, nil
+
+	default:
+		// Take everything queued so far; it is delivered from the disk buffer.
+		// Each batch keeps the policy's limits so it can be replayed as is.
+		var spilled [][]queuedRecord
+		for len(s.queue) > 0 {
+			spilled = append(spilled, s.takeBatch())
+		}
+		return spilled, nil
+	}
+}
+
+// spill writes batches straight to the disk buffer without trying to send
+// them. Must be called without s.mu held.
+func (s *Sender) spill(batches [][]queuedRecord) {
+	for _, records := range batches {
+		for _, batch := range s.combine(records) {
+			encoded, err := s.encode(*batch)
+			if err != nil {
+				s.logger.Printf("Dropping telemetry batch: %v", err)
+				continue
+			}
+			if err := s.buffer.WriteBytes(batch.Priority, encoded.body); err != nil {
+				s.logger.Printf("Failed to spill telemetry to buffer: %v", err)
+				continue
+			}
+
+			s.mu.Lock()
+			s.stats.Spilled += int64(len(batch.Data))
+			s.mu.Unlock()
+		}
+	}
+}
+
+// wakeUp re-arms the delivery goroutine's timer
+func (s *Sender) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// maxBatchBytes applies the default to the policy's batch byte size
+func maxBatchBytes(policyBytes int) int {
+	if policyBytes <= 0 {
+		return defaultMaxBatchBytes
+	}
+	return policyBytes
+}
+
+// untilFlush returns how long until the queue holds a batch that is due
+func (s *Sender) untilFlush() time.Duration {
+	telemetry := s.policy.GetTelemetryPolicy()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		return telemetry.FlushInterval
+	}
+	if len(s.queue) >= telemetry.BatchSize || s.queued >= maxBatchBytes(telemetry.MaxBatchBytes) {
+		return 0
+	}
+	if wait := time.Until(s.queue[0].added.Add(telemetry.FlushInterval)); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// takeDue removes and returns the next batch if one is due: the queue holds
+// a full batch by count or bytes, or its oldest record reached the flush
+// interval. With force set, any queued records are returned.
+func (s *Sender) takeDue(force bool) []queuedRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		return nil
+	}
+	if !force {
+		telemetry := s.policy.GetTelemetryPolicy()
+		full := len(s.queue) >= telemetry.BatchSize || s.queued >= maxBatchBytes(telemetry.MaxBatchBytes)
+		if !full && time.Since(s.queue[0].added) < telemetry.FlushInterval {
+			return nil
+		}
+	}
+
+	return s.takeBatch()
+}
+
+// takeBatch removes up to one batch of records from the head of the queue,
+// limited by the policy's batch size and byte size. Must be called with s.mu held.
+func (s *Sender) takeBatch() []queuedRecord {
+	telemetry := s.policy.GetTelemetryPolicy()
+	limit := maxBatchBytes(telemetry.MaxBatchBytes)
+
+	n, bytes := 0, 0
+	for n < len(s.queue) && n < telemetry.BatchSize {
+		size := len(s.queue[n].data)
+		if n > 0 && bytes+size > limit {
+			break
+		}
+		bytes += size
+		n++
+	}
+
+	records := make([]queuedRecord, n)
+	copy(records, s.queue[:n])
+	s.queue = s.queue[n:]
+	s.queued -= bytes
+
+	// Wake any Send blocked on a full queue
+	close(s.freed)
+	s.freed = make(chan struct{})
+
+	return records
+}
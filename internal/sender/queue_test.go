@@ -0,0 +1,200 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unitechio/agent/internal/buffer"
+	"github.com/unitechio/agent/internal/config"
+	"github.com/unitechio/agent/internal/identity"
+	"github.com/unitechio/agent/internal/policy"
+)
+
+// newTestSender returns a sender with the default policy and a queue of two
+// records. It is never started, so nothing is delivered.
+func newTestSender(t *testing.T, overflow Overflow) *Sender {
+	return newTestSenderWithOverride(t, overflow, "")
+}
+
+// newTestSenderWithOverride is newTestSender with a local policy override
+func newTestSenderWithOverride(t *testing.T, overflow Overflow, override string) *Sender {
+	t.Helper()
+	dir := t.TempDir()
+	logger := log.New(io.Discard, "", 0)
+
+	cfg := config.NewBootstrapConfig()
+	cfg.TLSConfig.CertFile = filepath.Join(dir, "certs", "agent.crt")
+	cfg.TLSConfig.KeyFile = filepath.Join(dir, "certs", "agent.key")
+	cfg.TLSConfig.CAFile = filepath.Join(dir, "certs", "ca.crt")
+	cfg.PolicyCacheFile = filepath.Join(dir, "policy.json")
+	if override != "" {
+		cfg.PolicyOverrideFile = filepath.Join(dir, "override.json")
+		if err := os.WriteFile(cfg.PolicyOverrideFile, []byte(override), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	identityMgr, err := identity.NewManager(cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create identity manager: %v", err)
+	}
+	policyEngine, err := policy.NewEngine(cfg, identityMgr, logger)
+	if err != nil {
+		t.Fatalf("Failed to create policy engine: %v", err)
+	}
+	buf, err := buffer.New(filepath.Join(dir, "buffer"), 1<<20, logger)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	t.Cleanup(func() { buf.Close() })
+
+	return &Sender{
+		cfg:            cfg,
+		policy:         policyEngine,
+		identity:       identityMgr,
+		logger:         logger,
+		buffer:         buf,
+		queueSize:      2,
+		queueTimeout:   50 * time.Millisecond,
+		overflowPolicy: overflow,
+		freed:          make(chan struct{}),
+		stats:          QueueStats{Capacity: 2},
+		wake:           make(chan struct{}, 1),
+		stopCh:         make(chan struct{}),
+		rejectedCodecs: make(map[Codec]bool),
+	}
+}
+
+func sendN(t *testing.T, s *Sender, n int) error {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := s.Send(context.Background(), buffer.PriorityNormal, map[string]interface{}{"i": i}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSendSpillsToBufferWhenFull(t *testing.T) {
+	s := newTestSender(t, OverflowSpill)
+
+	if err := sendN(t, s, 3); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	stats := s.Stats()
+	if stats.Queue.Depth != 1 || stats.Queue.Spilled != 2 {
+		t.Errorf("Expected depth 1 and 2 spilled, got %+v", stats.Queue)
+	}
+	if s.buffer.Len() != 1 {
+		t.Errorf("Expected one spilled batch in the buffer, got %d", s.buffer.Len())
+	}
+}
+
+func TestSpilledBatchesKeepBatchLimits(t *testing.T) {
+	const maxBytes = 250
+	s := newTestSenderWithOverride(t, OverflowSpill, `{"telemetry": {"max_batch_bytes": 250}}`)
+	s.queueSize = 10
+
+	pad := strings.Repeat("x", 90)
+	for i := 0; i <= s.queueSize; i++ {
+		if err := s.Send(context.Background(), buffer.PriorityNormal, map[string]interface{}{"i": i, "pad": pad}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if spilled := s.Stats().Queue.Spilled; spilled != int64(s.queueSize) {
+		t.Fatalf("Expected %d spilled records, got %d", s.queueSize, spilled)
+	}
+
+	reader := s.buffer.NewReader()
+	defer reader.Close()
+
+	batches, records := 0, 0
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := decompress(detectCodec(data), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var batch TelemetryBatch
+		if err := json.Unmarshal(raw, &batch); err != nil {
+			t.Fatal(err)
+		}
+
+		size := 0
+		for _, record := range batch.Data {
+			size += len(record)
+		}
+		if size > maxBytes {
+			t.Errorf("Spilled batch holds %d record bytes, more than max_batch_bytes %d", size, maxBytes)
+		}
+		batches++
+		records += len(batch.Data)
+	}
+	if batches < 2 || records != s.queueSize {
+		t.Errorf("Expected %d records split over several batches, got %d in %d", s.queueSize, records, batches)
+	}
+}
+
+func TestSendDropsOldestWhenFull(t *testing.T) {
+	s := newTestSender(t, OverflowDropOldest)
+
+	if err := sendN(t, s, 3); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	stats := s.Stats()
+	if stats.Queue.Depth != 2 || stats.Queue.Dropped != 1 || stats.Queue.MaxDepth != 2 {
+		t.Errorf("Expected depth 2 and 1 dropped, got %+v", stats.Queue)
+	}
+	if string(s.queue[0].data) != `{"i":1}` {
+		t.Errorf("Expected the oldest record to be dropped, head is %s", s.queue[0].data)
+	}
+}
+
+func TestSendBlocksUntilTimeoutWhenFull(t *testing.T) {
+	s := newTestSender(t, OverflowBlock)
+
+	err := sendN(t, s, 3)
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+	if s.Stats().Queue.TimedOut != 1 {
+		t.Errorf("Expected one timed out Send, got %+v", s.Stats().Queue)
+	}
+
+	// Taking a batch makes room for a blocked Send
+	done := make(chan error, 1)
+	go func() { done <- sendN(t, s, 1) }()
+	time.Sleep(10 * time.Millisecond)
+	s.takeDue(true)
+
+	if err := <-done; err != nil {
+		t.Errorf("Expected blocked Send to succeed once room was made, got %v", err)
+	}
+}
+
+func TestStopIsIdempotent(t *testing.T) {
+	s := newTestSender(t, OverflowSpill)
+
+	s.Stop()
+	s.Stop()
+
+	if err := sendN(t, s, 1); !errors.Is(err, ErrStopped) {
+		t.Errorf("Expected ErrStopped after Stop, got %v", err)
+	}
+}
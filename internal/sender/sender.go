@@ -3,6 +3,9 @@ package sender
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,33 +17,144 @@ import (
 	"github.com/unitechio/agent/internal/buffer"
 	"github.com/unitechio/agent/internal/config"
 	"github.com/unitechio/agent/internal/identity"
+	"github.com/unitechio/agent/internal/policy"
+	"github.com/unitechio/agent/internal/retry"
 )
 
-// Sender handles secure transmission of telemetry data
+// Defaults for batching and shutdown
+const (
+	defaultMaxBatchBytes = 1 << 20
+	pruneInterval        = 5 * time.Minute
+	shutdownFlushTimeout = 10 * time.Second
+)
+
+// Sender handles secure transmission of telemetry data. Records are batched
+// until the policy's batch size, byte size or flush interval is reached, and
+// delivered by a background goroutine (see queue.go).
 type Sender struct {
 	cfg      *config.Config
+	policy   *policy.Engine
 	identity *identity.Manager
 	logger   *log.Logger
 	buffer   *buffer.Buffer
 	client   *http.Client
-	mu       sync.Mutex
-	queue    []TelemetryBatch
+
+	mu             sync.Mutex
+	queue          []queuedRecord
+	queued         int           // JSON bytes of the queued records
+	queueSize      int           // maximum queued records
+	queueTimeout   time.Duration // how long Send blocks with OverflowBlock
+	overflowPolicy Overflow
+	freed          chan struct{}  // closed and replaced whenever records leave the queue
+	spills         sync.WaitGroup // spills to the disk buffer in progress outside s.mu
+	stats          QueueStats
+	delivery       DeliveryStats
+	stopped        bool
+	retryConfig    retry.Config
+
+	wake        chan struct{} // re-arms the delivery timer
+	stopCh      chan struct{}
+	done        chan struct{} // closed when the delivery loop exits; nil until Start
+	unsubscribe func()
+
+	// Codecs the server answered 415 Unsupported Media Type to
+	codecMu        sync.Mutex
+	rejectedCodecs map[Codec]bool
 }
 
 // TelemetryBatch represents a batch of telemetry data
 type TelemetryBatch struct {
-	AgentID   string                   `json:"agent_id"`
-	Timestamp time.Time                `json:"timestamp"`
-	Data      []map[string]interface{} `json:"data"`
+	BatchID   string            `json:"batch_id"` // stable across retries, for server-side de-duplication
+	AgentID   string            `json:"agent_id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Data      []json.RawMessage `json:"data"`
+	Priority  buffer.Priority   `json:"-"` // buffer retention class if delivery fails
+}
+
+// encodedBatch is a batch serialized and compressed for the wire. The body
+// is also what gets buffered when delivery fails.
+type encodedBatch struct {
+	id    string
+	body  []byte
+	codec Codec
+}
+
+// Stats describes the sender's delivery state, reported in the heartbeat
+type Stats struct {
+	Queue    QueueStats    `json:"queue"`
+	Delivery DeliveryStats `json:"delivery"`
+	Buffer   buffer.Stats  `json:"buffer"`
+}
+
+// DeliveryStats counts batch deliveries since startup
+type DeliveryStats struct {
+	Sent     int64 `json:"sent"`
+	Retries  int64 `json:"retries"`
+	Failed   int64 `json:"failed"`   // gave up and buffered
+	Rejected int64 `json:"rejected"` // refused by the server and dropped
 }
 
 // NewSender creates a new sender
-func NewSender(cfg *config.Config, identityMgr *identity.Manager, logger *log.Logger) (*Sender, error) {
+func NewSender(cfg *config.Config, policyEngine *policy.Engine, identityMgr *identity.Manager, logger *log.Logger) (*Sender, error) {
 	// Create buffer for offline storage
+	syncPolicy, err := buffer.ParseSyncPolicy(cfg.BufferSync)
+	if err != nil {
+		return nil, err
+	}
+	eviction, err := buffer.ParseEviction(cfg.BufferEviction)
+	if err != nil {
+		return nil, err
+	}
+	overflow, err := ParseOverflow(cfg.SendQueueOverflow)
+	if err != nil {
+		return nil, err
+	}
+	maxAgeByPriority := make(map[buffer.Priority]time.Duration, len(cfg.BufferMaxAgeByPriority))
+	for name, maxAge := range cfg.BufferMaxAgeByPriority {
+		priority, err := buffer.ParsePriority(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid buffer_max_age_by_priority: %w", err)
+		}
+		maxAgeByPriority[priority] = maxAge
+	}
+
+	queueSize := cfg.SendQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	queueTimeout := cfg.SendQueueTimeout
+	if queueTimeout <= 0 {
+		queueTimeout = defaultQueueTimeout
+	}
+
 	buf, err := buffer.New(cfg.BufferDir, cfg.MaxBufferSize, logger)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create buffer: %w", err)
 	}
+	buf.SetSyncPolicy(syncPolicy, cfg.BufferSyncInterval)
+	buf.SetRetention(buffer.Retention{
+		MaxAge:           cfg.BufferMaxAge,
+		MaxAgeByPriority: maxAgeByPriority,
+		Eviction:         eviction,
+	})
+
+	// Encrypt buffered telemetry with a key tied to the agent identity
+	bufferKey, err := identityMgr.BufferKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive buffer key: %w", err)
+	}
+	// The keyring may still be wrapped under an identity replaced while the
+	// agent was stopped; its key is kept until the keyring is re-wrapped
+	previousKey, err := identityMgr.PreviousBufferKey()
+	if err != nil {
+		logger.Printf("Warning: %v", err)
+	}
+	if err := buf.SetEncryptionKey(bufferKey, previousKey); err != nil {
+		return nil, fmt.Errorf("failed to enable buffer encryption: %w", err)
+	}
+	if err := identityMgr.DiscardPreviousKey(); err != nil {
+		logger.Printf("Warning: %v", err)
+	}
 
 	// Get mTLS HTTP client
 	client, err := identityMgr.GetHTTPClient()
@@ -48,72 +162,78 @@ func NewSender(cfg *config.Config, identityMgr *identity.Manager, logger *log.Lo
 		return nil, fmt.Errorf("failed to create HTTP client: %w", err)
 	}
 
-	return &Sender{
-		cfg:      cfg,
-		identity: identityMgr,
-		logger:   logger,
-		buffer:   buf,
-		client:   client,
-		queue:    make([]TelemetryBatch, 0),
-	}, nil
-}
-
-// Send queues data for transmission
-func (s *Sender) Send(ctx context.Context, data map[string]interface{}) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// Add to current batch
-	batch := TelemetryBatch{
-		AgentID:   s.identity.GetAgentID(),
-		Timestamp: time.Now(),
-		Data:      []map[string]interface{}{data},
+	s := &Sender{
+		cfg:            cfg,
+		policy:         policyEngine,
+		identity:       identityMgr,
+		logger:         logger,
+		buffer:         buf,
+		client:         client,
+		queue:          make([]queuedRecord, 0),
+		queueSize:      queueSize,
+		queueTimeout:   queueTimeout,
+		overflowPolicy: overflow,
+		freed:          make(chan struct{}),
+		stats:          QueueStats{Capacity: queueSize},
+		wake:           make(chan struct{}, 1),
+		stopCh:         make(chan struct{}),
+		rejectedCodecs: make(map[Codec]bool),
 	}
+	s.retryConfig = s.newRetryConfig()
 
-	s.queue = append(s.queue, batch)
-
-	// Flush if batch size reached
-	if len(s.queue) >= s.cfg.BatchSize {
-		return s.flush(ctx)
-	}
-
-	return nil
+	return s, nil
 }
 
-// Flush sends all queued data
-func (s *Sender) flush(ctx context.Context) error {
-	if len(s.queue) == 0 {
+// deliver sends records as one batch per priority class, highest first.
+// Batches that cannot be sent are written to the disk buffer. Only the
+// delivery goroutine calls deliver, so batches go out one at a time.
+func (s *Sender) deliver(ctx context.Context, records []queuedRecord) error {
+	if len(records) == 0 {
 		return nil
 	}
 
-	s.logger.Printf("Flushing %d batches to server...", len(s.queue))
+	s.logger.Printf("Sending %d telemetry records...", len(records))
 
-	// Combine all batches
-	combined := TelemetryBatch{
-		AgentID:   s.identity.GetAgentID(),
-		Timestamp: time.Now(),
-		Data:      make([]map[string]interface{}, 0),
-	}
+	batches := s.combine(records)
 
-	for _, batch := range s.queue {
-		combined.Data = append(combined.Data, batch.Data...)
-	}
+	var sendErr, bufErr error
+	for _, batch := range batches {
+		priority := batch.Priority
 
-	// Try to send with retry
-	err := s.sendWithRetry(ctx, combined)
-	if err != nil {
-		// If send fails, save to buffer
-		s.logger.Printf("Failed to send telemetry, buffering: %v", err)
-		if bufErr := s.buffer.Write(combined); bufErr != nil {
-			s.logger.Printf("Failed to buffer data: %v", bufErr)
-			return fmt.Errorf("send failed and buffer failed: %w", bufErr)
+		encoded, err := s.encode(*batch)
+		if err != nil {
+			s.logger.Printf("Dropping telemetry batch: %v", err)
+			continue
+		}
+
+		// Once a send has failed the network is likely down; buffer the rest directly
+		if sendErr == nil {
+			sendErr = s.sendWithRetry(ctx, encoded)
+			if sendErr == nil {
+				s.logger.Printf("Successfully sent %d data points", len(batch.Data))
+				continue
+			}
+			if rejected(sendErr) {
+				s.logger.Printf("Server rejected telemetry batch %s, dropping it: %v", batch.BatchID, sendErr)
+				sendErr = nil
+				continue
+			}
+			s.logger.Printf("Failed to send telemetry, buffering: %v", sendErr)
+		}
+
+		// If send fails, save the encoded body to the buffer
+		if err := s.buffer.WriteBytes(priority, encoded.body); err != nil {
+			s.logger.Printf("Failed to buffer data: %v", err)
+			bufErr = err
 		}
-		return err
 	}
 
-	// Clear queue on success
-	s.queue = make([]TelemetryBatch, 0)
-	s.logger.Printf("Successfully sent %d data points", len(combined.Data))
+	if bufErr != nil {
+		return fmt.Errorf("send failed and buffer failed: %w", bufErr)
+	}
+	if sendErr != nil {
+		return sendErr
+	}
 
 	// Try to flush buffered data
 	s.flushBuffer(ctx)
@@ -121,51 +241,103 @@ func (s *Sender) flush(ctx context.Context) error {
 	return nil
 }
 
-// sendWithRetry sends data with exponential backoff retry
-func (s *Sender) sendWithRetry(ctx context.Context, batch TelemetryBatch) error {
-	maxRetries := 5
-	baseDelay := 1 * time.Second
-
-	var lastErr error
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			// Exponential backoff: 1s, 2s, 4s, 8s, 16s
-			delay := baseDelay * time.Duration(1<<uint(attempt-1))
-			s.logger.Printf("Retry attempt %d/%d after %v", attempt+1, maxRetries, delay)
-
-			select {
-			case <-time.After(delay):
-			case <-ctx.Done():
-				return ctx.Err()
+// combine groups records into one batch per priority class, highest first
+func (s *Sender) combine(records []queuedRecord) []*TelemetryBatch {
+	combined := make(map[buffer.Priority]*TelemetryBatch)
+	for _, record := range records {
+		c, ok := combined[record.priority]
+		if !ok {
+			c = &TelemetryBatch{
+				BatchID:   newBatchID(),
+				AgentID:   s.identity.GetAgentID(),
+				Timestamp: time.Now(),
+				Data:      make([]json.RawMessage, 0),
+				Priority:  record.priority,
 			}
+			combined[record.priority] = c
 		}
+		c.Data = append(c.Data, record.data)
+	}
 
-		err := s.sendBatch(ctx, batch)
-		if err == nil {
-			return nil
+	batches := make([]*TelemetryBatch, 0, len(combined))
+	for priority := buffer.PriorityHigh; priority >= buffer.PriorityLow; priority-- {
+		if batch, ok := combined[priority]; ok {
+			batches = append(batches, batch)
 		}
-
-		lastErr = err
-		s.logger.Printf("Send attempt %d failed: %v", attempt+1, err)
 	}
+	return batches
+}
 
-	return fmt.Errorf("all retry attempts failed: %w", lastErr)
+// sendWithRetry sends a batch, retrying network errors, 429 and 5xx
+// responses with exponential backoff
+func (s *Sender) sendWithRetry(ctx context.Context, batch encodedBatch) error {
+	return retry.Do(ctx, s.retryConfig, func(ctx context.Context) error {
+		return s.sendBatch(ctx, batch)
+	})
 }
 
-// sendBatch sends a single batch to the server
-func (s *Sender) sendBatch(ctx context.Context, batch TelemetryBatch) error {
-	url := s.cfg.APIBaseURL + "/api/v1/telemetry"
+// newRetryConfig returns the sender's retry settings, with hooks that log
+// attempts and feed the delivery counters
+func (s *Sender) newRetryConfig() retry.Config {
+	return retry.Config{
+		InitialDelay:  1 * time.Second,
+		MaxDelay:      16 * time.Second,
+		MaxAttempts:   5,
+		Multiplier:    2.0,
+		Jitter:        true,
+		MaxRetryAfter: time.Minute,
+		OnAttempt: func(a retry.Attempt) {
+			if a.Err == nil {
+				return
+			}
+			s.logger.Printf("Send attempt %d failed: %v", a.Number, a.Err)
+			if a.Retryable {
+				s.mu.Lock()
+				s.delivery.Retries++
+				s.mu.Unlock()
+			}
+		},
+		OnOutcome: func(o retry.Outcome) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			switch {
+			case o.Err == nil:
+				s.delivery.Sent++
+			case rejected(o.Err):
+				s.delivery.Rejected++
+			default:
+				s.delivery.Failed++
+			}
+		},
+	}
+}
 
-	body, err := json.Marshal(batch)
-	if err != nil {
-		return fmt.Errorf("failed to marshal batch: %w", err)
+// rejected reports whether the server refused the batch itself, so sending
+// it again can never succeed. Authentication and routing errors are not
+// batch-specific and leave the batch buffered instead.
+func rejected(err error) bool {
+	switch retry.StatusCode(err) {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	default:
+		return false
 	}
+}
+
+// sendBatch sends a single encoded batch to the server. If the server does
+// not accept the batch's codec, it is re-encoded with the next one.
+func (s *Sender) sendBatch(ctx context.Context, batch encodedBatch) error {
+	url := s.cfg.APIBaseURL + "/api/v1/telemetry"
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(batch.body))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if encoding := batch.codec.contentEncoding(); encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	req.Header.Set("Idempotency-Key", batch.id)
 
 	resp, err := s.client.Do(req)
 	if err != nil {
@@ -173,65 +345,319 @@ func (s *Sender) sendBatch(ctx context.Context, batch TelemetryBatch) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnsupportedMediaType && batch.codec != CodecIdentity {
+		s.rejectCodec(batch.codec)
+
+		reencoded, err := s.reencode(batch)
+		if err != nil {
+			return err
+		}
+		return s.sendBatch(ctx, reencoded)
+	}
+
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(bodyBytes))
+		return retry.NewStatusError(resp)
 	}
 
 	return nil
 }
 
-// flushBuffer attempts to send buffered data
-func (s *Sender) flushBuffer(ctx context.Context) {
-	batches, err := s.buffer.ReadAll()
+// codec returns the codec selected by policy, skipping any the server rejected
+func (s *Sender) codec() Codec {
+	preferred := policyCodec(s.policy.GetTelemetryPolicy())
+
+	s.codecMu.Lock()
+	defer s.codecMu.Unlock()
+
+	usable := false
+	for _, codec := range fallbackCodecs {
+		if codec == preferred {
+			usable = true
+		}
+		if usable && !s.rejectedCodecs[codec] {
+			return codec
+		}
+	}
+	return CodecIdentity
+}
+
+// rejectCodec stops using a codec the server does not accept until restart
+func (s *Sender) rejectCodec(codec Codec) {
+	s.codecMu.Lock()
+	defer s.codecMu.Unlock()
+
+	if !s.rejectedCodecs[codec] {
+		s.logger.Printf("Server does not accept %s request bodies, falling back", codec)
+		s.rejectedCodecs[codec] = true
+	}
+}
+
+// encode serializes a batch and compresses it with the negotiated codec
+func (s *Sender) encode(batch TelemetryBatch) (encodedBatch, error) {
+	data, err := json.Marshal(batch)
 	if err != nil {
-		s.logger.Printf("Failed to read buffer: %v", err)
-		return
+		return encodedBatch{}, fmt.Errorf("failed to marshal batch: %w", err)
+	}
+
+	codec := s.codec()
+	body, err := compress(codec, data)
+	if err != nil {
+		return encodedBatch{}, err
 	}
 
-	if len(batches) == 0 {
+	return encodedBatch{id: batch.BatchID, body: body, codec: codec}, nil
+}
+
+// reencode switches a batch to the currently negotiated codec
+func (s *Sender) reencode(batch encodedBatch) (encodedBatch, error) {
+	data, err := decompress(batch.codec, batch.body)
+	if err != nil {
+		return encodedBatch{}, err
+	}
+
+	codec := s.codec()
+	body, err := compress(codec, data)
+	if err != nil {
+		return encodedBatch{}, err
+	}
+
+	return encodedBatch{id: batch.id, body: body, codec: codec}, nil
+}
+
+// decodeBuffered rebuilds the encoded batch of a buffered record. Records
+// keep the codec they were sent with; older agents buffered plain JSON.
+func decodeBuffered(data []byte) (encodedBatch, error) {
+	codec := detectCodec(data)
+	raw, err := decompress(codec, data)
+	if err != nil {
+		return encodedBatch{}, err
+	}
+
+	var header struct {
+		BatchID string `json:"batch_id"`
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return encodedBatch{}, fmt.Errorf("failed to parse batch: %w", err)
+	}
+
+	// Batches buffered by older agents have no ID; derive a stable one
+	if header.BatchID == "" {
+		header.BatchID = contentBatchID(raw)
+	}
+
+	return encodedBatch{id: header.BatchID, body: data, codec: codec}, nil
+}
+
+// flushBuffer attempts to send buffered data. Each batch is acknowledged as
+// soon as it is delivered, so a failure part-way only resends the remainder.
+func (s *Sender) flushBuffer(ctx context.Context) {
+	pending := s.buffer.Len()
+	if pending == 0 {
 		return
 	}
 
-	s.logger.Printf("Attempting to flush %d buffered batches", len(batches))
+	s.logger.Printf("Attempting to flush %d buffered batches", pending)
+
+	// Stream records rather than loading the whole buffer into memory
+	reader := s.buffer.NewReader()
+	defer reader.Close()
 
-	for _, data := range batches {
-		var batch TelemetryBatch
-		if err := json.Unmarshal(data, &batch); err != nil {
-			s.logger.Printf("Failed to unmarshal buffered batch: %v", err)
+	sent := 0
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.logger.Printf("Failed to read buffer: %v", err)
+			return
+		}
+
+		batch, err := decodeBuffered(data)
+		if err != nil {
+			// Skip it for good; it can never be sent
+			s.logger.Printf("Dropping unreadable buffered batch: %v", err)
+			if err := reader.Ack(); err != nil {
+				s.logger.Printf("Failed to acknowledge buffered batch: %v", err)
+				return
+			}
 			continue
 		}
 
-		if err := s.sendBatch(ctx, batch); err != nil {
-			s.logger.Printf("Failed to send buffered batch: %v", err)
+		err = s.sendBatch(ctx, batch)
+		switch {
+		case err == nil:
+			sent++
+		case rejected(err):
+			// Skip it for good; it would block everything behind it
+			s.logger.Printf("Server rejected buffered batch %s, dropping it: %v", batch.id, err)
+			s.mu.Lock()
+			s.delivery.Rejected++
+			s.mu.Unlock()
+		default:
+			s.logger.Printf("Failed to send buffered batch (%d of %d sent): %v", sent, pending, err)
 			// Stop trying if one fails (network still down)
 			return
 		}
+
+		if err := reader.Ack(); err != nil {
+			s.logger.Printf("Failed to acknowledge buffered batch: %v", err)
+			return
+		}
 	}
 
-	// Clear buffer on success
-	if err := s.buffer.Clear(); err != nil {
-		s.logger.Printf("Failed to clear buffer: %v", err)
-	} else {
-		s.logger.Println("Successfully flushed all buffered data")
+	s.logger.Printf("Successfully flushed %d buffered batches", sent)
+}
+
+// newBatchID returns a random batch ID
+func newBatchID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// Fall back to a time-based ID; uniqueness per agent is enough
+		return fmt.Sprintf("%x", time.Now().UnixNano())
 	}
+	return hex.EncodeToString(id)
+}
+
+// contentBatchID derives a batch ID from the batch's encoded contents
+func contentBatchID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
 }
 
-// Start begins periodic flushing
+// Start begins delivering batches once they are due and re-reads the
+// batching limits whenever the telemetry policy changes
 func (s *Sender) Start(ctx context.Context) {
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		defer ticker.Stop()
+	unsubscribePolicy := s.policy.Subscribe(func(change policy.Change) {
+		if change.Diff.TelemetryChanged {
+			s.wakeUp()
+		}
+	})
+
+	// Re-wrap the buffer keyring when the identity key changes
+	unsubscribeIdentity := s.identity.Subscribe(func(change identity.Change) {
+		if err := s.rotateBufferKey(); err != nil {
+			s.logger.Printf("Warning: failed to rotate buffer key, buffered telemetry may be lost: %v", err)
+		}
+	})
+
+	s.unsubscribe = func() {
+		unsubscribePolicy()
+		unsubscribeIdentity()
+	}
+
+	s.done = make(chan struct{})
+	go s.run(ctx)
+}
+
+// run is the delivery goroutine. It sends a batch whenever one is due and
+// is the only place network I/O happens.
+func (s *Sender) run(ctx context.Context) {
+	defer close(s.done)
+
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+
+	for {
+		timer := time.NewTimer(s.untilFlush())
+
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			// Queue or policy changed; check for a due batch and recompute the deadline
+		case <-prune.C:
+			// Apply the buffer's age and size limits
+			if err := s.buffer.Prune(); err != nil {
+				s.logger.Printf("Failed to prune buffer: %v", err)
+			}
+		case <-s.stopCh:
+			timer.Stop()
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
 
 		for {
-			select {
-			case <-ticker.C:
-				s.mu.Lock()
-				s.flush(ctx)
-				s.mu.Unlock()
-			case <-ctx.Done():
-				return
+			records := s.takeDue(false)
+			if records == nil {
+				break
+			}
+			if err := s.deliver(ctx, records); err != nil {
+				s.logger.Printf("Failed to deliver telemetry: %v", err)
 			}
 		}
-	}()
+	}
+}
+
+// Stop ends delivery, sends whatever is still queued and closes the buffer.
+// Whatever cannot be delivered in time is buffered for the next run. Calls
+// after the first do nothing.
+func (s *Sender) Stop() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	close(s.freed) // release blocked Send calls
+	s.freed = make(chan struct{})
+	s.mu.Unlock()
+
+	if s.unsubscribe != nil {
+		s.unsubscribe()
+	}
+
+	if s.done != nil {
+		close(s.stopCh)
+		<-s.done
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+	defer cancel()
+
+	for {
+		records := s.takeDue(true)
+		if records == nil {
+			break
+		}
+		if err := s.deliver(ctx, records); err != nil {
+			s.logger.Printf("Failed to deliver telemetry on shutdown: %v", err)
+		}
+	}
+
+	// Send calls spilling when Stop began finish before the buffer closes
+	s.spills.Wait()
+	if err := s.buffer.Close(); err != nil {
+		s.logger.Printf("Failed to close buffer: %v", err)
+	}
+}
+
+// rotateBufferKey re-wraps the buffer keyring under the current identity key
+func (s *Sender) rotateBufferKey() error {
+	bufferKey, err := s.identity.BufferKey()
+	if err != nil {
+		return fmt.Errorf("failed to derive buffer key: %w", err)
+	}
+	if err := s.buffer.RotateKey(bufferKey); err != nil {
+		return err
+	}
+	return s.identity.DiscardPreviousKey()
+}
+
+// Stats returns the sender's delivery state
+func (s *Sender) Stats() Stats {
+	s.mu.Lock()
+	queue := s.stats
+	queue.Depth = len(s.queue)
+	queue.Bytes = s.queued
+	delivery := s.delivery
+	s.mu.Unlock()
+
+	return Stats{
+		Queue:    queue,
+		Delivery: delivery,
+		Buffer:   s.buffer.Stats(),
+	}
 }
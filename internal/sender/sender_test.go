@@ -0,0 +1,162 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/unitechio/agent/internal/buffer"
+)
+
+// testBackend records telemetry deliveries and answers each with the next
+// status, repeating the last one
+type testBackend struct {
+	mu       sync.Mutex
+	statuses []int
+	received []string // Idempotency-Key of every request
+}
+
+func (b *testBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.received = append(b.received, r.Header.Get("Idempotency-Key"))
+	status := b.statuses[0]
+	if len(b.statuses) > 1 {
+		b.statuses = b.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (b *testBackend) respond(statuses ...int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.statuses = statuses
+}
+
+func (b *testBackend) requests() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.received...)
+}
+
+// newDeliveringSender returns a test sender that delivers to backend and
+// retries without waiting
+func newDeliveringSender(t *testing.T, backend *testBackend) *Sender {
+	t.Helper()
+	server := httptest.NewServer(backend)
+	t.Cleanup(server.Close)
+
+	s := newTestSender(t, OverflowSpill)
+	s.cfg.APIBaseURL = server.URL
+	s.client = server.Client()
+	s.retryConfig = s.newRetryConfig()
+	s.retryConfig.InitialDelay = time.Millisecond
+	s.retryConfig.MaxDelay = time.Millisecond
+	s.retryConfig.MaxAttempts = 2
+	return s
+}
+
+// bufferBatches writes n encoded batches to the sender's buffer and returns their IDs
+func bufferBatches(t *testing.T, s *Sender, n int) []string {
+	t.Helper()
+	var ids []string
+	for i := 0; i < n; i++ {
+		batch := TelemetryBatch{
+			BatchID:   newBatchID(),
+			Timestamp: time.Now(),
+			Data:      []json.RawMessage{json.RawMessage(fmt.Sprintf(`{"i":%d}`, i))},
+		}
+		encoded, err := s.encode(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.buffer.WriteBytes(buffer.PriorityNormal, encoded.body); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, batch.BatchID)
+	}
+	return ids
+}
+
+func TestDeliverByStatus(t *testing.T) {
+	tests := []struct {
+		status   int
+		buffered int
+		want     DeliveryStats
+	}{
+		{http.StatusOK, 0, DeliveryStats{Sent: 1}},
+		{http.StatusCreated, 0, DeliveryStats{Sent: 1}},
+		{http.StatusServiceUnavailable, 1, DeliveryStats{Retries: 1, Failed: 1}},
+		{http.StatusTooManyRequests, 1, DeliveryStats{Retries: 1, Failed: 1}},
+		{http.StatusUnauthorized, 1, DeliveryStats{Failed: 1}},
+		{http.StatusBadRequest, 0, DeliveryStats{Rejected: 1}},
+		{http.StatusRequestEntityTooLarge, 0, DeliveryStats{Rejected: 1}},
+		{http.StatusUnprocessableEntity, 0, DeliveryStats{Rejected: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			backend := &testBackend{statuses: []int{tt.status}}
+			s := newDeliveringSender(t, backend)
+
+			s.deliver(context.Background(), []queuedRecord{
+				{priority: buffer.PriorityNormal, data: json.RawMessage(`{"cpu":1}`)},
+			})
+
+			if s.buffer.Len() != tt.buffered {
+				t.Errorf("Expected %d buffered batches, got %d", tt.buffered, s.buffer.Len())
+			}
+			if stats := s.Stats().Delivery; stats != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, stats)
+			}
+		})
+	}
+}
+
+func TestFlushBufferAcksOnlyDeliveredBatches(t *testing.T) {
+	backend := &testBackend{statuses: []int{http.StatusOK, http.StatusServiceUnavailable}}
+	s := newDeliveringSender(t, backend)
+	ids := bufferBatches(t, s, 3)
+
+	// The first batch is delivered, the second fails and stops the flush
+	s.flushBuffer(context.Background())
+	if s.buffer.Len() != 2 {
+		t.Fatalf("Expected 2 batches left after a 503, got %d", s.buffer.Len())
+	}
+
+	backend.respond(http.StatusCreated)
+	s.flushBuffer(context.Background())
+	if s.buffer.Len() != 0 {
+		t.Errorf("Expected an empty buffer once the server recovers, got %d", s.buffer.Len())
+	}
+
+	// The failed batch is resent under the same ID
+	want := []string{ids[0], ids[1], ids[1], ids[2]}
+	if got := backend.requests(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected requests %v, got %v", want, got)
+	}
+}
+
+func TestFlushBufferDropsRejectedBatch(t *testing.T) {
+	backend := &testBackend{statuses: []int{http.StatusUnprocessableEntity, http.StatusOK}}
+	s := newDeliveringSender(t, backend)
+	bufferBatches(t, s, 2)
+
+	s.flushBuffer(context.Background())
+
+	if s.buffer.Len() != 0 {
+		t.Errorf("Expected the rejected batch to be dropped, got %d buffered", s.buffer.Len())
+	}
+	if len(backend.requests()) != 2 {
+		t.Errorf("Expected the batch behind the rejected one to be sent, got %d requests", len(backend.requests()))
+	}
+	if rejected := s.Stats().Delivery.Rejected; rejected != 1 {
+		t.Errorf("Expected 1 rejected batch, got %d", rejected)
+	}
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/unitechio/agent/internal/config"
 	"github.com/unitechio/agent/internal/identity"
+	"github.com/unitechio/agent/internal/retry"
 )
 
 // Updater handles auto-update functionality
@@ -82,8 +83,7 @@ func (u *Updater) CheckForUpdate(ctx context.Context) (*UpdateMetadata, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(bodyBytes))
+		return nil, retry.NewStatusError(resp)
 	}
 
 	var metadata UpdateMetadata
@@ -111,7 +111,7 @@ func (u *Updater) DownloadUpdate(ctx context.Context, metadata *UpdateMetadata)
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("download failed with status %d", resp.StatusCode)
+		return "", fmt.Errorf("download failed: %w", retry.NewStatusError(resp))
 	}
 
 	// Create temporary file
@@ -258,10 +258,32 @@ func (u *Updater) Rollback() error {
 	return nil
 }
 
+// retryConfig retries update checks and downloads a few times; the next
+// scheduled check picks up anything that still fails
+func (u *Updater) retryConfig() retry.Config {
+	return retry.Config{
+		InitialDelay: 2 * time.Second,
+		MaxDelay:     30 * time.Second,
+		MaxAttempts:  3,
+		Multiplier:   2.0,
+		Jitter:       true,
+		OnAttempt: func(a retry.Attempt) {
+			if a.Err != nil && a.Retryable {
+				u.logger.Printf("Update request failed, retrying in %v: %v", a.Delay.Round(time.Second), a.Err)
+			}
+		},
+	}
+}
+
 // PerformUpdate orchestrates the entire update process
 func (u *Updater) PerformUpdate(ctx context.Context) error {
 	// Check for update
-	metadata, err := u.CheckForUpdate(ctx)
+	var metadata *UpdateMetadata
+	err := retry.Do(ctx, u.retryConfig(), func(ctx context.Context) error {
+		var checkErr error
+		metadata, checkErr = u.CheckForUpdate(ctx)
+		return checkErr
+	})
 	if err != nil {
 		return fmt.Errorf("failed to check for update: %w", err)
 	}
@@ -272,7 +294,12 @@ func (u *Updater) PerformUpdate(ctx context.Context) error {
 	}
 
 	// Download update
-	tmpFile, err := u.DownloadUpdate(ctx, metadata)
+	var tmpFile string
+	err = retry.Do(ctx, u.retryConfig(), func(ctx context.Context) error {
+		var downloadErr error
+		tmpFile, downloadErr = u.DownloadUpdate(ctx, metadata)
+		return downloadErr
+	})
 	if err != nil {
 		return fmt.Errorf("failed to download update: %w", err)
 	}
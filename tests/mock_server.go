@@ -1,10 +1,15 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
@@ -12,6 +17,8 @@ import (
 	"math/big"
 	"net/http"
 	"time"
+
+	"github.com/unitechio/agent/internal/policy"
 )
 
 // BootstrapRequest matches the agent's request structure
@@ -22,6 +29,7 @@ type BootstrapRequest struct {
 	OS           string `json:"os"`
 	Arch         string `json:"arch"`
 	AgentVersion string `json:"agent_version"`
+	CSR          string `json:"csr"`
 }
 
 // BootstrapResponse matches the agent's expected response
@@ -29,7 +37,6 @@ type BootstrapResponse struct {
 	AgentID     string `json:"agent_id"`
 	APIBaseURL  string `json:"api_base_url"`
 	Certificate string `json:"certificate"`
-	PrivateKey  string `json:"private_key"`
 	CACert      string `json:"ca_cert"`
 	Policy      string `json:"policy"`
 	ExpiresAt   string `json:"expires_at"`
@@ -101,8 +108,25 @@ func handleBootstrap(w http.ResponseWriter, r *http.Request) {
 	// Generate agent ID
 	agentID := fmt.Sprintf("agent-%d", time.Now().Unix())
 
-	// Generate mock certificates
-	cert, key, caCert, err := generateMockCertificates(agentID)
+	// Parse the agent's CSR; the agent keeps its private key
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil {
+		log.Printf("❌ Missing CSR")
+		http.Error(w, "Missing CSR", http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		log.Printf("❌ Invalid CSR: %v", err)
+		http.Error(w, "Invalid CSR", http.StatusBadRequest)
+		return
+	}
+
+	// Generate mock certificates and a bootstrap policy signed under the same CA
+	cert, caCert, signedPolicy, err := generateMockCertificates(agentID, csr.PublicKey)
 	if err != nil {
 		log.Printf("❌ Failed to generate certificates: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -115,9 +139,8 @@ func handleBootstrap(w http.ResponseWriter, r *http.Request) {
 		AgentID:     agentID,
 		APIBaseURL:  "http://localhost:8080", // Point back to this server
 		Certificate: cert,
-		PrivateKey:  key,
 		CACert:      caCert,
-		Policy:      `{"version": "1.0", "rules": []}`,
+		Policy:      signedPolicy,
 		ExpiresAt:   expiresAt.Format(time.RFC3339),
 	}
 
@@ -130,8 +153,9 @@ func handleBootstrap(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-// generateMockCertificates creates self-signed certificates for testing
-func generateMockCertificates(agentID string) (certPEM, keyPEM, caCertPEM string, err error) {
+// generateMockCertificates creates a mock CA, issues the agent certificate
+// for its public key and signs the bootstrap policy
+func generateMockCertificates(agentID string, agentKey any) (certPEM, caCertPEM, signedPolicy string, err error) {
 	// Generate CA private key
 	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -157,12 +181,6 @@ func generateMockCertificates(agentID string) (certPEM, keyPEM, caCertPEM string
 		return "", "", "", err
 	}
 
-	// Generate agent private key
-	agentKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return "", "", "", err
-	}
-
 	// Create agent certificate
 	agentTemplate := x509.Certificate{
 		SerialNumber: big.NewInt(time.Now().Unix()),
@@ -172,19 +190,75 @@ func generateMockCertificates(agentID string) (certPEM, keyPEM, caCertPEM string
 		},
 		NotBefore:   time.Now(),
 		NotAfter:    time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
 
-	agentCertBytes, err := x509.CreateCertificate(rand.Reader, &agentTemplate, &caTemplate, &agentKey.PublicKey, caKey)
+	agentCertBytes, err := x509.CreateCertificate(rand.Reader, &agentTemplate, &caTemplate, agentKey, caKey)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	signedPolicy, err = signMockPolicy(&caTemplate, caKey)
 	if err != nil {
 		return "", "", "", err
 	}
 
 	// Encode to PEM
 	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: agentCertBytes}))
-	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(agentKey)}))
 	caCertPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCertBytes}))
 
-	return certPEM, keyPEM, caCertPEM, nil
+	return certPEM, caCertPEM, signedPolicy, nil
+}
+
+// signMockPolicy issues a policy signing certificate under the mock CA and
+// signs a default policy with it; the agent rejects unsigned policies
+func signMockPolicy(caTemplate *x509.Certificate, caKey *rsa.PrivateKey) (string, error) {
+	signerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	signerTemplate := x509.Certificate{
+		SerialNumber:       big.NewInt(time.Now().UnixNano()),
+		Subject:            pkix.Name{Organization: []string{"Univertech Mock CA"}, CommonName: "Univertech Policy Signer"},
+		NotBefore:          time.Now(),
+		NotAfter:           time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{policy.PolicySigningOID},
+	}
+	signerCertBytes, err := x509.CreateCertificate(rand.Reader, &signerTemplate, caTemplate, &signerKey.PublicKey, caKey)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(policy.Policy{
+		SchemaVersion: policy.SupportedSchemaVersion,
+		Version:       "1.0",
+		UpdatedAt:     time.Now().UTC(),
+		Collectors: map[string]policy.CollectorPolicy{
+			"system":    {Enabled: true, Interval: time.Minute},
+			"cpu":       {Enabled: true, Interval: time.Minute, Priority: "low"},
+			"memory":    {Enabled: true, Interval: time.Minute, Priority: "low"},
+			"disk":      {Enabled: true, Interval: 5 * time.Minute},
+			"network":   {Enabled: true, Interval: time.Minute},
+			"processes": {Enabled: true, Interval: 5 * time.Minute},
+		},
+		Update:    policy.UpdatePolicy{Enabled: false, Channel: "stable"},
+		Telemetry: policy.TelemetryPolicy{BatchSize: 100, FlushInterval: time.Minute, Compression: true},
+	})
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(body)
+	signature, err := ecdsa.SignASN1(rand.Reader, signerKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	document, err := json.Marshal(policy.SignedPolicy{
+		Policy:      body,
+		Signature:   base64.StdEncoding.EncodeToString(signature),
+		SigningCert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signerCertBytes})),
+	})
+	return string(document), err
 }